@@ -0,0 +1,221 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package arm64
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+func newTestFDT() *fdt {
+	return &fdt{
+		reserved: [][2]uint64{{0x80000000, 0x1000}},
+		root: &fdtNode{
+			props: []fdtProperty{
+				{"compatible", []byte("test,board\x00")},
+				{"#address-cells", []byte{0, 0, 0, 2}},
+			},
+			children: []*fdtNode{
+				{name: "memory@80000000", props: []fdtProperty{
+					{"device_type", []byte("memory\x00")},
+					{"reg", []byte{0, 0, 0, 0, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0}},
+				}},
+				{name: "chosen", props: []fdtProperty{
+					{"bootargs", []byte("console=ttyAMA0\x00")},
+					{"linux,initrd-start", be64(0x1000)},
+				}},
+			},
+		},
+	}
+}
+
+func TestFDT(t *testing.T) {
+	want := newTestFDT()
+	b := want.bytes()
+	require.Equal(t, uint32(fdtMagic), binary.BigEndian.Uint32(b))
+	require.Equal(t, uint32(len(b)), binary.BigEndian.Uint32(b[4:]))
+	got, err := parseFDT(b)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	chosen := got.chosen()
+	require.Equal(t, "console=ttyAMA0\x00", string(chosen.get("bootargs")))
+	chosen.set("bootargs", []byte("console=ttyS0\x00"))
+	chosen.set("linux,initrd-start", nil)
+	chosen.set("linux,initrd-end", be64(0x2000))
+	got, err = parseFDT(got.bytes())
+	require.NoError(t, err)
+	chosen = got.chosen()
+	require.Equal(t, "console=ttyS0\x00", string(chosen.get("bootargs")))
+	require.Nil(t, chosen.get("linux,initrd-start"))
+	require.Equal(t, be64(0x2000), chosen.get("linux,initrd-end"))
+
+	// a missing chosen node is created
+	noChosen := newTestFDT()
+	noChosen.root.children = noChosen.root.children[:1]
+	noChosen.chosen().set("bootargs", []byte("quiet\x00"))
+	got, err = parseFDT(noChosen.bytes())
+	require.NoError(t, err)
+	require.Equal(t, "quiet\x00", string(got.chosen().get("bootargs")))
+
+	bad := []struct {
+		name string
+		blob func(b []byte) []byte
+	}{
+		{"magic", func(b []byte) []byte { b[0]++; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-8] }},
+		{"version", func(b []byte) []byte { binary.BigEndian.PutUint32(b[24:], 18); return b }},
+		{"token", func(b []byte) []byte {
+			off := binary.BigEndian.Uint32(b[8:])
+			binary.BigEndian.PutUint32(b[off:], 7)
+			return b
+		}},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFDT(tt.blob(newTestFDT().bytes()))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseImageHeader(t *testing.T) {
+	kernel := make([]byte, 4096)
+	binary.LittleEndian.PutUint64(kernel[8:], 0x80000)
+	binary.LittleEndian.PutUint64(kernel[16:], 0x10000)
+	binary.LittleEndian.PutUint32(kernel[56:], imageMagic)
+	h, err := parseImageHeader(kernel)
+	require.NoError(t, err)
+	require.Equal(t, &imageHeader{textOffset: 0x80000, imageSize: 0x10000}, h)
+
+	// old kernels have no image size
+	binary.LittleEndian.PutUint64(kernel[16:], 0)
+	h, err = parseImageHeader(kernel)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(kernel)), h.imageSize)
+
+	binary.LittleEndian.PutUint64(kernel[16:], 16)
+	_, err = parseImageHeader(kernel)
+	require.Error(t, err)
+
+	kernel[56]++
+	_, err = parseImageHeader(kernel)
+	require.Error(t, err)
+}
+
+func TestParseIOMem(t *testing.T) {
+	iomem := `00000000-0003ffff : reserved
+09000000-09000fff : pl011@9000000
+40000000-bfffffff : System RAM
+  40210000-41b8ffff : Kernel code
+  41b90000-41fdffff : reserved
+  b0000000-b00fffff : reserved
+100000000-13fffffff : System RAM
+`
+	mem, err := parseIOMem(strings.NewReader(iomem))
+	require.NoError(t, err)
+	require.Equal(t, kexec.MemoryMap{
+		{Range: kexec.Range{Start: 0, Size: 0x40000}, Type: kexec.RangeReserved},
+		{Range: kexec.Range{Start: 0x40000000, Size: 0x1b90000}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x41b90000, Size: 0x450000}, Type: kexec.RangeReserved},
+		{Range: kexec.Range{Start: 0x41fe0000, Size: 0x6e020000}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0xb0000000, Size: 0x100000}, Type: kexec.RangeReserved},
+		{Range: kexec.Range{Start: 0xb0100000, Size: 0xff00000}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x100000000, Size: 0x40000000}, Type: kexec.RangeRAM},
+	}, mem)
+
+	// segments are never placed in reserved ranges
+	m := kexec.Memory{Phys: mem}
+	for _, r := range m.AvailableRAM() {
+		for _, res := range mem.FilterByType(kexec.RangeReserved) {
+			require.False(t, r.Overlaps(res), "%v overlaps %v", r, res)
+		}
+	}
+
+	_, err = parseIOMem(strings.NewReader("09000000-09000fff : pl011@9000000\n"))
+	require.Error(t, err)
+	_, err = parseIOMem(strings.NewReader("40000000 : System RAM\n"))
+	require.Error(t, err)
+}
+
+func TestSetupChosen(t *testing.T) {
+	dt := newTestFDT()
+	chosen := dt.chosen()
+	chosen.set("linux,uefi-system-table", be64(0xdead))
+	chosen.set("linux,uefi-mmap-desc-ver", []byte{0, 0, 0, 1})
+	chosen.set("rng-seed", make([]byte, 32))
+
+	running := newTestFDT()
+	runningChosen := running.chosen()
+	runningChosen.set("linux,uefi-system-table", be64(0xbf7f0018))
+	runningChosen.set("linux,uefi-mmap-start", be64(0xbf000000))
+	runningChosen.set("linux,uefi-mmap-size", []byte{0, 0, 0x0c, 0})
+	runningChosen.set("linux,uefi-mmap-desc-size", []byte{0, 0, 0, 0x30})
+	runningChosen.set("linux,uefi-mmap-desc-ver", []byte{0, 0, 0, 1})
+	runningChosen.set("kaslr-seed", make([]byte, 8))
+
+	require.NoError(t, setupChosen(chosen, running, "console=ttyS0"))
+	got, err := parseFDT(dt.bytes())
+	require.NoError(t, err)
+	chosen = got.chosen()
+	require.Equal(t, "console=ttyS0\x00", string(chosen.get("bootargs")))
+	require.Nil(t, chosen.get("linux,initrd-start"))
+	for _, p := range runningChosen.props {
+		if strings.HasPrefix(p.name, uefiPrefix) {
+			require.Equal(t, p.value, chosen.get(p.name), p.name)
+		}
+	}
+	require.Len(t, chosen.get("kaslr-seed"), 8)
+	require.NotEqual(t, make([]byte, 8), chosen.get("kaslr-seed"))
+	require.Len(t, chosen.get("rng-seed"), 32)
+	require.NotEqual(t, make([]byte, 32), chosen.get("rng-seed"))
+
+	// without a running device tree, stale UEFI properties are removed
+	require.NoError(t, setupChosen(chosen, nil, ""))
+	require.Nil(t, chosen.get("bootargs"))
+	for _, p := range chosen.props {
+		require.False(t, strings.HasPrefix(p.name, uefiPrefix), p.name)
+	}
+}
+
+func TestRunningFDT(t *testing.T) {
+	defer func(p string) { fdtPath = p }(fdtPath)
+	dir := t.TempDir()
+
+	fdtPath = filepath.Join(dir, "fdt")
+	dt, err := runningFDT()
+	require.NoError(t, err)
+	require.Nil(t, dt)
+
+	require.NoError(t, ioutil.WriteFile(fdtPath, newTestFDT().bytes(), 0644))
+	dt, err = runningFDT()
+	require.NoError(t, err)
+	require.Equal(t, newTestFDT(), dt)
+
+	require.NoError(t, ioutil.WriteFile(fdtPath, []byte("garbage"), 0644))
+	_, err = runningFDT()
+	require.Error(t, err)
+}
+
+func TestPurgatory(t *testing.T) {
+	const dtb, kernel = 0x48000000, 0x40280000
+	b := purgatory(dtb, kernel)
+	require.Len(t, b, purgatorySize)
+	le := binary.LittleEndian
+	// the literals are read relative to the loading instructions
+	ldrOffset := func(insn uint32) int { return int(insn>>5&0x7FFFF) * 4 }
+	require.Equal(t, uint64(dtb), le.Uint64(b[0+ldrOffset(le.Uint32(b[0:])):]))
+	require.Equal(t, uint64(kernel), le.Uint64(b[16+ldrOffset(le.Uint32(b[16:])):]))
+	// x0 holds the device tree, x4 the kernel
+	require.Equal(t, uint32(0), le.Uint32(b[0:])&0x1F)
+	require.Equal(t, uint32(4), le.Uint32(b[16:])&0x1F)
+	require.Equal(t, uint32(0xD61F0080), le.Uint32(b[20:]))
+}
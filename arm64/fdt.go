@@ -0,0 +1,295 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package arm64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Flattened device tree format, see https://www.devicetree.org/specifications/.
+const (
+	fdtMagic       = 0xD00DFEED
+	fdtHeaderSize  = 40
+	fdtVersion     = 17
+	fdtLastVersion = 16
+
+	fdtBeginNode = 1
+	fdtEndNode   = 2
+	fdtProp      = 3
+	fdtNop       = 4
+	fdtEnd       = 9
+)
+
+// maxFDTDepth limits the nesting of nodes.
+const maxFDTDepth = 64
+
+type fdtProperty struct {
+	name  string
+	value []byte
+}
+
+type fdtNode struct {
+	name     string
+	props    []fdtProperty
+	children []*fdtNode
+}
+
+// fdt is a parsed flattened device tree.
+type fdt struct {
+	bootCPU uint32
+	// reserved holds address and size of the memory reservation block.
+	reserved [][2]uint64
+	root     *fdtNode
+}
+
+func parseFDT(b []byte) (*fdt, error) {
+	be := binary.BigEndian
+	if len(b) < fdtHeaderSize || be.Uint32(b) != fdtMagic {
+		return nil, errors.New("fdt: invalid header")
+	}
+	total := be.Uint32(b[4:])
+	offStruct := be.Uint32(b[8:])
+	offStrings := be.Uint32(b[12:])
+	offRsv := be.Uint32(b[16:])
+	lastComp := be.Uint32(b[24:])
+	sizeStrings := be.Uint32(b[32:])
+	sizeStruct := be.Uint32(b[36:])
+	if lastComp > fdtVersion {
+		return nil, fmt.Errorf("fdt: unsupported version %d", lastComp)
+	}
+	if uint64(total) > uint64(len(b)) ||
+		uint64(offStruct)+uint64(sizeStruct) > uint64(total) ||
+		uint64(offStrings)+uint64(sizeStrings) > uint64(total) ||
+		offRsv > total {
+		return nil, errors.New("fdt: blocks exceed blob")
+	}
+	f := &fdt{bootCPU: be.Uint32(b[28:])}
+
+	for rsv := b[offRsv:total]; ; rsv = rsv[16:] {
+		if len(rsv) < 16 {
+			return nil, errors.New("fdt: unterminated memory reservation block")
+		}
+		addr, size := be.Uint64(rsv), be.Uint64(rsv[8:])
+		if addr == 0 && size == 0 {
+			break
+		}
+		f.reserved = append(f.reserved, [2]uint64{addr, size})
+	}
+
+	p := &fdtParser{
+		strct:   b[offStruct : offStruct+sizeStruct],
+		strings: b[offStrings : offStrings+sizeStrings],
+	}
+	var err error
+	if f.root, err = p.parse(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type fdtParser struct {
+	strct   []byte
+	strings []byte
+	off     int
+}
+
+func (p *fdtParser) token() (uint32, error) {
+	if p.off+4 > len(p.strct) {
+		return 0, errors.New("fdt: unexpected end of structure block")
+	}
+	t := binary.BigEndian.Uint32(p.strct[p.off:])
+	p.off += 4
+	return t, nil
+}
+
+// cstring reads a null terminated string at off in b.
+func cstring(b []byte, off int) (string, error) {
+	if off < 0 || off > len(b) {
+		return "", errors.New("fdt: string offset exceeds block")
+	}
+	i := bytes.IndexByte(b[off:], 0)
+	if i < 0 {
+		return "", errors.New("fdt: unterminated string")
+	}
+	return string(b[off : off+i]), nil
+}
+
+func (p *fdtParser) parse() (*fdtNode, error) {
+	var stack []*fdtNode
+	var root *fdtNode
+	for {
+		t, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case fdtBeginNode:
+			name, err := cstring(p.strct, p.off)
+			if err != nil {
+				return nil, err
+			}
+			p.off += (len(name) + 1 + 3) &^ 3
+			n := &fdtNode{name: name}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, errors.New("fdt: multiple root nodes")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+			if len(stack) == maxFDTDepth {
+				return nil, errors.New("fdt: nodes nested too deeply")
+			}
+			stack = append(stack, n)
+		case fdtEndNode:
+			if len(stack) == 0 {
+				return nil, errors.New("fdt: unexpected end of node")
+			}
+			stack = stack[:len(stack)-1]
+		case fdtProp:
+			if len(stack) == 0 || p.off+8 > len(p.strct) {
+				return nil, errors.New("fdt: invalid property")
+			}
+			size := int(binary.BigEndian.Uint32(p.strct[p.off:]))
+			nameOff := int(binary.BigEndian.Uint32(p.strct[p.off+4:]))
+			p.off += 8
+			if size < 0 || p.off+size > len(p.strct) {
+				return nil, errors.New("fdt: property exceeds structure block")
+			}
+			name, err := cstring(p.strings, nameOff)
+			if err != nil {
+				return nil, err
+			}
+			value := append([]byte(nil), p.strct[p.off:p.off+size]...)
+			p.off += (size + 3) &^ 3
+			n := stack[len(stack)-1]
+			n.props = append(n.props, fdtProperty{name: name, value: value})
+		case fdtNop:
+		case fdtEnd:
+			if root == nil || len(stack) != 0 {
+				return nil, errors.New("fdt: unbalanced nodes")
+			}
+			return root, nil
+		default:
+			return nil, fmt.Errorf("fdt: invalid token %#x", t)
+		}
+	}
+}
+
+// bytes serializes f as version 17 flattened device tree.
+func (f *fdt) bytes() []byte {
+	var strct bytes.Buffer
+	var strs bytes.Buffer
+	offsets := make(map[string]uint32)
+	be := binary.BigEndian
+	u32 := func(v uint32) {
+		var d [4]byte
+		be.PutUint32(d[:], v)
+		strct.Write(d[:])
+	}
+	pad := func() {
+		for strct.Len()%4 != 0 {
+			strct.WriteByte(0)
+		}
+	}
+	var write func(n *fdtNode)
+	write = func(n *fdtNode) {
+		u32(fdtBeginNode)
+		strct.WriteString(n.name)
+		strct.WriteByte(0)
+		pad()
+		for _, p := range n.props {
+			off, ok := offsets[p.name]
+			if !ok {
+				off = uint32(strs.Len())
+				offsets[p.name] = off
+				strs.WriteString(p.name)
+				strs.WriteByte(0)
+			}
+			u32(fdtProp)
+			u32(uint32(len(p.value)))
+			u32(off)
+			strct.Write(p.value)
+			pad()
+		}
+		for _, c := range n.children {
+			write(c)
+		}
+		u32(fdtEndNode)
+	}
+	write(f.root)
+	u32(fdtEnd)
+
+	var rsv bytes.Buffer
+	for _, r := range append(f.reserved, [2]uint64{}) {
+		var d [16]byte
+		be.PutUint64(d[:], r[0])
+		be.PutUint64(d[8:], r[1])
+		rsv.Write(d[:])
+	}
+
+	offRsv := uint32(fdtHeaderSize+7) &^ 7
+	offStruct := offRsv + uint32(rsv.Len())
+	offStrings := offStruct + uint32(strct.Len())
+	total := offStrings + uint32(strs.Len())
+
+	b := make([]byte, offRsv, total)
+	be.PutUint32(b, fdtMagic)
+	be.PutUint32(b[4:], total)
+	be.PutUint32(b[8:], offStruct)
+	be.PutUint32(b[12:], offStrings)
+	be.PutUint32(b[16:], offRsv)
+	be.PutUint32(b[20:], fdtVersion)
+	be.PutUint32(b[24:], fdtLastVersion)
+	be.PutUint32(b[28:], f.bootCPU)
+	be.PutUint32(b[32:], uint32(strs.Len()))
+	be.PutUint32(b[36:], uint32(strct.Len()))
+	b = append(b, rsv.Bytes()...)
+	b = append(b, strct.Bytes()...)
+	return append(b, strs.Bytes()...)
+}
+
+// chosen returns the /chosen node of f, which is created if missing.
+func (f *fdt) chosen() *fdtNode {
+	for _, c := range f.root.children {
+		if c.name == "chosen" {
+			return c
+		}
+	}
+	c := &fdtNode{name: "chosen"}
+	f.root.children = append(f.root.children, c)
+	return c
+}
+
+// set sets the property name of n to value. A nil value deletes it.
+func (n *fdtNode) set(name string, value []byte) {
+	for i, p := range n.props {
+		if p.name == name {
+			if value == nil {
+				n.props = append(n.props[:i], n.props[i+1:]...)
+			} else {
+				n.props[i].value = value
+			}
+			return
+		}
+	}
+	if value != nil {
+		n.props = append(n.props, fdtProperty{name: name, value: value})
+	}
+}
+
+func (n *fdtNode) get(name string) []byte {
+	for _, p := range n.props {
+		if p.name == name {
+			return p.value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package arm64 loads arm64 Linux kernels together with a device tree via
+// kexec_load, see https://www.kernel.org/doc/html/latest/arm64/booting.html.
+package arm64
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+const (
+	imageMagic      = 0x644D5241 // "ARM\x64"
+	imageHeaderSize = 64
+	// kernelAlign is the alignment of the base the kernel is loaded
+	// relative to.
+	kernelAlign = 2 << 20
+)
+
+// fdtPath is the device tree the running kernel was booted with. On UEFI
+// systems, the EFI stub has added the UEFI properties to its /chosen node.
+var fdtPath = "/sys/firmware/fdt"
+
+// uefiPrefix is the prefix of the /chosen properties describing the UEFI
+// system table and memory map, see
+// https://www.kernel.org/doc/Documentation/arm/uefi.rst.
+const uefiPrefix = "linux,uefi-"
+
+// Image is an arm64 Linux kernel with an initramfs and a device tree.
+type Image struct {
+	Name string
+
+	Kernel  io.ReaderAt
+	Initrd  io.ReaderAt
+	DTB     io.ReaderAt
+	Cmdline string
+}
+
+var _ boot.OSImage = &Image{}
+
+// Label returns either Name or a short description.
+func (img *Image) Label() string {
+	if len(img.Name) > 0 {
+		return img.Name
+	}
+	return fmt.Sprintf("arm64 Linux(cmdline=%s)", img.Cmdline)
+}
+
+// Edit the kernel command line.
+func (img *Image) Edit(f func(cmdline string) string) {
+	img.Cmdline = f(img.Cmdline)
+}
+
+// String implements fmt.Stringer.
+func (img *Image) String() string {
+	return fmt.Sprintf("Arm64Image(\n  Name: %s\n  Cmdline: %s\n  Initrd: %t\n)",
+		img.Name, img.Cmdline, img.Initrd != nil)
+}
+
+// imageHeader is the header of an arm64 kernel Image.
+type imageHeader struct {
+	textOffset uint64
+	imageSize  uint64
+}
+
+func parseImageHeader(b []byte) (*imageHeader, error) {
+	le := binary.LittleEndian
+	if len(b) < imageHeaderSize || le.Uint32(b[56:]) != imageMagic {
+		return nil, errors.New("kernel is not an arm64 Image")
+	}
+	h := &imageHeader{
+		textOffset: le.Uint64(b[8:]),
+		imageSize:  le.Uint64(b[16:]),
+	}
+	// kernels before v3.17 have no image size
+	if h.imageSize == 0 {
+		h.imageSize = uint64(len(b))
+	}
+	if h.imageSize < uint64(len(b)) {
+		return nil, fmt.Errorf("image size %d smaller than kernel", h.imageSize)
+	}
+	return h, nil
+}
+
+// Load implements boot.OSImage.Load. The kernel may be gzip compressed.
+func (img *Image) Load(verbose bool) error {
+	if runtime.GOARCH != "arm64" {
+		return fmt.Errorf("arm64: cannot load on %s", runtime.GOARCH)
+	}
+	if img.DTB == nil {
+		return errors.New("arm64: missing device tree")
+	}
+	kernel, err := uio.ReadAll(util.TryGzipFilter(img.Kernel))
+	if err != nil {
+		return fmt.Errorf("arm64: reading kernel failed: %v", err)
+	}
+	h, err := parseImageHeader(kernel)
+	if err != nil {
+		return fmt.Errorf("arm64: %v", err)
+	}
+	d, err := uio.ReadAll(img.DTB)
+	if err != nil {
+		return fmt.Errorf("arm64: reading device tree failed: %v", err)
+	}
+	dt, err := parseFDT(d)
+	if err != nil {
+		return fmt.Errorf("arm64: %v", err)
+	}
+	running, err := runningFDT()
+	if err != nil {
+		return fmt.Errorf("arm64: reading running device tree failed: %v", err)
+	}
+	chosen := dt.chosen()
+	if err := setupChosen(chosen, running, img.Cmdline); err != nil {
+		return fmt.Errorf("arm64: %v", err)
+	}
+
+	phys, err := memoryMap()
+	if err != nil {
+		return fmt.Errorf("arm64: reading memory map failed: %v", err)
+	}
+	// memory reserved by the device tree is left alone as well
+	for _, r := range dt.reserved {
+		phys.Insert(kexec.TypedRange{
+			Range: kexec.Range{Start: uintptr(r[0]), Size: uint(r[1])},
+			Type:  kexec.RangeReserved,
+		})
+	}
+	mem := kexec.Memory{Phys: phys}
+
+	// the kernel is placed at text_offset above the lowest 2 MiB aligned
+	// address of RAM that fits the whole image
+	var kernelRange kexec.Range
+	for _, r := range mem.Phys.FilterByType(kexec.RangeRAM) {
+		base := (uint64(r.Start) + kernelAlign - 1) &^ (kernelAlign - 1)
+		if base+h.textOffset+h.imageSize <= uint64(r.End()) {
+			kernelRange = kexec.Range{Start: uintptr(base + h.textOffset), Size: uint(h.imageSize)}
+			break
+		}
+	}
+	if kernelRange.Size == 0 {
+		return errors.New("arm64: no memory for kernel")
+	}
+	// the image size includes memory the kernel uses before it sets up
+	// its own allocator, so reserve all of it
+	mem.Segments.Insert(kexec.NewSegment(kernel, kernelRange))
+
+	if img.Initrd != nil {
+		initrd, err := uio.ReadAll(img.Initrd)
+		if err != nil {
+			return fmt.Errorf("arm64: reading initramfs failed: %v", err)
+		}
+		r, err := mem.AddKexecSegment(initrd)
+		if err != nil {
+			return fmt.Errorf("arm64: adding initramfs failed: %v", err)
+		}
+		chosen.set("linux,initrd-start", be64(uint64(r.Start)))
+		chosen.set("linux,initrd-end", be64(uint64(r.Start)+uint64(len(initrd))))
+	}
+
+	dtbRange, err := mem.AddKexecSegment(dt.bytes())
+	if err != nil {
+		return fmt.Errorf("arm64: adding device tree failed: %v", err)
+	}
+	entry, err := mem.AddKexecSegment(purgatory(uint64(dtbRange.Start), uint64(kernelRange.Start)))
+	if err != nil {
+		return fmt.Errorf("arm64: adding purgatory failed: %v", err)
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "arm64: kernel at %#x, device tree at %#x, purgatory at %#x\n", kernelRange.Start, dtbRange.Start, entry.Start)
+	}
+	if err := kexec.Load(entry.Start, mem.Segments, 0); err != nil {
+		return fmt.Errorf("arm64: kexec load failed: %v", err)
+	}
+	return nil
+}
+
+// runningFDT returns the device tree the running kernel was booted with, or
+// nil if there is none.
+func runningFDT() (*fdt, error) {
+	d, err := ioutil.ReadFile(fdtPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseFDT(d)
+}
+
+// setupChosen prepares the /chosen node of the device tree passed to the
+// next kernel the way kexec-tools does. The UEFI properties are taken from
+// running, so the next kernel finds the UEFI system table and memory map.
+// The KASLR and RNG seeds, consumed by the running kernel, are refreshed.
+// Properties describing the initramfs are removed and set when it is loaded.
+func setupChosen(chosen *fdtNode, running *fdt, cmdline string) error {
+	if cmdline != "" {
+		chosen.set("bootargs", append([]byte(cmdline), 0))
+	} else {
+		chosen.set("bootargs", nil)
+	}
+	for _, name := range []string{"linux,initrd-start", "linux,initrd-end", "linux,elfcorehdr", "linux,usable-memory-range"} {
+		chosen.set(name, nil)
+	}
+
+	for _, p := range append([]fdtProperty(nil), chosen.props...) {
+		if strings.HasPrefix(p.name, uefiPrefix) {
+			chosen.set(p.name, nil)
+		}
+	}
+	if running != nil {
+		for _, p := range running.chosen().props {
+			if strings.HasPrefix(p.name, uefiPrefix) {
+				chosen.set(p.name, p.value)
+			}
+		}
+	}
+
+	seed := make([]byte, 8)
+	if _, err := rand.Read(seed); err != nil {
+		return fmt.Errorf("reading kaslr-seed failed: %v", err)
+	}
+	chosen.set("kaslr-seed", seed)
+	if old := chosen.get("rng-seed"); old != nil {
+		seed := make([]byte, len(old))
+		if _, err := rand.Read(seed); err != nil {
+			return fmt.Errorf("reading rng-seed failed: %v", err)
+		}
+		chosen.set("rng-seed", seed)
+	}
+	return nil
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
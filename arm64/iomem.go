@@ -0,0 +1,82 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package arm64
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// iomemPath is read for the physical memory layout, since arm64 firmware
+// does not provide /sys/firmware/memmap.
+var iomemPath = "/proc/iomem"
+
+func memoryMap() (kexec.MemoryMap, error) {
+	f, err := os.Open(iomemPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIOMem(f)
+}
+
+// iomemReserved names ranges the running kernel keeps out of its allocator,
+// e.g. firmware memory and reserved-memory carve-outs of the device tree.
+// They are usually nested in System RAM.
+const iomemReserved = "reserved"
+
+// parseIOMem returns the System RAM ranges of /proc/iomem, with reserved
+// ranges at any nesting level excluded, like kexec-tools does.
+func parseIOMem(r io.Reader) (kexec.MemoryMap, error) {
+	var mem kexec.MemoryMap
+	var reserved []kexec.Range
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		fields := strings.SplitN(line, " : ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(fields[1])
+		if name != string(kexec.RangeRAM) && name != iomemReserved {
+			continue
+		}
+		bounds := strings.SplitN(strings.TrimSpace(fields[0]), "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid iomem line %q", line)
+		}
+		start, err := strconv.ParseUint(bounds[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid iomem line %q: %v", line, err)
+		}
+		end, err := strconv.ParseUint(bounds[1], 16, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid iomem line %q", line)
+		}
+		r := kexec.RangeFromInterval(uintptr(start), uintptr(end+1))
+		if name == iomemReserved {
+			reserved = append(reserved, r)
+			continue
+		}
+		mem.Insert(kexec.TypedRange{Range: r, Type: kexec.RangeRAM})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	// reserved ranges are inserted last, so they take precedence
+	for _, r := range reserved {
+		mem.Insert(kexec.TypedRange{Range: r, Type: kexec.RangeReserved})
+	}
+	if len(mem.FilterByType(kexec.RangeRAM)) == 0 {
+		return nil, fmt.Errorf("no System RAM in iomem")
+	}
+	return mem, nil
+}
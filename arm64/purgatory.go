@@ -0,0 +1,32 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package arm64
+
+import "encoding/binary"
+
+// purgatorySize is the size of the code returned by purgatory.
+const purgatorySize = 40
+
+// purgatory returns code entered after kexec. It jumps to the kernel at
+// kernel with the address of the device tree in x0 and x1 to x3 cleared, as
+// required by the arm64 boot protocol, see
+// https://www.kernel.org/doc/html/latest/arm64/booting.html.
+func purgatory(dtb, kernel uint64) []byte {
+	code := []uint32{
+		0x580000C0, // ldr x0, dtb
+		0xAA1F03E1, // mov x1, xzr
+		0xAA1F03E2, // mov x2, xzr
+		0xAA1F03E3, // mov x3, xzr
+		0x58000084, // ldr x4, kernel
+		0xD61F0080, // br x4
+	}
+	b := make([]byte, purgatorySize)
+	for i, c := range code {
+		binary.LittleEndian.PutUint32(b[4*i:], c)
+	}
+	binary.LittleEndian.PutUint64(b[24:], dtb)
+	binary.LittleEndian.PutUint64(b[32:], kernel)
+	return b
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CmdlinePolicy restricts the kernel command lines of OS packages. The zero
+// value allows any command line.
+//
+// Parameters in Required and Forbidden are given either as name=value,
+// matching a parameter with exactly this value, or as a name, matching the
+// parameter with any value. Like the kernel, names treat dashes and
+// underscores alike.
+type CmdlinePolicy struct {
+	// Required parameters must be present.
+	Required []string
+	// Forbidden parameters must not be present.
+	Forbidden []string
+	// ForbiddenPatterns are regular expressions that must not match any
+	// parameter.
+	ForbiddenPatterns []string
+	// MaxLength limits the length of the command line in bytes, if not
+	// zero.
+	MaxLength uint
+}
+
+// IsZero reports whether p allows any command line.
+func (p CmdlinePolicy) IsZero() bool {
+	return len(p.Required) == 0 && len(p.Forbidden) == 0 && len(p.ForbiddenPatterns) == 0 && p.MaxLength == 0
+}
+
+// Violations returns a description of each violation of p by cmdline.
+func (p CmdlinePolicy) Violations(cmdline string) []string {
+	var violations []string
+	if p.MaxLength > 0 && uint(len(cmdline)) > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("length %d exceeds %d", len(cmdline), p.MaxLength))
+	}
+	params := SplitCmdline(cmdline)
+	for _, r := range p.Required {
+		if !containsParam(params, r) {
+			violations = append(violations, fmt.Sprintf("missing %s", r))
+		}
+	}
+	for _, f := range p.Forbidden {
+		for _, param := range params {
+			if matchParam(param, f) {
+				violations = append(violations, fmt.Sprintf("forbidden %s", param))
+			}
+		}
+	}
+	for _, pattern := range p.ForbiddenPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("invalid pattern %q", pattern))
+			continue
+		}
+		for _, param := range params {
+			if re.MatchString(param) {
+				violations = append(violations, fmt.Sprintf("%s matches %q", param, pattern))
+			}
+		}
+	}
+	return violations
+}
+
+// SplitCmdline splits a kernel command line into parameters the way the
+// kernel does. Double quotes allow spaces in values and are removed.
+func SplitCmdline(cmdline string) []string {
+	var params []string
+	var param strings.Builder
+	inQuote, inParam := false, false
+	for _, c := range cmdline {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inParam = true
+		case !inQuote && (c == ' ' || c == '\t' || c == '\n'):
+			if inParam {
+				params = append(params, param.String())
+				param.Reset()
+				inParam = false
+			}
+		default:
+			param.WriteRune(c)
+			inParam = true
+		}
+	}
+	if inParam {
+		params = append(params, param.String())
+	}
+	return params
+}
+
+func containsParam(params []string, want string) bool {
+	for _, p := range params {
+		if matchParam(p, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParam reports whether param matches want, which is either a name or
+// name=value.
+func matchParam(param, want string) bool {
+	name, value, hasValue := cutParam(param)
+	wantName, wantValue, wantHasValue := cutParam(want)
+	if normalizeParamName(name) != normalizeParamName(wantName) {
+		return false
+	}
+	return !wantHasValue || hasValue && value == wantValue
+}
+
+func cutParam(param string) (name, value string, hasValue bool) {
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		return param[:i], param[i+1:], true
+	}
+	return param, "", false
+}
+
+func normalizeParamName(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCmdline(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    []string
+	}{
+		{"", nil},
+		{"  console=ttyS0,115200   quiet ", []string{"console=ttyS0,115200", "quiet"}},
+		{`dyndbg="file foo.c +p" ro`, []string{"dyndbg=file foo.c +p", "ro"}},
+		{"root=/dev/sda1\tinit=/bin/sh\n", []string{"root=/dev/sda1", "init=/bin/sh"}},
+		{`""`, []string{""}},
+	}
+	for _, tt := range tests {
+		got := SplitCmdline(tt.cmdline)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitCmdline(%q) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestCmdlinePolicyViolations(t *testing.T) {
+	p := CmdlinePolicy{
+		Required:          []string{"lockdown=integrity", "module.sig_enforce"},
+		Forbidden:         []string{"init", "rd.break", "lockdown=none"},
+		ForbiddenPatterns: []string{`^systemd\.debug`},
+		MaxLength:         80,
+	}
+
+	tests := []struct {
+		name       string
+		cmdline    string
+		violations int
+	}{
+		{"compliant", "console=ttyS0 lockdown=integrity module.sig_enforce=1", 0},
+		{"dashes and underscores", "lockdown=integrity module.sig-enforce", 0},
+		{"missing parameter", "console=ttyS0 module.sig_enforce", 1},
+		{"wrong value", "lockdown=none module.sig_enforce", 2},
+		{"forbidden parameter", "lockdown=integrity module.sig_enforce init=/bin/sh", 1},
+		{"forbidden name without value", "lockdown=integrity module.sig_enforce rd.break", 1},
+		{"forbidden pattern", "lockdown=integrity module.sig_enforce systemd.debug-shell", 1},
+		{"quoted", `lockdown=integrity module.sig_enforce "init=/bin/sh"`, 1},
+		{"too long", "lockdown=integrity module.sig_enforce " + strings.Repeat("x", 80), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := p.Violations(tt.cmdline)
+			if len(v) != tt.violations {
+				t.Errorf("got violations %q, want %d", v, tt.violations)
+			}
+		})
+	}
+
+	if v := (CmdlinePolicy{}).Violations("init=/bin/sh"); v != nil {
+		t.Errorf("zero policy: got violations %q", v)
+	}
+	if !(CmdlinePolicy{}).IsZero() || p.IsZero() {
+		t.Error("IsZero is wrong")
+	}
+}
@@ -4,7 +4,14 @@
 
 package config
 
-import "fmt"
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
 
 const SecurityCfgVersion int = 1
 
@@ -12,6 +19,11 @@ var (
 	ErrSecurityCfgVersionMissmatch = InvalidError("version missmatch, want version " + fmt.Sprint(SecurityCfgVersion))
 	ErrMissingBootMode             = InvalidError("boot mode must be set")
 	ErrUnknownBootMode             = InvalidError("unknown boot mode")
+	ErrUnknownRollbackPolicy       = InvalidError("unknown rollback policy")
+	ErrUnknownTimeSource           = InvalidError("unknown verification time source")
+	ErrSignedTimeWithoutTimestamp  = InvalidError("signed time source requires timestamps")
+	ErrInvalidSignaturePolicy      = InvalidError("invalid signature policy")
+	ErrInvalidCmdlinePolicy        = InvalidError("invalid kernel command line policy")
 )
 
 type BootMode int
@@ -35,17 +47,130 @@ func (b BootMode) String() string {
 	}
 }
 
+// RollbackPolicy controls how OS packages with a security version below the
+// high-water mark recorded by previous boots are treated.
+type RollbackPolicy int
+
+const (
+	// RollbackDisabled ignores security versions.
+	RollbackDisabled RollbackPolicy = iota
+	// RollbackWarn boots outdated OS packages but logs a warning.
+	RollbackWarn
+	// RollbackEnforce refuses outdated OS packages unless their signed
+	// metadata explicitly allows a downgrade.
+	RollbackEnforce
+)
+
+func (r RollbackPolicy) String() string {
+	switch r {
+	case RollbackDisabled:
+		return "disabled"
+	case RollbackWarn:
+		return "warn"
+	case RollbackEnforce:
+		return "enforce"
+	default:
+		return "unknown"
+	}
+}
+
+// TimeSource defines the time certificate validity periods are checked against
+// during OS package verification, if EnforceCertValidity is set.
+type TimeSource int
+
+const (
+	// RTCTime is the system time as read from the real time clock.
+	RTCTime TimeSource = iota
+	// TimeFixTime is the timestamp of the system time fix file at STDATA.
+	TimeFixTime
+	// SignedTime is the time of the RFC 3161 timestamp token over each
+	// signature, issued by one of the TSA roots. It requires
+	// RequireTimestamp. The signed creation time of the OS package is never
+	// used, since it is signed by the very key whose validity is checked.
+	SignedTime
+)
+
+func (t TimeSource) String() string {
+	switch t {
+	case RTCTime:
+		return "rtc"
+	case TimeFixTime:
+		return "timefix"
+	case SignedTime:
+		return "signed_timestamp"
+	default:
+		return "unknown"
+	}
+}
+
+// SignatureClause requires Threshold valid signatures chaining to the signing
+// root with the hex encoded SHA-256 fingerprint RootFingerprint.
+type SignatureClause struct {
+	RootFingerprint string
+	Threshold       uint
+}
+
 // SecurityConfig contains security critical configuration data for a System Transparency host.
 type SecurityCfg struct {
 	Version                 int
 	ValidSignatureThreshold uint
 	BootMode
-	UsePkgCache bool
+	UsePkgCache    bool
+	RollbackPolicy RollbackPolicy
+
+	// Verification policy for OS package signing certificates.
+	// EnforceCertValidity is opt-in, since validity periods of signing
+	// certificates used not to be checked at all. Hosts that enable it need
+	// signing certificates valid at TimeSource.
+	EnforceCertValidity bool
+	SigningKeyUsage     x509.KeyUsage
+	SigningExtKeyUsage  []x509.ExtKeyUsage
+	TimeSource          TimeSource
+
+	// SignaturePolicy lists clauses, which must all be satisfied by an
+	// OS package. If empty, ValidSignatureThreshold valid signatures chaining
+	// to any of the signing roots are required.
+	SignaturePolicy []SignatureClause
+
+	// RequireCRL makes a missing or stale CRL for any signing root fatal,
+	// and invalidates signatures lacking a current CRL for any intermediate
+	// of their certificate chain.
+	RequireCRL bool
+
+	// RequireLogProof makes OS packages need a proof of being logged in a
+	// transparency log, cosigned by at least WitnessQuorum witnesses.
+	RequireLogProof bool
+	WitnessQuorum   uint
+
+	// RequireTimestamp makes signatures need a valid RFC 3161 timestamp
+	// token issued by one of the TSA roots.
+	RequireTimestamp bool
+
+	// ProvenanceBuilderID makes OS packages need a DSSE descriptor carrying
+	// SLSA provenance of this builder.
+	ProvenanceBuilderID string
+
+	// OSPkgMaxMemberSize and OSPkgMaxSize limit the uncompressed size of
+	// each member and of all members of OS package archives in bytes.
+	// Zero means the default limit.
+	OSPkgMaxMemberSize uint64
+	OSPkgMaxSize       uint64
+
+	// CmdlinePolicy restricts the kernel command lines of OS packages.
+	CmdlinePolicy CmdlinePolicy
+
+	// ExpiryGracePeriod is added to the signed expiry time of OS packages
+	// before they are rejected as expired.
+	ExpiryGracePeriod time.Duration
 }
 
 var scValidators = []scValidator{
 	checkSecurityConfigVersion,
 	checkBootMode,
+	checkRollbackPolicy,
+	checkTimeSource,
+	checkSignaturePolicy,
+	checkCmdlinePolicy,
 }
 
 func checkSecurityConfigVersion(c *SecurityCfg) error {
@@ -64,3 +189,49 @@ func checkBootMode(c *SecurityCfg) error {
 	}
 	return nil
 }
+
+func checkRollbackPolicy(c *SecurityCfg) error {
+	if c.RollbackPolicy > RollbackEnforce {
+		return ErrUnknownRollbackPolicy
+	}
+	return nil
+}
+
+func checkTimeSource(c *SecurityCfg) error {
+	if c.TimeSource > SignedTime {
+		return ErrUnknownTimeSource
+	}
+	if c.TimeSource == SignedTime && !c.RequireTimestamp {
+		return ErrSignedTimeWithoutTimestamp
+	}
+	return nil
+}
+
+func checkSignaturePolicy(c *SecurityCfg) error {
+	for _, clause := range c.SignaturePolicy {
+		fp, err := hex.DecodeString(clause.RootFingerprint)
+		if err != nil || len(fp) != 32 {
+			return ErrInvalidSignaturePolicy
+		}
+		if clause.Threshold == 0 {
+			return ErrInvalidSignaturePolicy
+		}
+	}
+	return nil
+}
+
+func checkCmdlinePolicy(c *SecurityCfg) error {
+	for _, params := range [][]string{c.CmdlinePolicy.Required, c.CmdlinePolicy.Forbidden} {
+		for _, p := range params {
+			if p == "" || p[0] == '=' || strings.ContainsAny(p, " \t\n\"") {
+				return ErrInvalidCmdlinePolicy
+			}
+		}
+	}
+	for _, p := range c.CmdlinePolicy.ForbiddenPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return ErrInvalidCmdlinePolicy
+		}
+	}
+	return nil
+}
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
+	"time"
 )
 
 const (
@@ -12,8 +16,59 @@ const (
 	ValidSignatureThresholdJSONKey = "min_valid_sigs_required"
 	BootModeJSONKey                = "boot_mode"
 	UsePkgCacheJSONKey             = "use_ospkg_cache"
+	RollbackPolicyJSONKey          = "rollback_policy"
+	EnforceCertValidityJSONKey     = "enforce_cert_validity"
+	SigningKeyUsageJSONKey         = "signing_key_usage"
+	SigningExtKeyUsageJSONKey      = "signing_ext_key_usage"
+	TimeSourceJSONKey              = "verification_time"
+	SignaturePolicyJSONKey         = "signature_policy"
+	PolicyRootJSONKey              = "root"
+	PolicyThresholdJSONKey         = "threshold"
+	RequireCRLJSONKey              = "require_crl"
+	RequireLogProofJSONKey         = "require_log_proof"
+	WitnessQuorumJSONKey           = "witness_quorum"
+	RequireTimestampJSONKey        = "require_timestamp"
+	ProvenanceBuilderIDJSONKey     = "provenance_builder_id"
+	OSPkgMaxMemberSizeJSONKey      = "ospkg_max_member_size"
+	OSPkgMaxSizeJSONKey            = "ospkg_max_size"
+	CmdlinePolicyJSONKey           = "cmdline_policy"
+	CmdlineRequiredJSONKey         = "required"
+	CmdlineForbiddenJSONKey        = "forbidden"
+	CmdlinePatternsJSONKey         = "forbidden_patterns"
+	CmdlineMaxLengthJSONKey        = "max_length"
+	ExpiryGracePeriodJSONKey       = "expiry_grace_period"
 )
 
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"certSign":          x509.KeyUsageCertSign,
+	"crlSign":           x509.KeyUsageCRLSign,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// ParseExtKeyUsage returns the extended key usage called name in the
+// security configuration.
+func ParseExtKeyUsage(name string) (x509.ExtKeyUsage, error) {
+	eku, found := extKeyUsages[name]
+	if !found {
+		return 0, fmt.Errorf("unknown extended key usage %q", name)
+	}
+	return eku, nil
+}
+
 type securityCfgParser func(rawCfg, *SecurityCfg) error
 
 var securityCfgParsers = []securityCfgParser{
@@ -21,6 +76,21 @@ var securityCfgParsers = []securityCfgParser{
 	parseValidSignatureThreshold,
 	parseBootMode,
 	parseUsePkgCache,
+	parseRollbackPolicy,
+	parseEnforceCertValidity,
+	parseSigningKeyUsage,
+	parseSigningExtKeyUsage,
+	parseTimeSource,
+	parseSignaturePolicy,
+	parseRequireCRL,
+	parseRequireLogProof,
+	parseWitnessQuorum,
+	parseRequireTimestamp,
+	parseProvenanceBuilderID,
+	parseOSPkgMaxMemberSize,
+	parseOSPkgMaxSize,
+	parseCmdlinePolicy,
+	parseExpiryGracePeriod,
 }
 
 type SecurityCfgJSONParser struct {
@@ -106,3 +176,305 @@ func parseUsePkgCache(r rawCfg, c *SecurityCfg) error {
 	}
 	return nil
 }
+
+func parseRollbackPolicy(r rawCfg, c *SecurityCfg) error {
+	key := RollbackPolicyJSONKey
+	if val, found := r[key]; found {
+		if p, ok := val.(string); ok {
+			switch p {
+			case "", RollbackDisabled.String():
+				c.RollbackPolicy = RollbackDisabled
+			case RollbackWarn.String():
+				c.RollbackPolicy = RollbackWarn
+			case RollbackEnforce.String():
+				c.RollbackPolicy = RollbackEnforce
+			default:
+				return &ParseError{key, fmt.Errorf("unknown rollback policy %q", p)}
+			}
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseEnforceCertValidity(r rawCfg, c *SecurityCfg) error {
+	key := EnforceCertValidityJSONKey
+	if val, found := r[key]; found {
+		if b, ok := val.(bool); ok {
+			c.EnforceCertValidity = b
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseSigningKeyUsage(r rawCfg, c *SecurityCfg) error {
+	key := SigningKeyUsageJSONKey
+	if val, found := r[key]; found {
+		if list, ok := val.([]interface{}); ok {
+			for _, v := range list {
+				if s, ok := v.(string); ok {
+					ku, found := keyUsages[s]
+					if !found {
+						return &ParseError{key, fmt.Errorf("unknown key usage %q", s)}
+					}
+					c.SigningKeyUsage |= ku
+				} else {
+					return &TypeError{key, v}
+				}
+			}
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseSigningExtKeyUsage(r rawCfg, c *SecurityCfg) error {
+	key := SigningExtKeyUsageJSONKey
+	if val, found := r[key]; found {
+		if list, ok := val.([]interface{}); ok {
+			for _, v := range list {
+				if s, ok := v.(string); ok {
+					eku, err := ParseExtKeyUsage(s)
+					if err != nil {
+						return &ParseError{key, err}
+					}
+					c.SigningExtKeyUsage = append(c.SigningExtKeyUsage, eku)
+				} else {
+					return &TypeError{key, v}
+				}
+			}
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseTimeSource(r rawCfg, c *SecurityCfg) error {
+	key := TimeSourceJSONKey
+	if val, found := r[key]; found {
+		if s, ok := val.(string); ok {
+			switch s {
+			case "", RTCTime.String():
+				c.TimeSource = RTCTime
+			case TimeFixTime.String():
+				c.TimeSource = TimeFixTime
+			case SignedTime.String():
+				c.TimeSource = SignedTime
+			default:
+				return &ParseError{key, fmt.Errorf("unknown time source %q", s)}
+			}
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseSignaturePolicy(r rawCfg, c *SecurityCfg) error {
+	key := SignaturePolicyJSONKey
+	if val, found := r[key]; found {
+		list, ok := val.([]interface{})
+		if !ok {
+			return &TypeError{key, val}
+		}
+		for _, v := range list {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return &TypeError{key, v}
+			}
+			root, ok := m[PolicyRootJSONKey].(string)
+			if !ok {
+				return &TypeError{key, v}
+			}
+			th, ok := m[PolicyThresholdJSONKey].(float64)
+			if !ok {
+				return &TypeError{key, v}
+			}
+			if int(th) < 0 {
+				return &ParseError{key, errors.New("threshold is negative")}
+			}
+			c.SignaturePolicy = append(c.SignaturePolicy, SignatureClause{
+				RootFingerprint: strings.ToLower(root),
+				Threshold:       uint(th),
+			})
+		}
+	}
+	return nil
+}
+
+func parseRequireCRL(r rawCfg, c *SecurityCfg) error {
+	key := RequireCRLJSONKey
+	if val, found := r[key]; found {
+		if b, ok := val.(bool); ok {
+			c.RequireCRL = b
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseRequireLogProof(r rawCfg, c *SecurityCfg) error {
+	key := RequireLogProofJSONKey
+	if val, found := r[key]; found {
+		if b, ok := val.(bool); ok {
+			c.RequireLogProof = b
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseWitnessQuorum(r rawCfg, c *SecurityCfg) error {
+	key := WitnessQuorumJSONKey
+	if val, found := r[key]; found {
+		if q, ok := val.(float64); ok {
+			if int(q) < 0 {
+				return &ParseError{key, errors.New("value is negative")}
+			}
+			c.WitnessQuorum = uint(q)
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseRequireTimestamp(r rawCfg, c *SecurityCfg) error {
+	key := RequireTimestampJSONKey
+	if val, found := r[key]; found {
+		if b, ok := val.(bool); ok {
+			c.RequireTimestamp = b
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseProvenanceBuilderID(r rawCfg, c *SecurityCfg) error {
+	key := ProvenanceBuilderIDJSONKey
+	if val, found := r[key]; found {
+		if id, ok := val.(string); ok {
+			c.ProvenanceBuilderID = id
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseOSPkgMaxMemberSize(r rawCfg, c *SecurityCfg) error {
+	key := OSPkgMaxMemberSizeJSONKey
+	if val, found := r[key]; found {
+		if s, ok := val.(float64); ok {
+			if s < 0 {
+				return &ParseError{key, errors.New("value is negative")}
+			}
+			c.OSPkgMaxMemberSize = uint64(s)
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseOSPkgMaxSize(r rawCfg, c *SecurityCfg) error {
+	key := OSPkgMaxSizeJSONKey
+	if val, found := r[key]; found {
+		if s, ok := val.(float64); ok {
+			if s < 0 {
+				return &ParseError{key, errors.New("value is negative")}
+			}
+			c.OSPkgMaxSize = uint64(s)
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
+
+func parseCmdlinePolicy(r rawCfg, c *SecurityCfg) error {
+	key := CmdlinePolicyJSONKey
+	val, found := r[key]
+	if !found {
+		return nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return &TypeError{key, val}
+	}
+	strs := func(k string) ([]string, error) {
+		v, found := m[k]
+		if !found {
+			return nil, nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, &TypeError{key, v}
+		}
+		var ret []string
+		for _, e := range list {
+			s, ok := e.(string)
+			if !ok {
+				return nil, &TypeError{key, e}
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	}
+
+	var p CmdlinePolicy
+	var err error
+	if p.Required, err = strs(CmdlineRequiredJSONKey); err != nil {
+		return err
+	}
+	if p.Forbidden, err = strs(CmdlineForbiddenJSONKey); err != nil {
+		return err
+	}
+	if p.ForbiddenPatterns, err = strs(CmdlinePatternsJSONKey); err != nil {
+		return err
+	}
+	for _, pattern := range p.ForbiddenPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return &ParseError{key, err}
+		}
+	}
+	if v, found := m[CmdlineMaxLengthJSONKey]; found {
+		l, ok := v.(float64)
+		if !ok {
+			return &TypeError{key, v}
+		}
+		if l < 0 {
+			return &ParseError{key, errors.New("max length is negative")}
+		}
+		p.MaxLength = uint(l)
+	}
+	c.CmdlinePolicy = p
+	return nil
+}
+
+func parseExpiryGracePeriod(r rawCfg, c *SecurityCfg) error {
+	key := ExpiryGracePeriodJSONKey
+	if val, found := r[key]; found {
+		if s, ok := val.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return &ParseError{key, err}
+			}
+			if d < 0 {
+				return &ParseError{key, errors.New("value is negative")}
+			}
+			c.ExpiryGracePeriod = d
+		} else {
+			return &TypeError{key, val}
+		}
+	}
+	return nil
+}
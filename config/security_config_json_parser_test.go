@@ -2,9 +2,12 @@ package config
 
 import (
 	"bytes"
+	"crypto/x509"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSecurityCfgJSONParser(t *testing.T) {
@@ -39,6 +42,87 @@ func TestSecurityCfgJSONParser(t *testing.T) {
 			json: fmt.Sprintf(`{"%s": true}`, UsePkgCacheJSONKey),
 			want: &SecurityCfg{UsePkgCache: true},
 		},
+		{
+			name: "Rollback policy field 1",
+			json: fmt.Sprintf(`{"%s": "%s"}`, RollbackPolicyJSONKey, RollbackWarn.String()),
+			want: &SecurityCfg{RollbackPolicy: RollbackWarn},
+		},
+		{
+			name: "Rollback policy field 2",
+			json: fmt.Sprintf(`{"%s": "%s"}`, RollbackPolicyJSONKey, RollbackEnforce.String()),
+			want: &SecurityCfg{RollbackPolicy: RollbackEnforce},
+		},
+		{
+			name: "Enforce cert validity field",
+			json: fmt.Sprintf(`{"%s": true}`, EnforceCertValidityJSONKey),
+			want: &SecurityCfg{EnforceCertValidity: true},
+		},
+		{
+			name: "Signing key usage field",
+			json: fmt.Sprintf(`{"%s": ["digitalSignature", "contentCommitment"]}`, SigningKeyUsageJSONKey),
+			want: &SecurityCfg{SigningKeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment},
+		},
+		{
+			name: "Signing ext key usage field",
+			json: fmt.Sprintf(`{"%s": ["codeSigning"]}`, SigningExtKeyUsageJSONKey),
+			want: &SecurityCfg{SigningExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}},
+		},
+		{
+			name: "Time source field 1",
+			json: fmt.Sprintf(`{"%s": "%s"}`, TimeSourceJSONKey, TimeFixTime.String()),
+			want: &SecurityCfg{TimeSource: TimeFixTime},
+		},
+		{
+			name: "Time source field 2",
+			json: fmt.Sprintf(`{"%s": "%s"}`, TimeSourceJSONKey, SignedTime.String()),
+			want: &SecurityCfg{TimeSource: SignedTime},
+		},
+		{
+			name: "Signature policy field",
+			json: fmt.Sprintf(`{"%s": [{"%s": "%s", "%s": 2}]}`, SignaturePolicyJSONKey, PolicyRootJSONKey, strings.Repeat("AB", 32), PolicyThresholdJSONKey),
+			want: &SecurityCfg{SignaturePolicy: []SignatureClause{{RootFingerprint: strings.Repeat("ab", 32), Threshold: 2}}},
+		},
+		{
+			name: "Require CRL field",
+			json: fmt.Sprintf(`{"%s": true}`, RequireCRLJSONKey),
+			want: &SecurityCfg{RequireCRL: true},
+		},
+		{
+			name: "Log proof fields",
+			json: fmt.Sprintf(`{"%s": true, "%s": 2}`, RequireLogProofJSONKey, WitnessQuorumJSONKey),
+			want: &SecurityCfg{RequireLogProof: true, WitnessQuorum: 2},
+		},
+		{
+			name: "Require timestamp field",
+			json: fmt.Sprintf(`{"%s": true}`, RequireTimestampJSONKey),
+			want: &SecurityCfg{RequireTimestamp: true},
+		},
+		{
+			name: "Provenance builder ID field",
+			json: fmt.Sprintf(`{"%s": "https://ci.example.org/builder"}`, ProvenanceBuilderIDJSONKey),
+			want: &SecurityCfg{ProvenanceBuilderID: "https://ci.example.org/builder"},
+		},
+		{
+			name: "OS package size limits",
+			json: fmt.Sprintf(`{"%s": 1048576, "%s": 2097152}`, OSPkgMaxMemberSizeJSONKey, OSPkgMaxSizeJSONKey),
+			want: &SecurityCfg{OSPkgMaxMemberSize: 1 << 20, OSPkgMaxSize: 2 << 20},
+		},
+		{
+			name: "Cmdline policy field",
+			json: fmt.Sprintf(`{"%s": {"%s": ["lockdown=integrity"], "%s": ["init", "rdinit"], "%s": ["^rd\\."], "%s": 1024}}`,
+				CmdlinePolicyJSONKey, CmdlineRequiredJSONKey, CmdlineForbiddenJSONKey, CmdlinePatternsJSONKey, CmdlineMaxLengthJSONKey),
+			want: &SecurityCfg{CmdlinePolicy: CmdlinePolicy{
+				Required:          []string{"lockdown=integrity"},
+				Forbidden:         []string{"init", "rdinit"},
+				ForbiddenPatterns: []string{`^rd\.`},
+				MaxLength:         1024,
+			}},
+		},
+		{
+			name: "Expiry grace period field",
+			json: fmt.Sprintf(`{"%s": "72h"}`, ExpiryGracePeriodJSONKey),
+			want: &SecurityCfg{ExpiryGracePeriod: 72 * time.Hour},
+		},
 		{
 			name: "No fields",
 			json: `{}`,
@@ -66,6 +150,66 @@ func TestSecurityCfgJSONParser(t *testing.T) {
 			json: fmt.Sprintf(`{"%s": -1}`, ValidSignatureThresholdJSONKey),
 			key:  ValidSignatureThresholdJSONKey,
 		},
+		{
+			name: "Bad rollback policy string",
+			json: fmt.Sprintf(`{"%s": "some string"}`, RollbackPolicyJSONKey),
+			key:  RollbackPolicyJSONKey,
+		},
+		{
+			name: "Bad signing key usage string",
+			json: fmt.Sprintf(`{"%s": ["some string"]}`, SigningKeyUsageJSONKey),
+			key:  SigningKeyUsageJSONKey,
+		},
+		{
+			name: "Bad signing ext key usage string",
+			json: fmt.Sprintf(`{"%s": ["some string"]}`, SigningExtKeyUsageJSONKey),
+			key:  SigningExtKeyUsageJSONKey,
+		},
+		{
+			name: "Bad time source string",
+			json: fmt.Sprintf(`{"%s": "some string"}`, TimeSourceJSONKey),
+			key:  TimeSourceJSONKey,
+		},
+		{
+			name: "Bad witness quorum integer",
+			json: fmt.Sprintf(`{"%s": -1}`, WitnessQuorumJSONKey),
+			key:  WitnessQuorumJSONKey,
+		},
+		{
+			name: "Bad OS package member size limit",
+			json: fmt.Sprintf(`{"%s": -1}`, OSPkgMaxMemberSizeJSONKey),
+			key:  OSPkgMaxMemberSizeJSONKey,
+		},
+		{
+			name: "Bad OS package size limit",
+			json: fmt.Sprintf(`{"%s": -1}`, OSPkgMaxSizeJSONKey),
+			key:  OSPkgMaxSizeJSONKey,
+		},
+		{
+			name: "Bad signature policy threshold",
+			json: fmt.Sprintf(`{"%s": [{"%s": "", "%s": -1}]}`, SignaturePolicyJSONKey, PolicyRootJSONKey, PolicyThresholdJSONKey),
+			key:  SignaturePolicyJSONKey,
+		},
+		{
+			name: "Bad cmdline policy pattern",
+			json: fmt.Sprintf(`{"%s": {"%s": ["("]}}`, CmdlinePolicyJSONKey, CmdlinePatternsJSONKey),
+			key:  CmdlinePolicyJSONKey,
+		},
+		{
+			name: "Bad cmdline policy max length",
+			json: fmt.Sprintf(`{"%s": {"%s": -1}}`, CmdlinePolicyJSONKey, CmdlineMaxLengthJSONKey),
+			key:  CmdlinePolicyJSONKey,
+		},
+		{
+			name: "Bad expiry grace period",
+			json: fmt.Sprintf(`{"%s": "3 days"}`, ExpiryGracePeriodJSONKey),
+			key:  ExpiryGracePeriodJSONKey,
+		},
+		{
+			name: "Negative expiry grace period",
+			json: fmt.Sprintf(`{"%s": "-1h"}`, ExpiryGracePeriodJSONKey),
+			key:  ExpiryGracePeriodJSONKey,
+		},
 	}
 
 	badTypeTests := []struct {
@@ -92,6 +236,74 @@ func TestSecurityCfgJSONParser(t *testing.T) {
 			name: "Bad use pkg cache type 2",
 			json: fmt.Sprintf(`{"%s": "true"}`, UsePkgCacheJSONKey),
 		},
+		{
+			name: "Bad rollback policy type",
+			json: fmt.Sprintf(`{"%s": 1}`, RollbackPolicyJSONKey),
+		},
+		{
+			name: "Bad enforce cert validity type",
+			json: fmt.Sprintf(`{"%s": "true"}`, EnforceCertValidityJSONKey),
+		},
+		{
+			name: "Bad signing key usage type",
+			json: fmt.Sprintf(`{"%s": "digitalSignature"}`, SigningKeyUsageJSONKey),
+		},
+		{
+			name: "Bad signing ext key usage type",
+			json: fmt.Sprintf(`{"%s": [1]}`, SigningExtKeyUsageJSONKey),
+		},
+		{
+			name: "Bad time source type",
+			json: fmt.Sprintf(`{"%s": 1}`, TimeSourceJSONKey),
+		},
+		{
+			name: "Bad require log proof type",
+			json: fmt.Sprintf(`{"%s": "true"}`, RequireLogProofJSONKey),
+		},
+		{
+			name: "Bad witness quorum type",
+			json: fmt.Sprintf(`{"%s": "one"}`, WitnessQuorumJSONKey),
+		},
+		{
+			name: "Bad require timestamp type",
+			json: fmt.Sprintf(`{"%s": 1}`, RequireTimestampJSONKey),
+		},
+		{
+			name: "Bad OS package size limit type",
+			json: fmt.Sprintf(`{"%s": "1M"}`, OSPkgMaxSizeJSONKey),
+		},
+		{
+			name: "Bad expiry grace period type",
+			json: fmt.Sprintf(`{"%s": 3600}`, ExpiryGracePeriodJSONKey),
+		},
+		{
+			name: "Bad provenance builder ID type",
+			json: fmt.Sprintf(`{"%s": true}`, ProvenanceBuilderIDJSONKey),
+		},
+		{
+			name: "Bad require CRL type",
+			json: fmt.Sprintf(`{"%s": 1}`, RequireCRLJSONKey),
+		},
+		{
+			name: "Bad signature policy type",
+			json: fmt.Sprintf(`{"%s": {}}`, SignaturePolicyJSONKey),
+		},
+		{
+			name: "Bad signature policy clause type",
+			json: fmt.Sprintf(`{"%s": [{"%s": 1, "%s": 1}]}`, SignaturePolicyJSONKey, PolicyRootJSONKey, PolicyThresholdJSONKey),
+		},
+		{
+			name: "Bad cmdline policy type",
+			json: fmt.Sprintf(`{"%s": ["init"]}`, CmdlinePolicyJSONKey),
+		},
+		{
+			name: "Bad cmdline policy parameters type",
+			json: fmt.Sprintf(`{"%s": {"%s": "init"}}`, CmdlinePolicyJSONKey, CmdlineForbiddenJSONKey),
+		},
+		{
+			name: "Bad cmdline policy max length type",
+			json: fmt.Sprintf(`{"%s": {"%s": "1K"}}`, CmdlinePolicyJSONKey, CmdlineMaxLengthJSONKey),
+		},
 	}
 
 	for _, tt := range goodTests {
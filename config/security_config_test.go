@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -31,6 +32,9 @@ func TestLoadSecurityCfg(t *testing.T) {
 				ValidSignatureThreshold: 1,
 				BootMode:                NetworkBoot,
 				UsePkgCache:             true,
+				RollbackPolicy:          RollbackEnforce,
+				TimeSource:              SignedTime,
+				RequireTimestamp:        true,
 			},
 		},
 	}
@@ -79,6 +83,69 @@ func TestLoadSecurityCfg(t *testing.T) {
 			},
 			want: ErrUnknownBootMode,
 		},
+		{
+			name: "Unknown rollback policy",
+			cfg: &SecurityCfg{
+				Version:        SecurityCfgVersion,
+				BootMode:       LocalBoot,
+				RollbackPolicy: 3,
+			},
+			want: ErrUnknownRollbackPolicy,
+		},
+		{
+			name: "Unknown time source",
+			cfg: &SecurityCfg{
+				Version:    SecurityCfgVersion,
+				BootMode:   LocalBoot,
+				TimeSource: 3,
+			},
+			want: ErrUnknownTimeSource,
+		},
+		{
+			name: "Signed time without timestamps",
+			cfg: &SecurityCfg{
+				Version:    SecurityCfgVersion,
+				BootMode:   LocalBoot,
+				TimeSource: SignedTime,
+			},
+			want: ErrSignedTimeWithoutTimestamp,
+		},
+		{
+			name: "Signature policy with bad fingerprint",
+			cfg: &SecurityCfg{
+				Version:         SecurityCfgVersion,
+				BootMode:        LocalBoot,
+				SignaturePolicy: []SignatureClause{{RootFingerprint: "abcd", Threshold: 1}},
+			},
+			want: ErrInvalidSignaturePolicy,
+		},
+		{
+			name: "Signature policy with zero threshold",
+			cfg: &SecurityCfg{
+				Version:         SecurityCfgVersion,
+				BootMode:        LocalBoot,
+				SignaturePolicy: []SignatureClause{{RootFingerprint: strings.Repeat("ab", 32)}},
+			},
+			want: ErrInvalidSignaturePolicy,
+		},
+		{
+			name: "Cmdline policy with empty parameter",
+			cfg: &SecurityCfg{
+				Version:       SecurityCfgVersion,
+				BootMode:      LocalBoot,
+				CmdlinePolicy: CmdlinePolicy{Forbidden: []string{""}},
+			},
+			want: ErrInvalidCmdlinePolicy,
+		},
+		{
+			name: "Cmdline policy with bad pattern",
+			cfg: &SecurityCfg{
+				Version:       SecurityCfgVersion,
+				BootMode:      LocalBoot,
+				CmdlinePolicy: CmdlinePolicy{ForbiddenPatterns: []string{"("}},
+			},
+			want: ErrInvalidCmdlinePolicy,
+		},
 	}
 
 	for _, tt := range invalidSecurityCfgTests {
@@ -128,3 +195,79 @@ func TestBootMode(t *testing.T) {
 		})
 	}
 }
+
+func TestRollbackPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RollbackPolicy
+		want   string
+	}{
+		{
+			name:   "String for default value",
+			policy: RollbackDisabled,
+			want:   "disabled",
+		},
+		{
+			name:   "String for 'RollbackWarn'",
+			policy: RollbackWarn,
+			want:   "warn",
+		},
+		{
+			name:   "String for 'RollbackEnforce'",
+			policy: RollbackEnforce,
+			want:   "enforce",
+		},
+		{
+			name:   "String for unknown value",
+			policy: 3,
+			want:   "unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.String()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		source TimeSource
+		want   string
+	}{
+		{
+			name:   "String for default value",
+			source: RTCTime,
+			want:   "rtc",
+		},
+		{
+			name:   "String for 'TimeFixTime'",
+			source: TimeFixTime,
+			want:   "timefix",
+		},
+		{
+			name:   "String for 'SignedTime'",
+			source: SignedTime,
+			want:   "signed_timestamp",
+		},
+		{
+			name:   "String for unknown value",
+			source: 3,
+			want:   "unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.source.String()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
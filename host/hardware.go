@@ -0,0 +1,82 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	smbiosProductFile = "/sys/class/dmi/id/product_name"
+	cpuInfoFile       = "/proc/cpuinfo"
+)
+
+// armImplementers maps ARM CPU implementer codes to the vendor names used
+// by the kernel.
+var armImplementers = map[string]string{
+	"0x41": "ARM",
+	"0x42": "Broadcom",
+	"0x43": "Cavium",
+	"0x46": "Fujitsu",
+	"0x48": "HiSilicon",
+	"0x4e": "NVIDIA",
+	"0x50": "APM",
+	"0x51": "Qualcomm",
+	"0x61": "Apple",
+	"0xc0": "Ampere",
+}
+
+// SMBIOSProduct returns the product name of the system as reported by the
+// SMBIOS tables.
+func SMBIOSProduct() (string, error) {
+	raw, err := ioutil.ReadFile(smbiosProductFile)
+	if err != nil {
+		return "", fmt.Errorf("read SMBIOS product name: %v", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// CPUVendor returns the vendor ID of the first CPU, e.g. GenuineIntel or
+// AuthenticAMD. On ARM the vendor name of the CPU implementer is returned.
+func CPUVendor() (string, error) {
+	f, err := os.Open(cpuInfoFile)
+	if err != nil {
+		return "", fmt.Errorf("read CPU info: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		key, value, ok := cutCPUInfoLine(s.Text())
+		if !ok {
+			continue
+		}
+		switch key {
+		case "vendor_id":
+			return value, nil
+		case "CPU implementer":
+			if name, ok := armImplementers[strings.ToLower(value)]; ok {
+				return name, nil
+			}
+			return value, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("read CPU info: %v", err)
+	}
+	return "", fmt.Errorf("no CPU vendor in %s", cpuInfoFile)
+}
+
+func cutCPUInfoLine(line string) (key, value string, ok bool) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
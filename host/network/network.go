@@ -161,7 +161,19 @@ func FindInterfaces(mac *net.HardwareAddr) ([]netlink.Link, error) {
 	return links, nil
 }
 
+// Download returns the content of url. It is meant for small files,
+// use DownloadTo for large ones.
 func Download(url *url.URL, httpsRoots *x509.CertPool, insecure, log bool) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := DownloadTo(buf, url, httpsRoots, insecure, log); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DownloadTo streams the content of url to w and returns the number of
+// bytes written.
+func DownloadTo(w io.Writer, url *url.URL, httpsRoots *x509.CertPool, insecure, log bool) (int64, error) {
 	// setup client with values taken from http.DefaultTransport + RootCAs
 	tls := &tls.Config{
 		RootCAs: httpsRoots,
@@ -192,11 +204,11 @@ func Download(url *url.URL, httpsRoots *x509.CertPool, insecure, log bool) ([]by
 
 	resp, err := client.Get(url.String())
 	if err != nil {
-		return nil, fmt.Errorf("client: %v", err)
+		return 0, fmt.Errorf("client: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("response: %d", resp.StatusCode)
+		return 0, fmt.Errorf("response: %d", resp.StatusCode)
 	}
 	if log {
 		progress := func(rc io.ReadCloser) io.ReadCloser {
@@ -209,14 +221,14 @@ func Download(url *url.URL, httpsRoots *x509.CertPool, insecure, log bool) ([]by
 		}
 		resp.Body = progress(resp.Body)
 	}
-	ret, err := ioutil.ReadAll(resp.Body)
+	n, err := io.Copy(w, resp.Body)
 	if err != nil {
-		return nil, err
+		return n, err
 	}
-	if len(ret) == 0 {
-		return nil, fmt.Errorf("empty response")
+	if n == 0 {
+		return 0, fmt.Errorf("empty response")
 	}
-	return ret, nil
+	return n, nil
 }
 
 func CheckEntropy() {
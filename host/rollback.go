@@ -0,0 +1,60 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadSecurityVersion reads the OS package security version high-water mark
+// from the file named by path. A missing file is treated as version 0.
+func LoadSecurityVersion(path string) (uint64, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read file: %v", err)
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse security version: %v", err)
+	}
+	return v, nil
+}
+
+// storeSecurityVersionTPM is replaced in tests.
+var storeSecurityVersionTPM = StoreSecurityVersionTPM
+
+// RaiseSecurityVersion raises the OS package security version high-water
+// mark to v, first in the TPM, see StoreSecurityVersionTPM, then at the file
+// named by path. The file is only written once the TPM holds v, so if the
+// TPM fails, neither is changed and the next boot sees the same high-water
+// mark. Without a TPM 2.0, only the file is written.
+func RaiseSecurityVersion(path string, v uint64, ownerAuth string) error {
+	err := storeSecurityVersionTPM(v, ownerAuth)
+	if err != nil && !errors.Is(err, ErrNoTPM) {
+		return fmt.Errorf("TPM: %v", err)
+	}
+	return StoreSecurityVersion(path, v)
+}
+
+// StoreSecurityVersion writes v to the file named by path, if it is higher
+// than the version already stored there.
+func StoreSecurityVersion(path string, v uint64) error {
+	current, err := LoadSecurityVersion(path)
+	if err != nil {
+		return err
+	}
+	if v <= current {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatUint(v, 10)+"\n"), 0644)
+}
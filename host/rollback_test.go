@@ -0,0 +1,80 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package host
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func stubTPM(t *testing.T, store func(v uint64, ownerAuth string) error) {
+	t.Helper()
+	orig := storeSecurityVersionTPM
+	storeSecurityVersionTPM = store
+	t.Cleanup(func() { storeSecurityVersionTPM = orig })
+}
+
+func TestStoreSecurityVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "security_version")
+
+	v, err := LoadSecurityVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), v)
+
+	require.NoError(t, StoreSecurityVersion(path, 5))
+	require.NoError(t, StoreSecurityVersion(path, 3))
+	v, err = LoadSecurityVersion(path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), v)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("five"), 0600))
+	_, err = LoadSecurityVersion(path)
+	require.Error(t, err)
+}
+
+func TestRaiseSecurityVersion(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		tpmErr  error
+		want    uint64
+		wantErr bool
+	}{
+		{name: "TPM stored", want: 7},
+		{name: "no TPM", tpmErr: fmt.Errorf("open: %w", ErrNoTPM), want: 7},
+		{name: "TPM failed", tpmErr: errors.New("owner authorization required"), want: 2, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "security_version")
+			require.NoError(t, StoreSecurityVersion(path, 2))
+
+			var calls []uint64
+			stubTPM(t, func(v uint64, ownerAuth string) error {
+				require.Equal(t, "secret", ownerAuth)
+				// The file must not be raised before the TPM.
+				stored, err := LoadSecurityVersion(path)
+				require.NoError(t, err)
+				require.Equal(t, uint64(2), stored)
+				calls = append(calls, v)
+				return tt.tpmErr
+			})
+
+			err := RaiseSecurityVersion(path, 7, "secret")
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, []uint64{7}, calls)
+			got, err := LoadSecurityVersion(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -25,15 +25,20 @@ const (
 // Files at STBOOT partition
 const (
 	HostConfigFile = "/host_configuration.json"
+	SigningCRLFile = "/ospkg_signing_crls.pem"
 )
 
 // Files at STDATA partition
 const (
-	TimeFixFile        = "stboot/etc/system_time_fix"
-	CurrentOSPkgFile   = "stboot/etc/current_ospkg_pathname"
-	LocalOSPkgDir      = "stboot/os_pkgs/local/"
-	LocalBootOrderFile = "stboot/os_pkgs/local/boot_order"
-	NetworkOSpkgCache  = "stboot/os_pkgs/cache"
+	TimeFixFile         = "stboot/etc/system_time_fix"
+	CurrentOSPkgFile    = "stboot/etc/current_ospkg_pathname"
+	SecurityVersionFile = "stboot/etc/security_version"
+	LocalOSPkgDir       = "stboot/os_pkgs/local/"
+	LocalBootOrderFile  = "stboot/os_pkgs/local/boot_order"
+	NetworkOSpkgCache   = "stboot/os_pkgs/cache"
+	// WorkDir holds the private copies of OS packages being processed and
+	// their extracted boot files. It is emptied on every boot.
+	WorkDir = "stboot/tmp"
 )
 
 func MountBootPartition() error {
@@ -5,16 +5,65 @@
 package host
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
 
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
 	"github.com/system-transparency/stboot/stlog"
 	"github.com/u-root/u-root/pkg/tss"
 )
 
 const bootConfigPCR uint32 = 8
 
-func MeasureTPM(data ...[]byte) error {
+// TPM 2.0 NV indices holding the OS package security version high-water
+// mark. securityVersionNVIndex is a monotonic counter, which stboot
+// write-locks before handing over control, so the booted OS cannot advance
+// it until the next TPM reset. A new counter starts at the highest value any
+// counter of the TPM ever had, which is recorded in the write-once index
+// securityVersionBaseNVIndex. The high-water mark is the difference.
+//
+// Both indices are defined using the owner authorization, which must be set
+// to keep the booted OS from undefining and redefining them.
+const (
+	securityVersionNVIndex     tpmutil.Handle = 0x01800100
+	securityVersionBaseNVIndex tpmutil.Handle = 0x01800101
+)
+
+const (
+	// nvTypeCounter is TPM_NT_COUNTER in the TPMA_NV_TPM_NT field.
+	nvTypeCounter tpm2.NVAttr = 0x1 << 4
+	nvTypeMask    tpm2.NVAttr = 0xF << 4
+	// permanentOwnerAuthSet is TPMA_PERMANENT.ownerAuthSet.
+	permanentOwnerAuthSet uint32 = 1 << 0
+	// maxSecurityVersionSteps limits the increments of the counter per
+	// boot, each of which is a TPM command. It matches
+	// ospkg.MaxSecurityVersion, so a new counter can reach any version.
+	maxSecurityVersionSteps = 4096
+)
+
+const (
+	securityVersionAttrs     = tpm2.AttrAuthRead | tpm2.AttrAuthWrite | tpm2.AttrWriteSTClear | tpm2.AttrNoDA | tpm2.AttrOrderly | nvTypeCounter
+	securityVersionBaseAttrs = tpm2.AttrAuthRead | tpm2.AttrAuthWrite | tpm2.AttrWriteDefine | tpm2.AttrNoDA
+)
+
+// tpmRoot is where the kernel lists TPM devices.
+const tpmRoot = "/sys/class/tpm"
+
+// ErrNoTPM is returned if the host has no TPM 2.0.
+var ErrNoTPM = errors.New("no TPM 2.0")
+
+// MeasureTPM extends the boot config PCR with the hash of each element.
+// Elements are read as streams, so they do not need to fit into memory.
+func MeasureTPM(data ...io.Reader) error {
 	tpm, err := tss.NewTPM()
 	if err != nil {
 		return fmt.Errorf("cannot open TPM: %v", err)
@@ -26,9 +75,191 @@ func MeasureTPM(data ...[]byte) error {
 	stlog.Debug("TPM info: %s", str)
 
 	for n, d := range data {
-		if err := tpm.Measure(d, bootConfigPCR); err != nil {
+		var h hash.Hash
+		switch tpm.Version {
+		case tss.TPMVersion12:
+			h = sha1.New()
+		case tss.TPMVersion20:
+			h = sha256.New()
+		default:
+			return fmt.Errorf("unsupported TPM version: %x", tpm.Version)
+		}
+		if _, err := io.Copy(h, d); err != nil {
+			return fmt.Errorf("reading element %d failed: %v", n+1, err)
+		}
+		if err := tpm.Extend(h.Sum(nil), bootConfigPCR); err != nil {
 			return fmt.Errorf("measuring element %d failed: %v", n+1, err)
 		}
 	}
 	return tpm.Close()
 }
+
+// ReadSecurityVersionTPM returns the OS package security version high-water
+// mark stored in the TPM. If none has been stored yet, 0 is returned.
+// ErrNoTPM is returned if there is no TPM 2.0.
+func ReadSecurityVersionTPM() (uint64, error) {
+	tpm, err := openTPM20()
+	if err != nil {
+		return 0, err
+	}
+	defer tpm.Close()
+
+	v, defined, err := readSecurityVersion(tpm.RWC)
+	if err != nil {
+		return 0, err
+	}
+	if !defined {
+		stlog.Debug("TPM NV index %#x not defined", securityVersionNVIndex)
+	}
+	return v, nil
+}
+
+// StoreSecurityVersionTPM raises the security version high-water mark in the
+// TPM to v and write-locks it until the next TPM reset. The NV indices are
+// defined using ownerAuth if needed, which must be the non-empty owner
+// authorization of the TPM. Everything that can be checked is checked before
+// the TPM is changed. ErrNoTPM is returned if there is no TPM 2.0.
+func StoreSecurityVersionTPM(v uint64, ownerAuth string) error {
+	tpm, err := openTPM20()
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+
+	current, defined, err := readSecurityVersion(tpm.RWC)
+	if err != nil {
+		return err
+	}
+	if v > current && v-current > maxSecurityVersionSteps {
+		return fmt.Errorf("security version %d exceeds %d by more than %d", v, current, maxSecurityVersionSteps)
+	}
+	if !defined {
+		if err := defineSecurityVersion(tpm.RWC, ownerAuth); err != nil {
+			return err
+		}
+	}
+	for ; current < v; current++ {
+		if err := tpm2.NVIncrement(tpm.RWC, securityVersionNVIndex, ""); err != nil {
+			return fmt.Errorf("incrementing NV index %#x failed: %v", securityVersionNVIndex, err)
+		}
+	}
+	if err := tpm2.NVWriteLock(tpm.RWC, securityVersionNVIndex, securityVersionNVIndex, ""); err != nil {
+		return fmt.Errorf("locking NV index %#x failed: %v", securityVersionNVIndex, err)
+	}
+	return nil
+}
+
+// readSecurityVersion returns the high-water mark and whether the NV
+// indices are defined. Indices with unexpected attributes are an error, as
+// they may have been redefined by someone else.
+func readSecurityVersion(rw io.ReadWriter) (uint64, bool, error) {
+	counter, counterErr := tpm2.NVReadPublic(rw, securityVersionNVIndex)
+	base, baseErr := tpm2.NVReadPublic(rw, securityVersionBaseNVIndex)
+	switch {
+	case counterErr != nil && baseErr != nil:
+		return 0, false, nil
+	case counterErr != nil:
+		return 0, false, fmt.Errorf("NV index %#x not defined, but %#x is", securityVersionNVIndex, securityVersionBaseNVIndex)
+	case baseErr != nil:
+		return 0, false, fmt.Errorf("NV index %#x not defined, but %#x is", securityVersionBaseNVIndex, securityVersionNVIndex)
+	}
+	if counter.Attributes&nvTypeMask != nvTypeCounter || counter.Attributes&^(tpm2.AttrWriteLocked|tpm2.AttrWritten) != securityVersionAttrs {
+		return 0, false, fmt.Errorf("NV index %#x has unexpected attributes %v", securityVersionNVIndex, counter.Attributes)
+	}
+	if base.Attributes&^(tpm2.AttrWriteLocked|tpm2.AttrWritten) != securityVersionBaseAttrs || base.Attributes&tpm2.AttrWriteLocked == 0 {
+		return 0, false, fmt.Errorf("NV index %#x has unexpected attributes %v", securityVersionBaseNVIndex, base.Attributes)
+	}
+
+	c, err := readNVUint64(rw, securityVersionNVIndex)
+	if err != nil {
+		return 0, false, err
+	}
+	b, err := readNVUint64(rw, securityVersionBaseNVIndex)
+	if err != nil {
+		return 0, false, err
+	}
+	if c < b {
+		return 0, false, fmt.Errorf("NV counter %#x is below its base", securityVersionNVIndex)
+	}
+	return c - b, true, nil
+}
+
+// defineSecurityVersion defines the counter, initializes it and records its
+// initial value in the write-once base index.
+func defineSecurityVersion(rw io.ReadWriter, ownerAuth string) error {
+	set, err := ownerAuthSet(rw)
+	if err != nil {
+		return err
+	}
+	if !set || ownerAuth == "" {
+		return errors.New("TPM owner authorization must be set, otherwise the booted OS can reset the security version")
+	}
+	if err := tpm2.NVDefineSpace(rw, tpm2.HandleOwner, securityVersionNVIndex, ownerAuth, "", nil, securityVersionAttrs, 8); err != nil {
+		return fmt.Errorf("defining NV index %#x failed: %v", securityVersionNVIndex, err)
+	}
+	if err := tpm2.NVIncrement(rw, securityVersionNVIndex, ""); err != nil {
+		return fmt.Errorf("incrementing NV index %#x failed: %v", securityVersionNVIndex, err)
+	}
+	c, err := readNVUint64(rw, securityVersionNVIndex)
+	if err != nil {
+		return err
+	}
+	if err := tpm2.NVDefineSpace(rw, tpm2.HandleOwner, securityVersionBaseNVIndex, ownerAuth, "", nil, securityVersionBaseAttrs, 8); err != nil {
+		return fmt.Errorf("defining NV index %#x failed: %v", securityVersionBaseNVIndex, err)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, c)
+	if err := tpm2.NVWrite(rw, securityVersionBaseNVIndex, securityVersionBaseNVIndex, "", b, 0); err != nil {
+		return fmt.Errorf("writing NV index %#x failed: %v", securityVersionBaseNVIndex, err)
+	}
+	// permanent, as the index is write-define
+	if err := tpm2.NVWriteLock(rw, securityVersionBaseNVIndex, securityVersionBaseNVIndex, ""); err != nil {
+		return fmt.Errorf("locking NV index %#x failed: %v", securityVersionBaseNVIndex, err)
+	}
+	return nil
+}
+
+func readNVUint64(rw io.ReadWriter, index tpmutil.Handle) (uint64, error) {
+	b, err := tpm2.NVReadEx(rw, index, index, "", 0)
+	if err != nil {
+		return 0, fmt.Errorf("reading NV index %#x failed: %v", index, err)
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("NV index %#x has unexpected size %d", index, len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// ownerAuthSet reports whether the owner authorization of the TPM is set.
+func ownerAuthSet(rw io.ReadWriter) (bool, error) {
+	vals, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1, uint32(tpm2.TPMAPermanent))
+	if err != nil {
+		return false, fmt.Errorf("reading TPM properties failed: %v", err)
+	}
+	if len(vals) == 0 {
+		return false, errors.New("reading TPM properties failed: no TPMA_PERMANENT")
+	}
+	prop, ok := vals[0].(tpm2.TaggedProperty)
+	if !ok || prop.Tag != tpm2.TPMAPermanent {
+		return false, errors.New("reading TPM properties failed: no TPMA_PERMANENT")
+	}
+	return prop.Value&permanentOwnerAuthSet != 0, nil
+}
+
+// openTPM20 opens the TPM 2.0 of the host. ErrNoTPM is returned if there is
+// none, other errors concern a present TPM.
+func openTPM20() (*tss.TPM, error) {
+	devs, err := ioutil.ReadDir(tpmRoot)
+	if os.IsNotExist(err) || err == nil && len(devs) == 0 {
+		return nil, ErrNoTPM
+	}
+	tpm, err := tss.NewTPM()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open TPM: %v", err)
+	}
+	if tpm.Version != tss.TPMVersion20 {
+		tpm.Close()
+		return nil, ErrNoTPM
+	}
+	return tpm, nil
+}
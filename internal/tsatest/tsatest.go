@@ -0,0 +1,343 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tsatest provides an in-memory stand-in for a RFC 3161 time
+// stamping authority. It is meant for tests only and encodes its tokens
+// independently of the parser in package trust.
+package tsatest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/system-transparency/stboot/trust"
+)
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCert     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidSigningCertV2   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type issuerSerial struct {
+	Issuer       []asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type essCertID struct {
+	CertHash     []byte
+	IssuerSerial issuerSerial
+}
+
+type essCertIDv2 struct {
+	CertHash     []byte
+	IssuerSerial issuerSerial
+}
+
+type signingCertificate struct {
+	Certs []interface{}
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+// TSA issues timestamp tokens signed by a time stamping certificate, which
+// is issued by Root.
+type TSA struct {
+	Root *x509.Certificate
+	// Now returns the time put into tokens. If nil, time.Now is used.
+	Now func() time.Time
+	// SigningCert selects the signing certificate attribute: 2 for
+	// ESSCertIDv2 (the default), 1 for ESSCertID and -1 for none.
+	SigningCert int
+	// CertIDFor is the certificate named by the signing certificate
+	// attribute. If nil, the time stamping certificate is named.
+	CertIDFor *x509.Certificate
+	// Nonce replaces the nonce of requests in tokens served by ServeHTTP.
+	// If negative, tokens have no nonce.
+	Nonce *big.Int
+
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var _ trust.TSA = &TSA{}
+
+// New returns a TSA with a new root and time stamping certificate, both
+// valid from notBefore to notAfter.
+func New(notBefore, notAfter time.Time) (*TSA, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test TSA Root"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &TSA{Root: root, cert: cert, key: key}, nil
+}
+
+// Timestamp returns a DER encoded timestamp token over digest.
+func (t *TSA) Timestamp(digest [32]byte) ([]byte, error) {
+	return t.timestamp(digest, nil)
+}
+
+// timestamp returns a DER encoded timestamp token over digest, which
+// contains nonce unless it is nil.
+func (t *TSA) timestamp(digest [32]byte, nonce *big.Int) ([]byte, error) {
+	now := time.Now
+	if t.Now != nil {
+		now = t.Now
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version: 1,
+		Policy:  asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 0},
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			HashedMessage: digest[:],
+		},
+		SerialNumber: big.NewInt(now().UnixNano()),
+		GenTime:      now().UTC().Truncate(time.Second),
+		Nonce:        nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	eContent, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	infoDigest := sha256.Sum256(info)
+	contentType, err := newAttribute(oidContentType, oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := newAttribute(oidMessageDigest, infoDigest[:])
+	if err != nil {
+		return nil, err
+	}
+	attrs := []attribute{contentType, messageDigest}
+	if t.SigningCert >= 0 {
+		signingCert, err := t.signingCertAttribute()
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, signingCert)
+	}
+	signedAttrs, err := asn1.MarshalWithParams(attrs, "set")
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(signedAttrs)
+	sig, err := ecdsa.SignASN1(rand.Reader, t.key, attrsDigest[:])
+	if err != nil {
+		return nil, err
+	}
+	// signed attributes are implicitly tagged [0] inside SignerInfo
+	taggedAttrs := append([]byte{0xa0}, signedAttrs[1:]...)
+
+	sid, err := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: t.cert.RawIssuer},
+		SerialNumber: t.cert.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: eContent},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: t.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{FullBytes: taggedAttrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// ServeHTTP answers RFC 3161 timestamp queries.
+func (t *TSA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Version        int
+		MessageImprint messageImprint
+		Nonce          *big.Int `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var digest [32]byte
+	copy(digest[:], req.MessageImprint.HashedMessage)
+	nonce := req.Nonce
+	if t.Nonce != nil {
+		nonce = t.Nonce
+		if nonce.Sign() < 0 {
+			nonce = nil
+		}
+	}
+	token, err := t.timestamp(digest, nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := asn1.Marshal(struct {
+		Status struct{ Status int }
+		Token  asn1.RawValue
+	}{Token: asn1.RawValue{FullBytes: token}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(resp)
+}
+
+// signingCertAttribute returns the ESS signing certificate attribute naming
+// t.CertIDFor or the time stamping certificate.
+func (t *TSA) signingCertAttribute() (attribute, error) {
+	cert := t.cert
+	if t.CertIDFor != nil {
+		cert = t.CertIDFor
+	}
+	// directoryName [4] EXPLICIT Name
+	is := issuerSerial{
+		Issuer:       []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: cert.RawIssuer}},
+		SerialNumber: cert.SerialNumber,
+	}
+	if t.SigningCert == 1 {
+		h := sha1.Sum(cert.Raw)
+		return newAttribute(oidSigningCert, signingCertificate{Certs: []interface{}{essCertID{h[:], is}}})
+	}
+	h := sha256.Sum256(cert.Raw)
+	return newAttribute(oidSigningCertV2, signingCertificate{Certs: []interface{}{essCertIDv2{h[:], is}}})
+}
+
+func newAttribute(oid asn1.ObjectIdentifier, value interface{}) (attribute, error) {
+	v, err := asn1.Marshal(value)
+	if err != nil {
+		return attribute{}, err
+	}
+	return attribute{
+		Type:   oid,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: v},
+	}, nil
+}
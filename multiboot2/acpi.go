@@ -0,0 +1,143 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// efiSystabPath lists the physical addresses of the EFI configuration
+	// tables, including the ACPI RSDP.
+	efiSystabPath = "/sys/firmware/efi/systab"
+	// acpiPath exists if the running kernel uses ACPI.
+	acpiPath = "/sys/firmware/acpi"
+	// memPath gives access to physical memory.
+	memPath = "/dev/mem"
+)
+
+const (
+	rsdpSignature = "RSD PTR "
+	// rsdpV1Len is the length of the RSDP of ACPI 1.0, which is extended
+	// by later revisions.
+	rsdpV1Len = 20
+	rsdpV2Len = 36
+	// biosStart and biosEnd bound the BIOS read-only memory area searched
+	// for the RSDP on legacy systems.
+	biosStart = 0xe0000
+	biosEnd   = 0x100000
+)
+
+// findRSDP returns the ACPI RSDP of the running system. Its address is taken
+// from the EFI system table, or else the BIOS area is searched, like the
+// Linux kernel does. It fails if the system does not use ACPI.
+func findRSDP() ([]byte, error) {
+	if _, err := os.Stat(acpiPath); err != nil {
+		return nil, errors.New("no ACPI")
+	}
+	mem, err := os.Open(memPath)
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+
+	addr, err := systabRSDP(efiSystabPath)
+	if err == nil {
+		b := make([]byte, rsdpV2Len)
+		if _, err := mem.ReadAt(b, addr); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("reading RSDP at %#x failed: %v", addr, err)
+		}
+		return parseRSDP(b)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	bios := make([]byte, biosEnd-biosStart)
+	if _, err := mem.ReadAt(bios, biosStart); err != nil {
+		return nil, fmt.Errorf("reading BIOS area failed: %v", err)
+	}
+	for off := 0; off+rsdpV1Len <= len(bios); off += 16 {
+		if !bytes.HasPrefix(bios[off:], []byte(rsdpSignature)) {
+			continue
+		}
+		if rsdp, err := parseRSDP(bios[off:]); err == nil {
+			return rsdp, nil
+		}
+	}
+	return nil, errors.New("RSDP not found")
+}
+
+// systabRSDP returns the address of the RSDP listed in the EFI system table
+// file at path, preferring the one of ACPI 2.0 and later.
+func systabRSDP(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	addrs := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if kv := strings.SplitN(s.Text(), "=", 2); len(kv) == 2 {
+			addrs[kv[0]] = kv[1]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	for _, key := range []string{"ACPI20", "ACPI"} {
+		if v, ok := addrs[key]; ok {
+			addr, err := strconv.ParseInt(v, 0, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid %s address %q", path, key, v)
+			}
+			return addr, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no ACPI table", path)
+}
+
+// parseRSDP returns the RSDP at the start of b after checking its signature
+// and checksums.
+func parseRSDP(b []byte) ([]byte, error) {
+	if len(b) < rsdpV1Len || string(b[:len(rsdpSignature)]) != rsdpSignature {
+		return nil, errors.New("invalid RSDP signature")
+	}
+	if checksum(b[:rsdpV1Len]) != 0 {
+		return nil, errors.New("invalid RSDP checksum")
+	}
+	// revision 0 is ACPI 1.0, 2 and later have the extended RSDP
+	if b[15] < 2 {
+		return b[:rsdpV1Len], nil
+	}
+	if len(b) < rsdpV2Len {
+		return nil, errors.New("truncated RSDP")
+	}
+	length := binary.LittleEndian.Uint32(b[rsdpV1Len:])
+	if length < rsdpV2Len || uint64(length) > uint64(len(b)) {
+		return nil, fmt.Errorf("invalid RSDP length %d", length)
+	}
+	if checksum(b[:length]) != 0 {
+		return nil, errors.New("invalid extended RSDP checksum")
+	}
+	return b[:length], nil
+}
+
+func checksum(b []byte) byte {
+	var sum byte
+	for _, c := range b {
+		sum += c
+	}
+	return sum
+}
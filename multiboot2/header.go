@@ -0,0 +1,134 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	headerMagic  = 0xE85250D6
+	headerSearch = 32768
+	headerAlign  = 8
+	archI386     = 0
+)
+
+// header tag types
+const (
+	headerTagEnd            = 0
+	headerTagInfoRequest    = 1
+	headerTagAddress        = 2
+	headerTagEntryAddress   = 3
+	headerTagConsoleFlags   = 4
+	headerTagFramebuffer    = 5
+	headerTagModuleAlign    = 6
+	headerTagEFIBS          = 7
+	headerTagEntryAddrEFI32 = 8
+	headerTagEntryAddrEFI64 = 9
+	headerTagRelocatable    = 10
+)
+
+const headerTagOptional = 1
+
+// ErrHeaderNotFound is returned if a kernel does not contain a Multiboot2
+// header.
+var ErrHeaderNotFound = errors.New("multiboot2 header not found")
+
+// header is the Multiboot2 header of a kernel.
+type header struct {
+	// entryAddr is the entry point given by the header, if not zero.
+	entryAddr uint32
+	// requests are the types of information tags requested by the kernel,
+	// required those it cannot do without.
+	requests []uint32
+	required []uint32
+}
+
+// parseHeader searches the Multiboot2 header within the first 32 KiB of r.
+func parseHeader(r io.Reader) (*header, error) {
+	buf := make([]byte, headerSearch)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("reading kernel failed: %v", err)
+	}
+	buf = buf[:n]
+
+	le := binary.LittleEndian
+	for off := 0; off+16 <= len(buf); off += headerAlign {
+		if le.Uint32(buf[off:]) != headerMagic {
+			continue
+		}
+		arch := le.Uint32(buf[off+4:])
+		length := le.Uint32(buf[off+8:])
+		checksum := le.Uint32(buf[off+12:])
+		if headerMagic+arch+length+checksum != 0 {
+			continue
+		}
+		if arch != archI386 {
+			return nil, fmt.Errorf("unsupported architecture %d", arch)
+		}
+		if length < 16 || uint64(off)+uint64(length) > uint64(len(buf)) {
+			return nil, fmt.Errorf("invalid header length %d", length)
+		}
+		return parseHeaderTags(buf[off+16 : off+int(length)])
+	}
+	return nil, ErrHeaderNotFound
+}
+
+func parseHeaderTags(b []byte) (*header, error) {
+	le := binary.LittleEndian
+	var h header
+	for len(b) >= 8 {
+		typ := le.Uint16(b)
+		optional := le.Uint16(b[2:])&headerTagOptional != 0
+		size := le.Uint32(b[4:])
+		if size < 8 || uint64(size) > uint64(len(b)) {
+			return nil, fmt.Errorf("invalid size %d of header tag %d", size, typ)
+		}
+		tag := b[8:size]
+
+		switch typ {
+		case headerTagEnd:
+			return &h, nil
+		case headerTagInfoRequest:
+			for ; len(tag) >= 4; tag = tag[4:] {
+				req := le.Uint32(tag)
+				if !optional && !supportedTags[req] {
+					return nil, fmt.Errorf("unsupported information request %d", req)
+				}
+				h.requests = append(h.requests, req)
+				if !optional {
+					h.required = append(h.required, req)
+				}
+			}
+		case headerTagEntryAddress:
+			if len(tag) < 4 {
+				return nil, fmt.Errorf("invalid size %d of header tag %d", size, typ)
+			}
+			h.entryAddr = le.Uint32(tag)
+		case headerTagConsoleFlags, headerTagFramebuffer, headerTagModuleAlign,
+			headerTagEntryAddrEFI32, headerTagEntryAddrEFI64, headerTagRelocatable:
+			// modules are page aligned, the kernel is loaded at the
+			// addresses of its ELF segments and EFI entry points are
+			// only used if EFI boot services are available
+		default:
+			// includes the address tag for non-ELF kernels and the
+			// request to keep EFI boot services
+			if !optional {
+				return nil, fmt.Errorf("unsupported header tag %d", typ)
+			}
+		}
+
+		next := (size + 7) &^ 7
+		if uint64(next) >= uint64(len(b)) {
+			break
+		}
+		b = b[next:]
+	}
+	return nil, errors.New("missing end tag in header")
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot2
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/u-root/u-root/pkg/boot/kexec"
+)
+
+// information tag types
+const (
+	tagEnd            = 0
+	tagCmdline        = 1
+	tagBootLoaderName = 2
+	tagModule         = 3
+	tagBasicMeminfo   = 4
+	tagMmap           = 6
+	tagACPIOld        = 14
+	tagACPINew        = 15
+	tagEFIMmap        = 17
+)
+
+// supportedTags are the information tags provided to kernels.
+var supportedTags = map[uint32]bool{
+	tagCmdline:        true,
+	tagBootLoaderName: true,
+	tagModule:         true,
+	tagBasicMeminfo:   true,
+	tagMmap:           true,
+	tagACPIOld:        true,
+	tagACPINew:        true,
+	tagEFIMmap:        true,
+}
+
+// memory types of the mmap tag
+const (
+	memAvailable = 1
+	memReserved  = 2
+	memACPI      = 3
+	memNVS       = 4
+)
+
+var mmapTypes = map[kexec.RangeType]uint32{
+	kexec.RangeRAM:  memAvailable,
+	kexec.RangeACPI: memACPI,
+	kexec.RangeNVS:  memNVS,
+}
+
+// EFI memory types and attributes of the EFI mmap tag
+const (
+	efiReservedMemoryType   = 0
+	efiConventionalMemory   = 7
+	efiACPIReclaimMemory    = 9
+	efiACPIMemoryNVS        = 10
+	efiMemoryWB             = 0x8
+	efiDescriptorVersion    = 1
+	efiPageSize             = 4096
+	efiMemoryDescriptorSize = 40
+)
+
+var efiTypes = map[kexec.RangeType]uint32{
+	kexec.RangeRAM:  efiConventionalMemory,
+	kexec.RangeACPI: efiACPIReclaimMemory,
+	kexec.RangeNVS:  efiACPIMemoryNVS,
+}
+
+// module is a module loaded into memory.
+type module struct {
+	start, end uint32
+	cmdline    string
+}
+
+// info is the boot information passed to a Multiboot2 kernel. EFI boot
+// services are gone after kexec, so kernels requesting them are rejected.
+type info struct {
+	cmdline    string
+	bootloader string
+	modules    []module
+	mem        kexec.MemoryMap
+	// efi adds the memory map as EFI memory map, for kernels booted
+	// on EFI systems.
+	efi bool
+	// rsdp is the ACPI RSDP, if any. Its first 20 bytes are passed as the
+	// ACPI 1.0 RSDP, all of it as the ACPI 2.0 RSDP if it is longer.
+	rsdp []byte
+}
+
+// provides reports whether i contains information tags of type typ.
+func (i *info) provides(typ uint32) bool {
+	switch typ {
+	case tagEFIMmap:
+		return i.efi
+	case tagACPIOld:
+		return len(i.rsdp) >= rsdpV1Len
+	case tagACPINew:
+		return len(i.rsdp) > rsdpV1Len
+	}
+	return supportedTags[typ]
+}
+
+// marshal returns the boot information structure. It contains no
+// addresses of itself, so it can be placed anywhere.
+func (i *info) marshal() []byte {
+	var b bytes.Buffer
+	// total size and reserved field are set at the end
+	b.Write(make([]byte, 8))
+
+	writeStringTag(&b, tagCmdline, i.cmdline)
+	writeStringTag(&b, tagBootLoaderName, i.bootloader)
+	for _, m := range i.modules {
+		var t bytes.Buffer
+		le32(&t, m.start)
+		le32(&t, m.end)
+		t.WriteString(m.cmdline)
+		t.WriteByte(0)
+		writeTag(&b, tagModule, t.Bytes())
+	}
+
+	lower, upper := i.memoryBoundaries()
+	var meminfo bytes.Buffer
+	le32(&meminfo, lower>>10)
+	le32(&meminfo, upper>>10)
+	writeTag(&b, tagBasicMeminfo, meminfo.Bytes())
+
+	var mmap bytes.Buffer
+	le32(&mmap, 24) // entry size
+	le32(&mmap, 0)  // entry version
+	for _, r := range i.mem {
+		typ, ok := mmapTypes[r.Type]
+		if !ok {
+			typ = memReserved
+		}
+		le64(&mmap, uint64(r.Start))
+		le64(&mmap, uint64(r.Size))
+		le32(&mmap, typ)
+		le32(&mmap, 0)
+	}
+	writeTag(&b, tagMmap, mmap.Bytes())
+
+	if i.efi {
+		var efi bytes.Buffer
+		le32(&efi, efiMemoryDescriptorSize)
+		le32(&efi, efiDescriptorVersion)
+		for _, r := range i.mem {
+			typ, ok := efiTypes[r.Type]
+			if !ok {
+				typ = efiReservedMemoryType
+			}
+			var attr uint64
+			if typ == efiConventionalMemory {
+				attr = efiMemoryWB
+			}
+			le32(&efi, typ)
+			le32(&efi, 0)
+			le64(&efi, uint64(r.Start)) // physical start
+			le64(&efi, 0)               // virtual start
+			le64(&efi, (uint64(r.Size)+efiPageSize-1)/efiPageSize)
+			le64(&efi, attr)
+		}
+		writeTag(&b, tagEFIMmap, efi.Bytes())
+	}
+
+	if i.provides(tagACPIOld) {
+		writeTag(&b, tagACPIOld, i.rsdp[:rsdpV1Len])
+	}
+	if i.provides(tagACPINew) {
+		writeTag(&b, tagACPINew, i.rsdp)
+	}
+
+	writeTag(&b, tagEnd, nil)
+	d := b.Bytes()
+	binary.LittleEndian.PutUint32(d, uint32(len(d)))
+	return d
+}
+
+// memoryBoundaries returns the amount of lower memory starting at 0 and of
+// upper memory starting at 1 MiB in bytes.
+func (i *info) memoryBoundaries() (lower, upper uint32) {
+	const (
+		m1   = 1 << 20
+		k640 = 640 << 10
+	)
+	for _, r := range i.mem {
+		if r.Type != kexec.RangeRAM {
+			continue
+		}
+		end := uint64(r.Start) + uint64(r.Size)
+		if r.Start == 0 {
+			lower = uint32(min64(end, k640))
+		}
+		if uint64(r.Start) <= m1 && end > m1 {
+			upper = uint32(min64(end-m1, 0xFFFFFFFF))
+		}
+	}
+	return lower, upper
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func writeStringTag(b *bytes.Buffer, typ uint32, s string) {
+	writeTag(b, typ, append([]byte(s), 0))
+}
+
+// writeTag writes a tag with the given content padded to 8 bytes.
+func writeTag(b *bytes.Buffer, typ uint32, content []byte) {
+	le32(b, typ)
+	le32(b, uint32(8+len(content)))
+	b.Write(content)
+	if pad := (8 - b.Len()%8) % 8; pad != 0 {
+		b.Write(make([]byte, pad))
+	}
+}
+
+func le32(b *bytes.Buffer, v uint32) {
+	var d [4]byte
+	binary.LittleEndian.PutUint32(d[:], v)
+	b.Write(d[:])
+}
+
+func le64(b *bytes.Buffer, v uint64) {
+	var d [8]byte
+	binary.LittleEndian.PutUint64(d[:], v)
+	b.Write(d[:])
+}
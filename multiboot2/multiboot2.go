@@ -0,0 +1,189 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package multiboot2 loads ELF kernels like Xen or tboot using the
+// Multiboot2 protocol, see
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html.
+package multiboot2
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+	"github.com/u-root/u-root/pkg/boot/util"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+const bootloader = "stboot"
+
+// Image is a Multiboot2 kernel and its modules.
+type Image struct {
+	Name string
+
+	Kernel  io.ReaderAt
+	Cmdline string
+	Modules []multiboot.Module
+
+	// MaxModuleSize and MaxTotalSize bound the size of a single module
+	// and of all modules together, which are read into memory for
+	// loading. Zero means no limit.
+	MaxModuleSize uint64
+	MaxTotalSize  uint64
+}
+
+var _ boot.OSImage = &Image{}
+
+// Label returns either Name or a short description.
+func (img *Image) Label() string {
+	if len(img.Name) > 0 {
+		return img.Name
+	}
+	return fmt.Sprintf("Multiboot2(cmdline=%s)", img.Cmdline)
+}
+
+// Edit the kernel command line.
+func (img *Image) Edit(f func(cmdline string) string) {
+	img.Cmdline = f(img.Cmdline)
+}
+
+// String implements fmt.Stringer.
+func (img *Image) String() string {
+	modules := make([]string, len(img.Modules))
+	for i, mod := range img.Modules {
+		modules[i] = mod.Cmdline
+	}
+	return fmt.Sprintf("Multiboot2Image(\n  Name: %s\n  Cmdline: %s\n  Modules: %s\n)",
+		img.Name, img.Cmdline, strings.Join(modules, ", "))
+}
+
+// Load implements boot.OSImage.Load. The kernel may be gzip compressed.
+func (img *Image) Load(verbose bool) error {
+	kernel := util.TryGzipFilter(img.Kernel)
+	h, err := parseHeader(uio.Reader(kernel))
+	if err != nil {
+		return fmt.Errorf("multiboot2: %v", err)
+	}
+	entry, err := entryPoint(kernel, h)
+	if err != nil {
+		return fmt.Errorf("multiboot2: %v", err)
+	}
+
+	var mem kexec.Memory
+	if err := mem.LoadElfSegments(kernel); err != nil {
+		return fmt.Errorf("multiboot2: loading ELF segments failed: %v", err)
+	}
+	if err := mem.ParseMemoryMap(); err != nil {
+		return fmt.Errorf("multiboot2: parsing memory map failed: %v", err)
+	}
+
+	i := &info{
+		cmdline:    img.Cmdline,
+		bootloader: bootloader,
+		mem:        mem.Phys,
+	}
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		i.efi = true
+	}
+	if i.rsdp, err = findRSDP(); err != nil && verbose {
+		fmt.Fprintf(os.Stderr, "multiboot2: no ACPI RSDP: %v\n", err)
+	}
+	for _, req := range h.required {
+		if !i.provides(req) {
+			return fmt.Errorf("multiboot2: required information %d not available", req)
+		}
+	}
+	modules, err := img.readModules()
+	if err != nil {
+		return fmt.Errorf("multiboot2: %v", err)
+	}
+	for n, d := range modules {
+		mod := img.Modules[n]
+		r, err := mem.AddKexecSegment(d)
+		if err != nil {
+			return fmt.Errorf("multiboot2: adding module %d failed: %v", n+1, err)
+		}
+		end := uint64(r.Start) + uint64(len(d))
+		if end > 0xFFFFFFFF {
+			return fmt.Errorf("multiboot2: module %d above 4 GiB", n+1)
+		}
+		i.modules = append(i.modules, module{start: uint32(r.Start), end: uint32(end), cmdline: mod.Cmdline})
+	}
+
+	infoRange, err := mem.AddKexecSegment(i.marshal())
+	if err != nil {
+		return fmt.Errorf("multiboot2: adding boot information failed: %v", err)
+	}
+	if uint64(infoRange.Start) > 0xFFFFFFFF {
+		return fmt.Errorf("multiboot2: boot information above 4 GiB")
+	}
+
+	r, err := mem.FindSpace(trampolineSize)
+	if err != nil {
+		return fmt.Errorf("multiboot2: %v", err)
+	}
+	if uint64(r.Start) > 0xFFFFFFFF {
+		return fmt.Errorf("multiboot2: trampoline above 4 GiB")
+	}
+	t, err := trampoline(uint32(r.Start), uint32(infoRange.Start), entry)
+	if err != nil {
+		return fmt.Errorf("multiboot2: %v", err)
+	}
+	mem.Segments.Insert(kexec.NewSegment(t, r))
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "multiboot2: entry %#x, boot information at %#x, trampoline at %#x\n", entry, infoRange.Start, r.Start)
+	}
+	if err := kexec.Load(r.Start, mem.Segments, 0); err != nil {
+		return fmt.Errorf("multiboot2: kexec load failed: %v", err)
+	}
+	return nil
+}
+
+// readModules reads the modules of img into memory, within the limits of img.
+func (img *Image) readModules() ([][]byte, error) {
+	var modules [][]byte
+	var total uint64
+	for n, mod := range img.Modules {
+		r := uio.Reader(mod.Module)
+		if img.MaxModuleSize > 0 {
+			r = io.LimitReader(r, int64(img.MaxModuleSize)+1)
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading module %d failed: %v", n+1, err)
+		}
+		if img.MaxModuleSize > 0 && uint64(len(d)) > img.MaxModuleSize {
+			return nil, fmt.Errorf("module %d exceeds limit of %d bytes", n+1, img.MaxModuleSize)
+		}
+		total += uint64(len(d))
+		if img.MaxTotalSize > 0 && total > img.MaxTotalSize {
+			return nil, fmt.Errorf("modules exceed limit of %d bytes", img.MaxTotalSize)
+		}
+		modules = append(modules, d)
+	}
+	return modules, nil
+}
+
+// entryPoint returns the entry point given by the header h of kernel, or
+// else by its ELF header.
+func entryPoint(kernel io.ReaderAt, h *header) (uint32, error) {
+	f, err := elf.NewFile(kernel)
+	if err != nil {
+		return 0, fmt.Errorf("kernel is not an ELF file: %v", err)
+	}
+	if h.entryAddr != 0 {
+		return h.entryAddr, nil
+	}
+	if f.Entry > 0xFFFFFFFF {
+		return 0, fmt.Errorf("entry point %#x above 4 GiB", f.Entry)
+	}
+	return uint32(f.Entry), nil
+}
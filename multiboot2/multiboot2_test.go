@@ -0,0 +1,342 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot2
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/u-root/u-root/pkg/boot/kexec"
+	"github.com/u-root/u-root/pkg/boot/multiboot"
+)
+
+const (
+	testLoadAddr  = 0x100000
+	testELFEntry  = 0x100200
+	testHeaderOff = 0x100
+)
+
+func headerTag(typ, flags uint16, content ...uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, typ)
+	binary.Write(&b, binary.LittleEndian, flags)
+	binary.Write(&b, binary.LittleEndian, uint32(8+4*len(content)))
+	binary.Write(&b, binary.LittleEndian, content)
+	if pad := (8 - b.Len()%8) % 8; pad != 0 {
+		b.Write(make([]byte, pad))
+	}
+	return b.Bytes()
+}
+
+// newTestKernel returns an ELF kernel for i386 with a Multiboot2 header
+// containing tags, followed by the end tag.
+func newTestKernel(t *testing.T, tags ...[]byte) []byte {
+	t.Helper()
+	var mb bytes.Buffer
+	for _, tag := range tags {
+		mb.Write(tag)
+	}
+	mb.Write(headerTag(headerTagEnd, 0))
+	length := uint32(16 + mb.Len())
+
+	var b bytes.Buffer
+	eh := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_386),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     testELFEntry,
+		Phoff:     52,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     1,
+	}
+	copy(eh.Ident[:], elf.ELFMAG)
+	eh.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	eh.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	eh.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	require.NoError(t, binary.Write(&b, binary.LittleEndian, eh))
+	size := uint32(testHeaderOff + length + 0x100)
+	ph := elf.Prog32{
+		Type:   uint32(elf.PT_LOAD),
+		Vaddr:  testLoadAddr,
+		Paddr:  testLoadAddr,
+		Filesz: size,
+		Memsz:  size,
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Align:  0x1000,
+	}
+	require.NoError(t, binary.Write(&b, binary.LittleEndian, ph))
+	b.Write(make([]byte, testHeaderOff-b.Len()))
+
+	for _, v := range []uint32{headerMagic, archI386, length, -(headerMagic + archI386 + length)} {
+		require.NoError(t, binary.Write(&b, binary.LittleEndian, v))
+	}
+	b.Write(mb.Bytes())
+	b.Write(make([]byte, int(size)-b.Len()))
+	return b.Bytes()
+}
+
+func TestParseHeader(t *testing.T) {
+	kernel := newTestKernel(t,
+		headerTag(headerTagInfoRequest, 0, tagBasicMeminfo, tagMmap),
+		headerTag(headerTagFramebuffer, headerTagOptional, 1024, 768, 32),
+		headerTag(headerTagModuleAlign, 0),
+	)
+	h, err := parseHeader(bytes.NewReader(kernel))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{tagBasicMeminfo, tagMmap}, h.requests)
+	entry, err := entryPoint(bytes.NewReader(kernel), h)
+	require.NoError(t, err)
+	require.Equal(t, uint32(testELFEntry), entry)
+
+	kernel = newTestKernel(t, headerTag(headerTagEntryAddress, 0, 0x100400))
+	h, err = parseHeader(bytes.NewReader(kernel))
+	require.NoError(t, err)
+	entry, err = entryPoint(bytes.NewReader(kernel), h)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0x100400), entry)
+
+	bad := []struct {
+		name   string
+		kernel []byte
+	}{
+		{"unsupported request", newTestKernel(t, headerTag(headerTagInfoRequest, 0, 8))},
+		{"address tag", newTestKernel(t, headerTag(headerTagAddress, 0, 0, 0, 0, 0))},
+		{"EFI boot services", newTestKernel(t, headerTag(headerTagEFIBS, 0))},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseHeader(bytes.NewReader(tt.kernel))
+			require.Error(t, err)
+		})
+	}
+
+	// optional requests need not be supported
+	_, err = parseHeader(bytes.NewReader(newTestKernel(t, headerTag(headerTagInfoRequest, headerTagOptional, 8))))
+	require.NoError(t, err)
+
+	// a header with a wrong checksum is ignored
+	kernel = newTestKernel(t)
+	kernel[testHeaderOff+12]++
+	_, err = parseHeader(bytes.NewReader(kernel))
+	require.Equal(t, ErrHeaderNotFound, err)
+}
+
+type infoTag struct {
+	typ     uint32
+	content []byte
+}
+
+// parseInfo splits a boot information structure into its tags.
+func parseInfo(t *testing.T, b []byte) []infoTag {
+	t.Helper()
+	le := binary.LittleEndian
+	require.Equal(t, uint32(len(b)), le.Uint32(b))
+	var tags []infoTag
+	for off := 8; ; {
+		require.Zero(t, off%8, "tag not aligned")
+		typ, size := le.Uint32(b[off:]), le.Uint32(b[off+4:])
+		tags = append(tags, infoTag{typ, b[off+8 : off+int(size)]})
+		if typ == tagEnd {
+			require.Equal(t, len(b), off+8)
+			return tags
+		}
+		off += int(size+7) &^ 7
+	}
+}
+
+// newTestRSDP returns an ACPI 2.0 RSDP pointing to an XSDT at xsdt.
+func newTestRSDP(xsdt uint64) []byte {
+	b := make([]byte, rsdpV2Len)
+	copy(b, rsdpSignature)
+	copy(b[9:], "STBOOT")
+	b[15] = 2
+	binary.LittleEndian.PutUint32(b[20:], rsdpV2Len)
+	binary.LittleEndian.PutUint64(b[24:], xsdt)
+	b[8] = -checksum(b[:rsdpV1Len])
+	b[32] = -checksum(b)
+	return b
+}
+
+func TestInfo(t *testing.T) {
+	kernel := newTestKernel(t, headerTag(headerTagInfoRequest, 0, tagBasicMeminfo, tagMmap, tagEFIMmap, tagACPIOld, tagACPINew))
+	h, err := parseHeader(bytes.NewReader(kernel))
+	require.NoError(t, err)
+
+	i := &info{
+		cmdline:    "dom0_mem=1G",
+		bootloader: bootloader,
+		modules: []module{
+			{start: 0x200000, end: 0x200100, cmdline: "console=hvc0"},
+			{start: 0x300000, end: 0x300200},
+		},
+		mem: kexec.MemoryMap{
+			{Range: kexec.Range{Start: 0, Size: 0x9f000}, Type: kexec.RangeRAM},
+			{Range: kexec.Range{Start: 0x9f000, Size: 0x61000}, Type: kexec.RangeReserved},
+			{Range: kexec.Range{Start: 0x100000, Size: 0x7ff00000}, Type: kexec.RangeRAM},
+			{Range: kexec.Range{Start: 0x80000000, Size: 0x10000}, Type: kexec.RangeACPI},
+		},
+		efi:  true,
+		rsdp: newTestRSDP(0x80001000),
+	}
+	for _, req := range h.required {
+		require.True(t, i.provides(req), "required tag %d not provided", req)
+	}
+	tags := parseInfo(t, i.marshal())
+
+	byType := make(map[uint32][]infoTag)
+	for _, tag := range tags {
+		byType[tag.typ] = append(byType[tag.typ], tag)
+	}
+	for _, req := range h.requests {
+		require.Contains(t, byType, req, "requested tag %d missing", req)
+	}
+	le := binary.LittleEndian
+
+	require.Equal(t, "dom0_mem=1G\x00", string(byType[tagCmdline][0].content))
+	require.Equal(t, "stboot\x00", string(byType[tagBootLoaderName][0].content))
+
+	mods := byType[tagModule]
+	require.Len(t, mods, 2)
+	require.Equal(t, uint32(0x200000), le.Uint32(mods[0].content))
+	require.Equal(t, uint32(0x200100), le.Uint32(mods[0].content[4:]))
+	require.Equal(t, "console=hvc0\x00", string(mods[0].content[8:]))
+	require.Equal(t, "\x00", string(mods[1].content[8:]))
+
+	meminfo := byType[tagBasicMeminfo][0].content
+	require.Equal(t, uint32(0x9f000>>10), le.Uint32(meminfo))
+	require.Equal(t, uint32(0x7ff00000>>10), le.Uint32(meminfo[4:]))
+
+	mmap := byType[tagMmap][0].content
+	require.Equal(t, uint32(24), le.Uint32(mmap))
+	entries := mmap[8:]
+	require.Len(t, entries, 4*24)
+	wantTypes := []uint32{memAvailable, memReserved, memAvailable, memACPI}
+	for n, r := range i.mem {
+		e := entries[24*n:]
+		require.Equal(t, uint64(r.Start), le.Uint64(e))
+		require.Equal(t, uint64(r.Size), le.Uint64(e[8:]))
+		require.Equal(t, wantTypes[n], le.Uint32(e[16:]))
+	}
+
+	efi := byType[tagEFIMmap][0].content
+	require.Equal(t, uint32(efiMemoryDescriptorSize), le.Uint32(efi))
+	descs := efi[8:]
+	require.Len(t, descs, 4*efiMemoryDescriptorSize)
+	wantEFITypes := []uint32{efiConventionalMemory, efiReservedMemoryType, efiConventionalMemory, efiACPIReclaimMemory}
+	for n, r := range i.mem {
+		d := descs[efiMemoryDescriptorSize*n:]
+		require.Equal(t, wantEFITypes[n], le.Uint32(d))
+		require.Equal(t, uint64(r.Start), le.Uint64(d[8:]))
+		require.Equal(t, uint64(r.Size)/efiPageSize, le.Uint64(d[24:]))
+	}
+
+	require.Equal(t, i.rsdp[:rsdpV1Len], byType[tagACPIOld][0].content)
+	require.Equal(t, i.rsdp, byType[tagACPINew][0].content)
+
+	// without EFI and ACPI 2.0, the EFI memory map and the new RSDP are
+	// left out
+	i.efi = false
+	i.rsdp = i.rsdp[:rsdpV1Len]
+	require.False(t, i.provides(tagEFIMmap))
+	require.False(t, i.provides(tagACPINew))
+	for _, tag := range parseInfo(t, i.marshal()) {
+		require.NotEqual(t, uint32(tagEFIMmap), tag.typ)
+		require.NotEqual(t, uint32(tagACPINew), tag.typ)
+	}
+}
+
+func TestFindRSDP(t *testing.T) {
+	dir := t.TempDir()
+	acpiPath = dir
+	efiSystabPath = filepath.Join(dir, "systab")
+	memPath = filepath.Join(dir, "mem")
+	defer func() {
+		acpiPath = "/sys/firmware/acpi"
+		efiSystabPath = "/sys/firmware/efi/systab"
+		memPath = "/dev/mem"
+	}()
+
+	rsdp := newTestRSDP(0x7fff0000)
+	mem := make([]byte, biosEnd)
+	copy(mem[0x7e000:], rsdp)
+	copy(mem[0xf6a40:], rsdp[:rsdpV1Len])
+	mem[0xf6a40+15] = 0 // ACPI 1.0
+	mem[0xf6a40+8] = 0
+	mem[0xf6a40+8] = -checksum(mem[0xf6a40 : 0xf6a40+rsdpV1Len])
+	require.NoError(t, ioutil.WriteFile(memPath, mem, 0600))
+
+	// legacy systems are searched in the BIOS area
+	got, err := findRSDP()
+	require.NoError(t, err)
+	require.Equal(t, mem[0xf6a40:0xf6a40+rsdpV1Len], got)
+
+	// EFI systems list the RSDP in the system table
+	systab := "SMBIOS3=0x7f900000\nACPI20=0x7e000\nACPI=0xf6a40\n"
+	require.NoError(t, ioutil.WriteFile(efiSystabPath, []byte(systab), 0600))
+	got, err = findRSDP()
+	require.NoError(t, err)
+	require.Equal(t, rsdp, got)
+
+	// bad checksums are rejected
+	mem[0x7e000+30]++
+	require.NoError(t, ioutil.WriteFile(memPath, mem, 0600))
+	_, err = findRSDP()
+	require.Error(t, err)
+
+	acpiPath = filepath.Join(dir, "missing")
+	_, err = findRSDP()
+	require.Error(t, err, "no ACPI")
+}
+
+func TestReadModules(t *testing.T) {
+	img := &Image{
+		Modules: []multiboot.Module{
+			{Module: bytes.NewReader(make([]byte, 100))},
+			{Module: bytes.NewReader(make([]byte, 200))},
+		},
+	}
+	mods, err := img.readModules()
+	require.NoError(t, err)
+	require.Len(t, mods, 2)
+	require.Len(t, mods[1], 200)
+
+	img.MaxModuleSize = 200
+	_, err = img.readModules()
+	require.NoError(t, err)
+	img.MaxModuleSize = 199
+	_, err = img.readModules()
+	require.Error(t, err)
+
+	img.MaxModuleSize = 0
+	img.MaxTotalSize = 299
+	_, err = img.readModules()
+	require.Error(t, err)
+}
+
+func TestTrampoline(t *testing.T) {
+	const base, infoAddr, entry = 0x1000000, 0x2000000, testELFEntry
+	b, err := trampoline(base, infoAddr, entry)
+	require.NoError(t, err)
+	require.Len(t, b, trampolineSize)
+
+	le := binary.LittleEndian
+	// mov ebx, info
+	require.Equal(t, byte(0xBB), b[8])
+	require.Equal(t, uint32(infoAddr), le.Uint32(b[9:]))
+	// mov eax, magic; ljmp code segment:entry
+	i := bytes.Index(b, []byte{0xB8, 0x89, 0x62, 0xD7, 0x36, 0xEA})
+	require.Positive(t, i)
+	require.Equal(t, uint32(entry), le.Uint32(b[i+6:]))
+	require.Equal(t, uint16(codeSelector), le.Uint16(b[i+10:]))
+
+	_, err = trampoline(0x80000000, infoAddr, entry)
+	require.Error(t, err)
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// bootMagic is passed to the kernel in EAX.
+const bootMagic = 0x36D76289
+
+// GDT selectors of the trampoline
+const (
+	codeSelector = 0x08
+	dataSelector = 0x10
+)
+
+var gdt = []uint64{
+	0x0,                // null entry
+	0x00CF9A000000FFFF, // 32-bit code segment
+	0x00CF92000000FFFF, // data segment
+}
+
+// trampolineSize is the size of the code returned by trampoline.
+const trampolineSize = 128
+
+// trampoline returns code to be loaded at base, which is entered in 64-bit
+// mode after kexec. It switches to 32-bit protected mode without paging
+// and jumps to entry with the Multiboot2 magic in EAX and the address of
+// the boot information in EBX, as required by the Multiboot2 specification.
+func trampoline(base, info, entry uint32) ([]byte, error) {
+	if uint64(base)+trampolineSize > 1<<31 {
+		return nil, fmt.Errorf("trampoline at %#x: not addressable", base)
+	}
+	const (
+		gdtOff    = 80
+		gdtrOff   = gdtOff + 24
+		farptrOff = gdtrOff + 10
+	)
+	le := binary.LittleEndian
+	abs := func(off uint32) []byte {
+		var b [4]byte
+		le.PutUint32(b[:], base+off)
+		return b[:]
+	}
+	imm := func(v uint32) []byte {
+		var b [4]byte
+		le.PutUint32(b[:], v)
+		return b[:]
+	}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	// 64-bit mode
+	code64 := cat(
+		[]byte{0x0F, 0x01, 0x14, 0x25}, abs(gdtrOff), // lgdt [gdtr]
+		[]byte{0xBB}, imm(info), // mov ebx, info
+		[]byte{0xFF, 0x2C, 0x25}, abs(farptrOff), // ljmp [farptr]
+	)
+	// 32-bit compatibility mode, then protected mode
+	code32 := cat(
+		[]byte{0x0F, 0x20, 0xC0},      // mov eax, cr0
+		[]byte{0x25}, imm(0x7FFFFFFF), // and eax, ~CR0.PG
+		[]byte{0x0F, 0x22, 0xC0},      // mov cr0, eax
+		[]byte{0xB9}, imm(0xC0000080), // mov ecx, MSR_EFER
+		[]byte{0x0F, 0x32},            // rdmsr
+		[]byte{0x25}, imm(0xFFFFFEFF), // and eax, ~EFER.LME
+		[]byte{0x0F, 0x30},              // wrmsr
+		[]byte{0x31, 0xC0},              // xor eax, eax
+		[]byte{0x0F, 0x22, 0xE0},        // mov cr4, eax
+		[]byte{0xB8}, imm(dataSelector), // mov eax, data segment
+		[]byte{0x8E, 0xD8, 0x8E, 0xC0, 0x8E, 0xD0, 0x8E, 0xE0, 0x8E, 0xE8}, // mov ds, es, ss, fs, gs
+		[]byte{0xB8}, imm(bootMagic), // mov eax, magic
+		[]byte{0xEA}, imm(entry), []byte{codeSelector, 0x00}, // ljmp code segment:entry
+	)
+
+	b := make([]byte, trampolineSize)
+	copy(b, code64)
+	copy(b[len(code64):], code32)
+	if len(code64)+len(code32) > gdtOff {
+		return nil, fmt.Errorf("trampoline: code exceeds %d bytes", gdtOff)
+	}
+	for i, d := range gdt {
+		le.PutUint64(b[gdtOff+8*i:], d)
+	}
+	le.PutUint16(b[gdtrOff:], uint16(len(gdt)*8-1))
+	le.PutUint64(b[gdtrOff+2:], uint64(base+gdtOff))
+	le.PutUint32(b[farptrOff:], base+uint32(len(code64)))
+	le.PutUint16(b[farptrOff+4:], codeSelector)
+	return b, nil
+}
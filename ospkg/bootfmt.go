@@ -0,0 +1,182 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// x86 boot protocol, see https://www.kernel.org/doc/html/latest/x86/boot.html.
+const (
+	bzImageBootFlagOff   = 0x1FE
+	bzImageBootFlag      = 0xAA55
+	bzImageMagicOff      = 0x202
+	bzImageMagic         = "HdrS"
+	bzImageVersionOff    = 0x206
+	bzImageXLoadFlagsOff = 0x236
+	bzImageHeaderEnd     = 0x238
+	// bzImageMinVersion is the first boot protocol version announcing a
+	// 64-bit entry point, which is required by kexec.
+	bzImageMinVersion = 0x020C
+	xlfKernel64       = 1 << 0
+)
+
+// arm64 boot protocol, see https://www.kernel.org/doc/html/latest/arm64/booting.html.
+const (
+	arm64ImageFlagsOff  = 48
+	arm64ImageMagicOff  = 56
+	arm64ImageMagic     = "ARM\x64"
+	arm64ImageHeaderEnd = 64
+	arm64ImageBigEndian = 1 << 0
+)
+
+// newc cpio format, see https://www.kernel.org/doc/html/latest/driver-api/early-userspace/buffer-format.html.
+const (
+	newcMagic      = "070701"
+	newcCRCMagic   = "070702"
+	newcHeaderSize = 110
+)
+
+const gzipMagic = "\x1F\x8B"
+
+// initramfsCompressions are the magic numbers of compression formats
+// supported for initramfs by Linux besides gzip. Gzip compressed archives
+// are decompressed in order to check the archive within.
+var initramfsCompressions = []string{
+	"\xFD7zXZ\x00",     // xz
+	"\x28\xB5\x2F\xFD", // zstd
+	"\x02\x21\x4C\x18", // lz4 legacy format
+}
+
+// kernelArch returns the architecture of the Linux kernel r by the name
+// used by Go. It recognizes x86 bzImages supporting the 64-bit boot protocol
+// and arm64 Images, which may be gzip compressed.
+func kernelArch(r sizeReaderAt) (string, error) {
+	head := make([]byte, bzImageHeaderEnd)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	if bytes.HasPrefix(head, []byte(gzipMagic)) {
+		zr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			return "", fmt.Errorf("invalid gzip data: %v", err)
+		}
+		head = make([]byte, arm64ImageHeaderEnd)
+		if _, err := io.ReadFull(zr, head); err != nil {
+			return "", fmt.Errorf("invalid gzip data: %v", err)
+		}
+	}
+
+	le := binary.LittleEndian
+	switch {
+	case len(head) >= bzImageHeaderEnd && string(head[bzImageMagicOff:bzImageMagicOff+4]) == bzImageMagic:
+		if le.Uint16(head[bzImageBootFlagOff:]) != bzImageBootFlag {
+			return "", errors.New("invalid bzImage boot flag")
+		}
+		if v := le.Uint16(head[bzImageVersionOff:]); v < bzImageMinVersion {
+			return "", fmt.Errorf("bzImage boot protocol %d.%02d, need at least %d.%02d", v>>8, v&0xFF, bzImageMinVersion>>8, bzImageMinVersion&0xFF)
+		}
+		if le.Uint16(head[bzImageXLoadFlagsOff:])&xlfKernel64 == 0 {
+			return "", errors.New("bzImage has no 64-bit entry point")
+		}
+		return "amd64", nil
+	case len(head) >= arm64ImageHeaderEnd && string(head[arm64ImageMagicOff:arm64ImageMagicOff+4]) == arm64ImageMagic:
+		if le.Uint64(head[arm64ImageFlagsOff:])&arm64ImageBigEndian != 0 {
+			return "", errors.New("big-endian arm64 Image")
+		}
+		return "arm64", nil
+	default:
+		return "", errors.New("neither an x86 bzImage nor an arm64 Image")
+	}
+}
+
+// decompressKernel returns the kernel r as handed to kexec. A gzip compressed
+// arm64 Image is decompressed, as kexec_file_load only accepts plain Images.
+// The decompressed Image must not exceed limit bytes.
+func decompressKernel(r sizeReaderAt, limit uint64) (sizeReaderAt, error) {
+	head := make([]byte, len(gzipMagic))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(head) != gzipMagic {
+		return r, nil
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip data: %v", err)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip data: %v", err)
+	}
+	if uint64(len(b)) > limit {
+		return nil, fmt.Errorf("decompressed kernel exceeds %d bytes", limit)
+	}
+	kernel := bytes.NewReader(b)
+	if arch, err := kernelArch(kernel); err != nil {
+		return nil, err
+	} else if arch != "arm64" {
+		return nil, fmt.Errorf("gzip compressed kernel for %s", arch)
+	}
+	return kernel, nil
+}
+
+// checkInitramfs checks that r is a cpio archive in the newc format as
+// required by Linux, which may be compressed.
+func checkInitramfs(r sizeReaderAt) error {
+	head := make([]byte, newcHeaderSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+
+	if bytes.HasPrefix(head, []byte(gzipMagic)) {
+		zr, err := gzip.NewReader(io.NewSectionReader(r, 0, r.Size()))
+		if err != nil {
+			return fmt.Errorf("invalid gzip data: %v", err)
+		}
+		head = make([]byte, newcHeaderSize)
+		n, err := io.ReadFull(zr, head)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("invalid gzip data: %v", err)
+		}
+		return checkNewcHeader(head[:n])
+	}
+	for _, magic := range initramfsCompressions {
+		if bytes.HasPrefix(head, []byte(magic)) {
+			// the archive within cannot be checked without
+			// decompressing it
+			return nil
+		}
+	}
+	return checkNewcHeader(head)
+}
+
+// checkNewcHeader checks the first header of a newc cpio archive.
+func checkNewcHeader(head []byte) error {
+	if len(head) < newcHeaderSize {
+		return errors.New("not a newc cpio archive and not compressed with gzip, xz, zstd or lz4")
+	}
+	magic := string(head[:len(newcMagic)])
+	if magic != newcMagic && magic != newcCRCMagic {
+		return errors.New("not a newc cpio archive and not compressed with gzip, xz, zstd or lz4")
+	}
+	for _, c := range head[len(newcMagic):] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return errors.New("invalid newc cpio header")
+		}
+	}
+	return nil
+}
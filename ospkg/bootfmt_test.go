@@ -0,0 +1,215 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKernel    = newTestBzImage("kernel")
+	testInitramfs = newTestInitramfs("initramfs")
+)
+
+// newTestBzImage returns the header of an x86_64 bzImage followed by
+// payload.
+func newTestBzImage(payload string) []byte {
+	b := make([]byte, bzImageHeaderEnd)
+	le := binary.LittleEndian
+	le.PutUint16(b[bzImageBootFlagOff:], bzImageBootFlag)
+	copy(b[bzImageMagicOff:], bzImageMagic)
+	le.PutUint16(b[bzImageVersionOff:], 0x020F)
+	le.PutUint16(b[bzImageXLoadFlagsOff:], xlfKernel64)
+	return append(b, payload...)
+}
+
+// newTestArm64Image returns the header of an arm64 Image followed by
+// payload.
+func newTestArm64Image(payload string) []byte {
+	b := make([]byte, arm64ImageHeaderEnd)
+	copy(b[arm64ImageMagicOff:], arm64ImageMagic)
+	return append(b, payload...)
+}
+
+// newTestInitramfs returns a newc cpio archive containing the file init
+// with content.
+func newTestInitramfs(content string) []byte {
+	var b bytes.Buffer
+	pad := func() {
+		for b.Len()%4 != 0 {
+			b.WriteByte(0)
+		}
+	}
+	entry := func(name string, mode uint32, data string) {
+		fmt.Fprintf(&b, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			newcMagic, 1, mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		b.WriteString(name)
+		b.WriteByte(0)
+		pad()
+		b.WriteString(data)
+		pad()
+	}
+	entry("init", 0100755, content)
+	entry("TRAILER!!!", 0, "")
+	return b.Bytes()
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestKernelArch(t *testing.T) {
+	tests := []struct {
+		name   string
+		kernel []byte
+		arch   string
+	}{
+		{"bzImage", testKernel, "amd64"},
+		{"arm64 Image", newTestArm64Image("kernel"), "arm64"},
+		{"arm64 Image.gz", gzipped(t, newTestArm64Image("kernel")), "arm64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arch, err := kernelArch(bytes.NewReader(tt.kernel))
+			require.NoError(t, err)
+			require.Equal(t, tt.arch, arch)
+		})
+	}
+
+	bad := []struct {
+		name string
+		edit func(b []byte) []byte
+	}{
+		{"unknown format", func(b []byte) []byte { return []byte("kernel") }},
+		{"boot flag", func(b []byte) []byte { b[bzImageBootFlagOff] = 0; return b }},
+		{"old boot protocol", func(b []byte) []byte { b[bzImageVersionOff] = 0x0A; return b }},
+		{"32-bit", func(b []byte) []byte { b[bzImageXLoadFlagsOff] = 0; return b }},
+		{"truncated", func(b []byte) []byte { return b[:bzImageXLoadFlagsOff] }},
+		{"big-endian arm64", func(b []byte) []byte {
+			b = newTestArm64Image("kernel")
+			b[arm64ImageFlagsOff] = arm64ImageBigEndian
+			return b
+		}},
+		{"invalid gzip", func(b []byte) []byte { return []byte(gzipMagic + "kernel") }},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := kernelArch(bytes.NewReader(tt.edit(newTestBzImage("kernel"))))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDecompressKernel(t *testing.T) {
+	image := newTestArm64Image("kernel")
+	got, err := decompressKernel(bytes.NewReader(gzipped(t, image)), 1<<20)
+	require.NoError(t, err)
+	b := make([]byte, got.Size())
+	_, err = got.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, image, b)
+
+	// uncompressed kernels are passed on as they are
+	r := bytes.NewReader(testKernel)
+	got, err = decompressKernel(r, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, r, got)
+
+	bad := map[string][]byte{
+		"limit":        gzipped(t, newTestArm64Image(strings.Repeat("kernel", 1000))),
+		"bzImage":      gzipped(t, testKernel),
+		"truncated":    gzipped(t, image)[:40],
+		"invalid gzip": []byte(gzipMagic + "kernel"),
+	}
+	for name, kernel := range bad {
+		t.Run(name, func(t *testing.T) {
+			_, err := decompressKernel(bytes.NewReader(kernel), 1024)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCheckInitramfs(t *testing.T) {
+	good := map[string][]byte{
+		"newc":      testInitramfs,
+		"newc gzip": gzipped(t, testInitramfs),
+		"xz":        []byte("\xFD7zXZ\x00initramfs"),
+		"zstd":      []byte("\x28\xB5\x2F\xFDinitramfs"),
+		"lz4":       []byte("\x02\x21\x4C\x18initramfs"),
+	}
+	for name, initramfs := range good {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, checkInitramfs(bytes.NewReader(initramfs)))
+		})
+	}
+
+	odc := append([]byte("070707"), testInitramfs[6:]...)
+	invalid := append([]byte(nil), testInitramfs...)
+	invalid[20] = 'x'
+	bad := map[string][]byte{
+		"arbitrary data": []byte("initramfs"),
+		"old cpio":       odc,
+		"invalid header": invalid,
+		"truncated":      testInitramfs[:newcHeaderSize-1],
+		"gzip data":      gzipped(t, []byte("initramfs")),
+		"invalid gzip":   []byte(gzipMagic + "initramfs"),
+	}
+	for name, initramfs := range bad {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, checkInitramfs(bytes.NewReader(initramfs)))
+		})
+	}
+}
+
+func TestCreateOSPackageBootFormats(t *testing.T) {
+	dir := t.TempDir()
+	k := writeTestFile(t, dir, "kernel", testKernel)
+	i := writeTestFile(t, dir, "initramfs", testInitramfs)
+	junk := writeTestFile(t, dir, "junk", []byte("junk"))
+
+	_, err := CreateOSPackage("test", "", junk, i, "", "", "", nil)
+	require.EqualError(t, err, "os package: invalid kernel: neither an x86 bzImage nor an arm64 Image")
+	_, err = CreateOSPackage("test", "", k, junk, "", "", "", nil)
+	require.Error(t, err)
+
+	// the kernel of a boot entry must match its architecture
+	src := t.TempDir()
+	writeTestFile(t, src, "kernel", testKernel)
+	writeTestFile(t, src, "initramfs", testInitramfs)
+	m := &OSManifest{
+		Version: ManifestVersion,
+		Entries: []BootEntry{{Arch: "arm64", KernelPath: "kernel", InitramfsPath: "initramfs"}},
+	}
+	require.NoError(t, m.Write(src))
+	_, err = CreateOSPackageFromDir(src, "")
+	require.EqualError(t, err, "os package: kernel of entry arm64 is built for amd64")
+
+	// without entries the kernel must match the target architecture
+	defer func(arch string) { goarch = arch }(goarch)
+	goarch = "amd64"
+	arm64Kernel := writeTestFile(t, dir, "Image", newTestArm64Image("Image"))
+	_, err = CreateOSPackage("test", "", arm64Kernel, i, "", "", "", nil)
+	require.EqualError(t, err, "os package: kernel is built for arm64, need amd64")
+	_, err = createTestUKIOSPackage(t, newTestUKI(t, testSection{ukiKernelSection, newTestArm64Image("Image")}))
+	require.EqualError(t, err, "os package: kernel of uki is built for arm64, need amd64")
+	goarch = "arm64"
+	osp, err := CreateOSPackage("test", "", arm64Kernel, i, "", "", "", nil)
+	require.NoError(t, err)
+	_, err = verifiedTestOSPackage(t, osp).OSImage(false)
+	require.NoError(t, err)
+}
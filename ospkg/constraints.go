@@ -0,0 +1,126 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// HostConstraints restrict the hosts an OS package is booted on. They are
+// part of the signed metadata. Each non-empty list must contain a match for
+// the host, empty lists match any host.
+type HostConstraints struct {
+	// HostIDs are the IDs of the host configuration allowed to boot the
+	// OS package. Entries may be shell patterns as understood by
+	// path.Match, e.g. "rack1-*".
+	HostIDs []string `json:"host_ids,omitempty"`
+	// Products are SMBIOS product names, as found in
+	// /sys/class/dmi/id/product_name.
+	Products []string `json:"smbios_products,omitempty"`
+	// CPUVendors are CPU vendor IDs as reported by the kernel, e.g.
+	// GenuineIntel or AuthenticAMD.
+	CPUVendors []string `json:"cpu_vendors,omitempty"`
+}
+
+// HostInfo describes the running host for matching HostConstraints. Empty
+// fields are unknown and match no constraint.
+type HostInfo struct {
+	ID        string
+	Product   string
+	CPUVendor string
+}
+
+// IsZero reports whether c matches any host.
+func (c *HostConstraints) IsZero() bool {
+	return c == nil || len(c.HostIDs) == 0 && len(c.Products) == 0 && len(c.CPUVendors) == 0
+}
+
+// Validate checks that c contains no empty entries or malformed patterns.
+func (c *HostConstraints) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, id := range c.HostIDs {
+		if id == "" {
+			return errors.New("empty host ID")
+		}
+		if _, err := path.Match(id, ""); err != nil {
+			return fmt.Errorf("invalid host ID pattern %q", id)
+		}
+	}
+	for _, p := range c.Products {
+		if p == "" {
+			return errors.New("empty SMBIOS product name")
+		}
+	}
+	for _, v := range c.CPUVendors {
+		if v == "" {
+			return errors.New("empty CPU vendor")
+		}
+	}
+	return nil
+}
+
+// Match returns an error describing why h does not satisfy c, or nil.
+func (c *HostConstraints) Match(h HostInfo) error {
+	if c.IsZero() {
+		return nil
+	}
+	if len(c.HostIDs) > 0 && !matchHostID(c.HostIDs, h.ID) {
+		return fmt.Errorf("host ID %q is not one of %s", h.ID, strings.Join(c.HostIDs, ", "))
+	}
+	if len(c.Products) > 0 && !contains(c.Products, h.Product) {
+		return fmt.Errorf("SMBIOS product %q is not one of %s", h.Product, strings.Join(c.Products, ", "))
+	}
+	if len(c.CPUVendors) > 0 && !contains(c.CPUVendors, h.CPUVendor) {
+		return fmt.Errorf("CPU vendor %q is not one of %s", h.CPUVendor, strings.Join(c.CPUVendors, ", "))
+	}
+	return nil
+}
+
+func matchHostID(patterns []string, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a one-line description of c.
+func (c *HostConstraints) String() string {
+	if c.IsZero() {
+		return "any host"
+	}
+	var parts []string
+	if len(c.HostIDs) > 0 {
+		parts = append(parts, "host IDs "+strings.Join(c.HostIDs, ", "))
+	}
+	if len(c.Products) > 0 {
+		parts = append(parts, "SMBIOS products "+strings.Join(c.Products, ", "))
+	}
+	if len(c.CPUVendors) > 0 {
+		parts = append(parts, "CPU vendors "+strings.Join(c.CPUVendors, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostConstraintsMatch(t *testing.T) {
+	host := HostInfo{ID: "rack1-07", Product: "ProLiant DL360 Gen10", CPUVendor: "GenuineIntel"}
+	tests := []struct {
+		name  string
+		c     *HostConstraints
+		h     HostInfo
+		match bool
+	}{
+		{"nil", nil, host, true},
+		{"empty", &HostConstraints{}, HostInfo{}, true},
+		{"host ID", &HostConstraints{HostIDs: []string{"rack1-07"}}, host, true},
+		{"host ID pattern", &HostConstraints{HostIDs: []string{"rack2-*", "rack1-*"}}, host, true},
+		{"other host ID", &HostConstraints{HostIDs: []string{"rack2-*"}}, host, false},
+		{"missing host ID", &HostConstraints{HostIDs: []string{"*"}}, HostInfo{}, false},
+		{"product", &HostConstraints{Products: []string{"ProLiant DL360 Gen10"}}, host, true},
+		{"other product", &HostConstraints{Products: []string{"ProLiant DL380 Gen10"}}, host, false},
+		{"CPU vendor", &HostConstraints{CPUVendors: []string{"AuthenticAMD", "GenuineIntel"}}, host, true},
+		{"other CPU vendor", &HostConstraints{CPUVendors: []string{"AuthenticAMD"}}, host, false},
+		{"all", &HostConstraints{HostIDs: []string{"rack1-*"}, Products: []string{"ProLiant DL360 Gen10"}, CPUVendors: []string{"GenuineIntel"}}, host, true},
+		{"all but one", &HostConstraints{HostIDs: []string{"rack1-*"}, Products: []string{"ProLiant DL360 Gen10"}, CPUVendors: []string{"AuthenticAMD"}}, host, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.c.Match(tt.h)
+			if tt.match {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestHostConstraintsValidate(t *testing.T) {
+	require.NoError(t, (*HostConstraints)(nil).Validate())
+	require.NoError(t, (&HostConstraints{HostIDs: []string{"rack[12]-*"}}).Validate())
+	require.Error(t, (&HostConstraints{HostIDs: []string{"rack[12"}}).Validate())
+	require.Error(t, (&HostConstraints{HostIDs: []string{""}}).Validate())
+	require.Error(t, (&HostConstraints{Products: []string{""}}).Validate())
+	require.Error(t, (&HostConstraints{CPUVendors: []string{""}}).Validate())
+}
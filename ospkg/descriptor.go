@@ -5,14 +5,25 @@
 package ospkg
 
 import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/url"
+
+	"github.com/system-transparency/stboot/trust"
 )
 
 const (
-	DescriptorVersion int = 1
+	// DescriptorVersion is the version of newly created descriptors.
+	// Signatures of version 2 descriptors cover the archive hash along with
+	// the descriptor metadata, see Descriptor.SignedHash.
+	DescriptorVersion int = 2
+	// DescriptorVersionLegacy is the version of descriptors whose signatures
+	// cover the archive hash only.
+	DescriptorVersionLegacy int = 1
 	// DescriptorExt is the file extension of OS package descriptor file
 	DescriptorExt string = ".json"
 )
@@ -22,8 +33,56 @@ type Descriptor struct {
 	Version int    `json:"version"`
 	PkgURL  string `json:"os_pkg_url"`
 
+	// Metadata of version 2 descriptors. Times are UNIX timestamps,
+	// zero means unset.
+	Label   string `json:"label,omitempty"`
+	Created int64  `json:"created,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+
+	// SecurityVersion is used for rollback protection. stboot refuses OS
+	// packages with a security version lower than the highest one booted
+	// before, unless AllowDowngrade is set.
+	SecurityVersion uint64 `json:"security_version,omitempty"`
+	AllowDowngrade  bool   `json:"allow_downgrade,omitempty"`
+
+	// Constraints restrict the hosts booting the OS package.
+	Constraints *HostConstraints `json:"constraints,omitempty"`
+
 	Certificates [][]byte `json:"certificates"`
 	Signatures   [][]byte `json:"signatures"`
+	// Intermediates holds a PEM bundle of intermediate certificates for
+	// each signature. They are used to build the chain from the signing
+	// certificate to the root and are not covered by the signatures.
+	Intermediates [][]byte `json:"intermediates,omitempty"`
+	// Timestamps holds a DER encoded RFC 3161 timestamp token over the
+	// SHA-256 hash of each signature, or nil. They are not covered by the
+	// signatures.
+	Timestamps [][]byte `json:"timestamps,omitempty"`
+
+	// LogProof proves that the signed hash of the descriptor is logged in
+	// a transparency log. It is attached after signing and therefore not
+	// covered by the signatures.
+	LogProof *trust.LogProof `json:"log_proof,omitempty"`
+
+	// dsse holds the payload of descriptors encoded as DSSE envelope.
+	dsse *dsseData
+}
+
+// signedData is the canonical encoding of the data covered by the
+// signatures of a version 2 descriptor. It is serialized as compact JSON
+// with the fields in the order defined here. Fields added after the
+// introduction of version 2 are omitted if empty, so existing signatures
+// stay valid.
+type signedData struct {
+	Version         int              `json:"version"`
+	ArchiveSHA256   string           `json:"archive_sha256"`
+	PkgURL          string           `json:"os_pkg_url"`
+	Label           string           `json:"label"`
+	Created         int64            `json:"created"`
+	Expires         int64            `json:"expires"`
+	SecurityVersion uint64           `json:"security_version,omitempty"`
+	AllowDowngrade  bool             `json:"allow_downgrade,omitempty"`
+	Constraints     *HostConstraints `json:"constraints,omitempty"`
 }
 
 // DescriptorFromFile parses a manifest from a json file
@@ -35,8 +94,13 @@ func DescriptorFromFile(src string) (*Descriptor, error) {
 	return DescriptorFromBytes(bytes)
 }
 
-// DescriptorFromBytes parses a manifest from a byte slice.
+// DescriptorFromBytes parses a manifest from a byte slice. Besides the
+// plain JSON format, DSSE envelopes with an in-toto statement as payload
+// are detected and parsed.
 func DescriptorFromBytes(data []byte) (*Descriptor, error) {
+	if isDSSE(data) {
+		return descriptorFromDSSE(data)
+	}
 	var d Descriptor
 	if err := json.Unmarshal(data, &d); err != nil {
 		return nil, fmt.Errorf("descriptor: parsing failed: %v", err)
@@ -46,6 +110,9 @@ func DescriptorFromBytes(data []byte) (*Descriptor, error) {
 
 // Bytes serializes a manifest stuct into a byte slice.
 func (d *Descriptor) Bytes() ([]byte, error) {
+	if d.dsse != nil {
+		return d.dsseBytes()
+	}
 	buf, err := json.MarshalIndent(d, "", "  ")
 	if err != nil {
 		return nil, fmt.Errorf("descriptor: serializing failed: %v", err)
@@ -53,11 +120,89 @@ func (d *Descriptor) Bytes() ([]byte, error) {
 	return buf, nil
 }
 
+func (d *Descriptor) signedData(archiveHash [32]byte) signedData {
+	return signedData{
+		Version:         d.Version,
+		ArchiveSHA256:   hex.EncodeToString(archiveHash[:]),
+		PkgURL:          d.PkgURL,
+		Label:           d.Label,
+		Created:         d.Created,
+		Expires:         d.Expires,
+		SecurityVersion: d.SecurityVersion,
+		AllowDowngrade:  d.AllowDowngrade,
+		Constraints:     d.Constraints,
+	}
+}
+
+// SignedBytes returns the canonical encoding of the data covered by the
+// signatures of d, given the SHA-256 hash of the OS package archive.
+// For DSSE encoded descriptors this is the DSSE pre-authentication encoding
+// of the payload.
+func (d *Descriptor) SignedBytes(archiveHash [32]byte) ([]byte, error) {
+	switch d.Version {
+	case DescriptorVersionLegacy:
+		return archiveHash[:], nil
+	case DescriptorVersion:
+		sd := d.signedData(archiveHash)
+		if d.dsse != nil {
+			return d.dsseSignedBytes(sd)
+		}
+		buf, err := json.Marshal(sd)
+		if err != nil {
+			return nil, fmt.Errorf("descriptor: serializing signed data failed: %v", err)
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("descriptor: invalid version %d", d.Version)
+	}
+}
+
+// SignedHash returns the hash to be signed for d, given the SHA-256 hash
+// of the OS package archive. For legacy descriptors this is the archive
+// hash itself, for version 2 descriptors the hash of d.SignedBytes.
+// Signatures of DSSE encoded descriptors cover d.SignedBytes directly, see
+// SignatureInput, but the hash still identifies the signed data.
+func (d *Descriptor) SignedHash(archiveHash [32]byte) ([32]byte, error) {
+	if d.Version == DescriptorVersionLegacy {
+		return archiveHash, nil
+	}
+	b, err := d.SignedBytes(archiveHash)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(b), nil
+}
+
+// SignatureInput returns the input to the trust.Signer of key for d, given
+// the SHA-256 hash of the OS package archive. It is d.SignedHash, except for
+// DSSE encoded descriptors, whose signatures cover the pre-authentication
+// encoding as required by DSSE.
+func (d *Descriptor) SignatureInput(archiveHash [32]byte, key crypto.PublicKey) ([]byte, error) {
+	if d.dsse == nil {
+		h, err := d.SignedHash(archiveHash)
+		if err != nil {
+			return nil, err
+		}
+		return h[:], nil
+	}
+	pae, err := d.SignedBytes(archiveHash)
+	if err != nil {
+		return nil, err
+	}
+	return dsseSignatureInput(pae, key), nil
+}
+
 // Validate returns true if s has valid content.
 func (d *Descriptor) Validate() error {
 	// Version
-	if d.Version != DescriptorVersion {
-		return fmt.Errorf("descriptor: invalid version %d. Want %d", d.Version, DescriptorVersion)
+	switch d.Version {
+	case DescriptorVersion:
+	case DescriptorVersionLegacy:
+		if d.Label != "" || d.Created != 0 || d.Expires != 0 || d.SecurityVersion != 0 || d.AllowDowngrade || d.Constraints != nil {
+			return fmt.Errorf("descriptor: version %d does not support metadata", d.Version)
+		}
+	default:
+		return fmt.Errorf("descriptor: invalid version %d. Want %d or %d", d.Version, DescriptorVersion, DescriptorVersionLegacy)
 	}
 
 	// Package URL
@@ -68,5 +213,27 @@ func (d *Descriptor) Validate() error {
 	if d.PkgURL != "" && u.Scheme == "" {
 		return fmt.Errorf("descriptor: invalid invalid package URL: missing scheme")
 	}
+
+	// Signatures
+	if len(d.Certificates) != len(d.Signatures) {
+		return fmt.Errorf("descriptor: %d certificates for %d signatures", len(d.Certificates), len(d.Signatures))
+	}
+	if len(d.Intermediates) != 0 && len(d.Intermediates) != len(d.Signatures) {
+		return fmt.Errorf("descriptor: %d intermediate bundles for %d signatures", len(d.Intermediates), len(d.Signatures))
+	}
+	if len(d.Timestamps) != 0 && len(d.Timestamps) != len(d.Signatures) {
+		return fmt.Errorf("descriptor: %d timestamps for %d signatures", len(d.Timestamps), len(d.Signatures))
+	}
+
+	// Metadata
+	if d.Created < 0 || d.Expires < 0 {
+		return fmt.Errorf("descriptor: negative timestamp")
+	}
+	if d.Expires != 0 && d.Expires < d.Created {
+		return fmt.Errorf("descriptor: expires before creation")
+	}
+	if err := d.Constraints.Validate(); err != nil {
+		return fmt.Errorf("descriptor: invalid host constraints: %v", err)
+	}
 	return nil
 }
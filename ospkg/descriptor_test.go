@@ -27,3 +27,58 @@ func TestDescriptorFromBytes(t *testing.T) {
 	t.Log(d)
 	require.NoError(t, err)
 }
+
+func TestDescriptorValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		d     Descriptor
+		valid bool
+	}{
+		{"v2", Descriptor{Version: 2, Label: "l", Created: 1, Expires: 2}, true},
+		{"v1", Descriptor{Version: 1}, true},
+		{"v1 with metadata", Descriptor{Version: 1, Label: "l"}, false},
+		{"unknown version", Descriptor{Version: 3}, false},
+		{"expires before created", Descriptor{Version: 2, Created: 2, Expires: 1}, false},
+		{"v2 with constraints", Descriptor{Version: 2, Constraints: &HostConstraints{HostIDs: []string{"a-*"}}}, true},
+		{"v1 with constraints", Descriptor{Version: 1, Constraints: &HostConstraints{HostIDs: []string{"a"}}}, false},
+		{"invalid constraints", Descriptor{Version: 2, Constraints: &HostConstraints{HostIDs: []string{"a["}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.d.Validate()
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestSignedHash(t *testing.T) {
+	hash := [32]byte{1, 2, 3}
+
+	v1 := Descriptor{Version: 1, PkgURL: "https://a.com/a.zip"}
+	got, err := v1.SignedHash(hash)
+	require.NoError(t, err)
+	require.Equal(t, hash, got)
+
+	v2 := Descriptor{Version: 2, PkgURL: "https://a.com/a.zip", Label: "a", Created: 1}
+	want, err := v2.SignedHash(hash)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, want)
+
+	for _, modify := range []func(d *Descriptor){
+		func(d *Descriptor) { d.PkgURL = "https://b.com/a.zip" },
+		func(d *Descriptor) { d.Label = "b" },
+		func(d *Descriptor) { d.Created = 2 },
+		func(d *Descriptor) { d.Expires = 3 },
+		func(d *Descriptor) { d.Constraints = &HostConstraints{CPUVendors: []string{"GenuineIntel"}} },
+	} {
+		d := v2
+		modify(&d)
+		got, err := d.SignedHash(hash)
+		require.NoError(t, err)
+		require.NotEqual(t, want, got)
+	}
+}
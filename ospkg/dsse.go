@@ -0,0 +1,301 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/system-transparency/stboot/trust"
+)
+
+const (
+	// InTotoPayloadType is the DSSE payload type of in-toto statements.
+	InTotoPayloadType string = "application/vnd.in-toto+json"
+	// InTotoStatementType is the type of the in-toto statements used as
+	// DSSE payload.
+	InTotoStatementType string = "https://in-toto.io/Statement/v1"
+	// OSPackagePredicateType is the predicate type of statements, which
+	// carry no provenance.
+	OSPackagePredicateType string = "https://system-transparency.org/os-package/v1"
+	// SLSAProvenanceV1 and SLSAProvenanceV02 are the predicate types of
+	// SLSA provenance.
+	SLSAProvenanceV1  string = "https://slsa.dev/provenance/v1"
+	SLSAProvenanceV02 string = "https://slsa.dev/provenance/v0.2"
+)
+
+// dsseEnvelope is the DSSE encoding of a descriptor. Signatures are made
+// over the DSSE pre-authentication encoding of the payload as defined by
+// DSSE, so that standard DSSE verifiers can check them, see
+// dsseSignatureInput.
+// The log proof and timestamps are not covered by the signatures, like in
+// the plain JSON format.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     []byte          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+	LogProof    *trust.LogProof `json:"log_proof,omitempty"`
+}
+
+// dsseSignature extends the DSSE signature with the PEM encoded certificate
+// of the signer, its intermediates and an optional timestamp token.
+type dsseSignature struct {
+	KeyID         string `json:"keyid"`
+	Sig           []byte `json:"sig"`
+	Cert          string `json:"cert"`
+	Intermediates string `json:"intermediates,omitempty"`
+	Timestamp     []byte `json:"timestamp,omitempty"`
+}
+
+// inTotoStatement is the payload of a DSSE descriptor. Its only subject is
+// the OS package archive, whose annotations hold the signed descriptor
+// metadata.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name        string            `json:"name"`
+	Digest      map[string]string `json:"digest"`
+	Annotations signedData        `json:"annotations"`
+}
+
+// dsseData is the payload of a DSSE encoded descriptor.
+type dsseData struct {
+	payload   []byte
+	statement inTotoStatement
+}
+
+func isDSSE(data []byte) bool {
+	var probe struct {
+		PayloadType string `json:"payloadType"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.PayloadType != ""
+}
+
+func descriptorFromDSSE(data []byte) (*Descriptor, error) {
+	var env dsseEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("descriptor: parsing DSSE envelope failed: %v", err)
+	}
+	if env.PayloadType != InTotoPayloadType {
+		return nil, fmt.Errorf("descriptor: unsupported DSSE payload type %q", env.PayloadType)
+	}
+	var st inTotoStatement
+	if err := json.Unmarshal(env.Payload, &st); err != nil {
+		return nil, fmt.Errorf("descriptor: parsing in-toto statement failed: %v", err)
+	}
+	if st.Type != InTotoStatementType {
+		return nil, fmt.Errorf("descriptor: unsupported in-toto statement type %q", st.Type)
+	}
+	if len(st.Subject) != 1 {
+		return nil, fmt.Errorf("descriptor: in-toto statement must have exactly one subject")
+	}
+	sd := st.Subject[0].Annotations
+	if st.Subject[0].Digest["sha256"] != sd.ArchiveSHA256 {
+		return nil, fmt.Errorf("descriptor: subject digest does not match annotations")
+	}
+	if sd.Version != DescriptorVersion {
+		return nil, fmt.Errorf("descriptor: DSSE format requires version %d", DescriptorVersion)
+	}
+
+	d := &Descriptor{
+		Version:         sd.Version,
+		PkgURL:          sd.PkgURL,
+		Label:           sd.Label,
+		Created:         sd.Created,
+		Expires:         sd.Expires,
+		SecurityVersion: sd.SecurityVersion,
+		AllowDowngrade:  sd.AllowDowngrade,
+		Constraints:     sd.Constraints,
+		LogProof:        env.LogProof,
+		dsse:            &dsseData{payload: env.Payload, statement: st},
+	}
+	var haveIntermediates, haveTimestamps bool
+	for _, s := range env.Signatures {
+		d.Certificates = append(d.Certificates, []byte(s.Cert))
+		d.Signatures = append(d.Signatures, s.Sig)
+		d.Intermediates = append(d.Intermediates, []byte(s.Intermediates))
+		d.Timestamps = append(d.Timestamps, s.Timestamp)
+		haveIntermediates = haveIntermediates || s.Intermediates != ""
+		haveTimestamps = haveTimestamps || len(s.Timestamp) > 0
+	}
+	if !haveIntermediates {
+		d.Intermediates = nil
+	}
+	if !haveTimestamps {
+		d.Timestamps = nil
+	}
+	return d, nil
+}
+
+// dsseBytes serializes d as DSSE envelope.
+func (d *Descriptor) dsseBytes() ([]byte, error) {
+	env := dsseEnvelope{
+		PayloadType: InTotoPayloadType,
+		Payload:     d.dsse.payload,
+		Signatures:  []dsseSignature{},
+		LogProof:    d.LogProof,
+	}
+	for i, sig := range d.Signatures {
+		s := dsseSignature{
+			Sig:  sig,
+			Cert: string(d.Certificates[i]),
+		}
+		if block, _ := pem.Decode(d.Certificates[i]); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				fp := sha256.Sum256(cert.Raw)
+				s.KeyID = hex.EncodeToString(fp[:])
+			}
+		}
+		if len(d.Intermediates) > i {
+			s.Intermediates = string(d.Intermediates[i])
+		}
+		if len(d.Timestamps) > i {
+			s.Timestamp = d.Timestamps[i]
+		}
+		env.Signatures = append(env.Signatures, s)
+	}
+	buf, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("descriptor: serializing failed: %v", err)
+	}
+	return buf, nil
+}
+
+// dsseSignedBytes returns the DSSE pre-authentication encoding of the
+// payload of d, after making sure that the payload matches the metadata of
+// d and the archive hash.
+func (d *Descriptor) dsseSignedBytes(sd signedData) ([]byte, error) {
+	want, err := json.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor: serializing signed data failed: %v", err)
+	}
+	got, err := json.Marshal(d.dsse.statement.Subject[0].Annotations)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor: serializing DSSE annotations failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		return nil, fmt.Errorf("descriptor: metadata does not match DSSE payload")
+	}
+	pae := fmt.Sprintf("DSSEv1 %d %s %d ", len(InTotoPayloadType), InTotoPayloadType, len(d.dsse.payload))
+	return append([]byte(pae), d.dsse.payload...), nil
+}
+
+// dsseSignatureInput returns the input to trust.Signer for signing the
+// pre-authentication encoding pae with key. ED25519 signs pae itself, the
+// other algorithms sign its hash: SHA-384 for ECDSA on P-384, SHA-256
+// otherwise.
+func dsseSignatureInput(pae []byte, key crypto.PublicKey) []byte {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return pae
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			h := sha512.Sum384(pae)
+			return h[:]
+		}
+	}
+	h := sha256.Sum256(pae)
+	return h[:]
+}
+
+// setDSSE makes d use the DSSE encoding with a payload covering the current
+// metadata, archiveHash and the given predicate. An empty predicate type
+// results in a statement without provenance.
+func (d *Descriptor) setDSSE(name string, archiveHash [32]byte, predicateType string, predicate json.RawMessage) error {
+	if predicateType == "" {
+		predicateType = OSPackagePredicateType
+		predicate = json.RawMessage("{}")
+	}
+	sd := d.signedData(archiveHash)
+	st := inTotoStatement{
+		Type: InTotoStatementType,
+		Subject: []inTotoSubject{{
+			Name:        name,
+			Digest:      map[string]string{"sha256": sd.ArchiveSHA256},
+			Annotations: sd,
+		}},
+		PredicateType: predicateType,
+		Predicate:     predicate,
+	}
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("descriptor: serializing in-toto statement failed: %v", err)
+	}
+	d.dsse = &dsseData{payload: payload, statement: st}
+	return nil
+}
+
+// IsDSSE reports whether d is encoded as DSSE envelope.
+func (d *Descriptor) IsDSSE() bool {
+	return d.dsse != nil
+}
+
+// BuilderID returns the builder ID of the SLSA provenance in the payload of
+// a DSSE descriptor.
+func (d *Descriptor) BuilderID() (string, error) {
+	if d.dsse == nil {
+		return "", fmt.Errorf("descriptor: no provenance")
+	}
+	st := d.dsse.statement
+	var id string
+	switch st.PredicateType {
+	case SLSAProvenanceV1:
+		var p struct {
+			RunDetails struct {
+				Builder struct {
+					ID string `json:"id"`
+				} `json:"builder"`
+			} `json:"runDetails"`
+		}
+		if err := json.Unmarshal(st.Predicate, &p); err != nil {
+			return "", fmt.Errorf("descriptor: parsing provenance failed: %v", err)
+		}
+		id = p.RunDetails.Builder.ID
+	case SLSAProvenanceV02:
+		var p struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		}
+		if err := json.Unmarshal(st.Predicate, &p); err != nil {
+			return "", fmt.Errorf("descriptor: parsing provenance failed: %v", err)
+		}
+		id = p.Builder.ID
+	default:
+		return "", fmt.Errorf("descriptor: no SLSA provenance, predicate type is %q", st.PredicateType)
+	}
+	if id == "" {
+		return "", fmt.Errorf("descriptor: provenance has no builder ID")
+	}
+	return id, nil
+}
+
+// provenanceFromStatement extracts the predicate from an in-toto statement.
+func provenanceFromStatement(data []byte) (string, json.RawMessage, error) {
+	var st inTotoStatement
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&st); err != nil {
+		return "", nil, fmt.Errorf("parsing in-toto statement failed: %v", err)
+	}
+	if st.PredicateType == "" || len(st.Predicate) == 0 {
+		return "", nil, fmt.Errorf("in-toto statement has no predicate")
+	}
+	return st.PredicateType, st.Predicate, nil
+}
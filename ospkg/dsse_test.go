@@ -0,0 +1,179 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDSSE(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, signer := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.SetSecurityVersion(3, false))
+	require.NoError(t, osp.SetHostConstraints(&HostConstraints{Products: []string{"A"}}))
+	require.NoError(t, osp.UseDSSE(nil))
+	require.NoError(t, osp.Sign(key, cert))
+
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	var env dsseEnvelope
+	require.NoError(t, json.Unmarshal(descriptor, &env))
+	require.Equal(t, InTotoPayloadType, env.PayloadType)
+	require.Len(t, env.Signatures, 1)
+	var st inTotoStatement
+	require.NoError(t, json.Unmarshal(env.Payload, &st))
+	require.Equal(t, InTotoStatementType, st.Type)
+	require.Equal(t, OSPackagePredicateType, st.PredicateType)
+	archiveHash := sha256.Sum256(archive)
+	require.Equal(t, hex.EncodeToString(archiveHash[:]), st.Subject[0].Digest["sha256"])
+
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	require.True(t, osp.IsDSSE())
+	version, _ := osp.SecurityVersion()
+	require.Equal(t, uint64(3), version)
+
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+
+	// signatures cover the pre-authentication encoding of the payload
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(InTotoPayloadType), InTotoPayloadType, len(env.Payload), env.Payload)
+	require.True(t, ed25519.Verify(signer.PublicKey.(ed25519.PublicKey), []byte(pae), env.Signatures[0].Sig))
+	signed, err := osp.LogMessage()
+	require.NoError(t, err)
+	require.Equal(t, sha256.Sum256([]byte(pae)), signed)
+
+	// metadata is compared by its serialization
+	osp.descriptor.Constraints = &HostConstraints{HostIDs: []string{}, Products: []string{"A"}}
+	_, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+
+	// metadata must match the payload
+	osp.descriptor.SecurityVersion = 4
+	_, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.Error(t, err)
+}
+
+func TestDSSEECDSA(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		curve elliptic.Curve
+		hash  func([]byte) []byte
+	}{
+		{elliptic.P256(), func(b []byte) []byte { h := sha256.Sum256(b); return h[:] }},
+		{elliptic.P384(), func(b []byte) []byte { h := sha512.Sum384(b); return h[:] }},
+	} {
+		priv, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		require.NoError(t, err)
+		key, cert, _ := newTestCertWithKey(t, priv, root, rootPriv)
+
+		osp := createTestOSPackage(t, testKernel, testInitramfs)
+		require.NoError(t, osp.UseDSSE(nil))
+		require.NoError(t, osp.Sign(key, cert))
+		res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+		require.NoError(t, err)
+		require.Equal(t, uint(1), res.Valid)
+
+		// as checked by a standard DSSE verifier
+		descriptor, err := osp.DescriptorBytes()
+		require.NoError(t, err)
+		var env dsseEnvelope
+		require.NoError(t, json.Unmarshal(descriptor, &env))
+		block, _ := pem.Decode([]byte(env.Signatures[0].Cert))
+		c, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(InTotoPayloadType), InTotoPayloadType, len(env.Payload), env.Payload)
+		require.True(t, ecdsa.VerifyASN1(c.PublicKey.(*ecdsa.PublicKey), tt.hash([]byte(pae)), env.Signatures[0].Sig), tt.curve.Params().Name)
+	}
+}
+
+func TestDSSEProvenance(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+	roots := []*x509.Certificate{root}
+
+	provenance := fmt.Sprintf(`{
+		"_type": "%s",
+		"subject": [{"name": "os.img", "digest": {"sha256": "00"}}],
+		"predicateType": "%s",
+		"predicate": {"runDetails": {"builder": {"id": "https://ci.example.org/builder"}}}
+	}`, InTotoStatementType, SLSAProvenanceV1)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.UseDSSE([]byte(provenance)))
+	require.NoError(t, osp.Sign(key, cert))
+
+	id, err := osp.descriptor.BuilderID()
+	require.NoError(t, err)
+	require.Equal(t, "https://ci.example.org/builder", id)
+
+	res, err := osp.Verify(roots, VerifyOptions{BuilderID: "https://ci.example.org/builder"})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+	_, err = osp.Verify(roots, VerifyOptions{BuilderID: "https://ci.example.org/other"})
+	require.Error(t, err)
+
+	// signed metadata cannot be changed
+	require.Error(t, osp.UseDSSE(nil))
+
+	// plain JSON descriptors carry no provenance
+	osp = createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+	_, err = osp.Verify(roots, VerifyOptions{BuilderID: "https://ci.example.org/builder"})
+	require.Error(t, err)
+}
+
+func TestBuilderID(t *testing.T) {
+	tests := []struct {
+		name          string
+		predicateType string
+		predicate     string
+		want          string
+	}{
+		{"SLSA v1", SLSAProvenanceV1, `{"runDetails": {"builder": {"id": "b1"}}}`, "b1"},
+		{"SLSA v0.2", SLSAProvenanceV02, `{"builder": {"id": "b2"}}`, "b2"},
+		{"no builder", SLSAProvenanceV1, `{}`, ""},
+		{"no provenance", OSPackagePredicateType, `{}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Descriptor{Version: DescriptorVersion}
+			require.NoError(t, d.setDSSE("ospkg.zip", [32]byte{}, tt.predicateType, json.RawMessage(tt.predicate)))
+			id, err := d.BuilderID()
+			if tt.want == "" {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.want, id)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"archive/zip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/system-transparency/stboot/trust"
+)
+
+// Info is a summary of an OS package for inspection. It is gathered
+// without verifying the OS package, so none of its content is trustworthy.
+type Info struct {
+	ArchiveSHA256 string          `json:"archive_sha256"`
+	ArchiveSize   int64           `json:"archive_size"`
+	Descriptor    DescriptorInfo  `json:"descriptor"`
+	Manifest      *OSManifest     `json:"manifest"`
+	Members       []MemberInfo    `json:"members"`
+	Signatures    []SignatureInfo `json:"signatures"`
+}
+
+// DescriptorInfo summarizes the descriptor of an OS package.
+type DescriptorInfo struct {
+	Version int `json:"version"`
+	// Format is either "json" or "dsse".
+	Format          string `json:"format"`
+	PkgURL          string `json:"os_pkg_url,omitempty"`
+	Label           string `json:"label,omitempty"`
+	Created         int64  `json:"created,omitempty"`
+	Expires         int64  `json:"expires,omitempty"`
+	SecurityVersion uint64 `json:"security_version,omitempty"`
+	AllowDowngrade  bool   `json:"allow_downgrade,omitempty"`
+	// Constraints restrict the hosts booting the OS package.
+	Constraints *HostConstraints `json:"constraints,omitempty"`
+	LogProof    bool             `json:"log_proof"`
+	// BuilderID is the builder of the provenance of DSSE descriptors.
+	BuilderID string `json:"builder_id,omitempty"`
+}
+
+// MemberInfo describes a file inside the archive of an OS package.
+type MemberInfo struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+	SHA256         string `json:"sha256"`
+}
+
+// SignatureInfo describes a signature of an OS package and its certificate.
+type SignatureInfo struct {
+	Subject       string    `json:"subject,omitempty"`
+	Issuer        string    `json:"issuer,omitempty"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	KeyType       string    `json:"key_type,omitempty"`
+	Fingerprint   string    `json:"fingerprint,omitempty"`
+	Intermediates int       `json:"intermediates"`
+	Timestamped   bool      `json:"timestamped"`
+	// Error is set if the certificate cannot be parsed.
+	Error string `json:"error,omitempty"`
+}
+
+// Info returns a summary of osp. Members of the archive are read in order to
+// hash them.
+func (osp *OSPackage) Info() (*Info, error) {
+	r, err := osp.ArchiveReader()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := calculateHash(r)
+	if err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
+	}
+	d := osp.descriptor
+	info := &Info{
+		ArchiveSHA256: hex.EncodeToString(hash[:]),
+		ArchiveSize:   osp.archiveSize,
+		Descriptor: DescriptorInfo{
+			Version:         d.Version,
+			Format:          "json",
+			PkgURL:          d.PkgURL,
+			Label:           d.Label,
+			Created:         d.Created,
+			Expires:         d.Expires,
+			SecurityVersion: d.SecurityVersion,
+			AllowDowngrade:  d.AllowDowngrade,
+			Constraints:     d.Constraints,
+			LogProof:        d.LogProof != nil,
+		},
+		Manifest: osp.manifest,
+	}
+	if d.IsDSSE() {
+		info.Descriptor.Format = "dsse"
+		info.Descriptor.BuilderID, _ = d.BuilderID()
+	}
+
+	archive, err := zip.NewReader(osp.archive, osp.archiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
+	}
+	for _, f := range archive.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("os package: %v", err)
+		}
+		sum, err := calculateHash(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("os package: hashing %s: %v", f.Name, err)
+		}
+		info.Members = append(info.Members, MemberInfo{
+			Name:           f.Name,
+			Size:           f.UncompressedSize64,
+			CompressedSize: f.CompressedSize64,
+			SHA256:         hex.EncodeToString(sum[:]),
+		})
+	}
+	if info.Manifest == nil {
+		mf, err := unzipFile(archive, ManifestName)
+		if err != nil {
+			return nil, fmt.Errorf("os package: %v", err)
+		}
+		data, err := readZipFile(mf)
+		if err != nil {
+			return nil, fmt.Errorf("os package: reading manifest failed: %v", err)
+		}
+		info.Manifest, err = OSManifestFromBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("os package: %v", err)
+		}
+	}
+
+	for i, certPEM := range d.Certificates {
+		info.Signatures = append(info.Signatures, signatureInfo(d, i, certPEM))
+	}
+	return info, nil
+}
+
+func signatureInfo(d *Descriptor, i int, certPEM []byte) SignatureInfo {
+	var si SignatureInfo
+	if len(d.Intermediates) > i {
+		rest := d.Intermediates[i]
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			si.Intermediates++
+		}
+	}
+	si.Timestamped = len(d.Timestamps) > i && len(d.Timestamps[i]) > 0
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		si.Error = "no PEM encoded certificate"
+		return si
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		si.Error = err.Error()
+		return si
+	}
+	si.Subject = cert.Subject.String()
+	si.Issuer = cert.Issuer.String()
+	si.NotBefore = cert.NotBefore
+	si.NotAfter = cert.NotAfter
+	si.KeyType = keyType(cert.PublicKey)
+	si.Fingerprint = trust.Fingerprint(cert)
+	return si
+}
+
+func keyType(pub interface{}) string {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return "ED25519"
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+func unixTime(t int64) string {
+	if t == 0 {
+		return "unset"
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// String returns a human readable, multi-line representation of i.
+func (i *Info) String() string {
+	var b strings.Builder
+	d := i.Descriptor
+	fmt.Fprintf(&b, "Archive:          SHA-256 %s, %d bytes\n", i.ArchiveSHA256, i.ArchiveSize)
+	fmt.Fprintf(&b, "Descriptor:       version %d, %s format\n", d.Version, d.Format)
+	fmt.Fprintf(&b, "  URL:            %s\n", d.PkgURL)
+	fmt.Fprintf(&b, "  Label:          %s\n", d.Label)
+	fmt.Fprintf(&b, "  Created:        %s\n", unixTime(d.Created))
+	fmt.Fprintf(&b, "  Expires:        %s\n", unixTime(d.Expires))
+	fmt.Fprintf(&b, "  Security vers.: %d, downgrade allowed: %t\n", d.SecurityVersion, d.AllowDowngrade)
+	fmt.Fprintf(&b, "  Hosts:          %s\n", d.Constraints)
+	fmt.Fprintf(&b, "  Log proof:      %t\n", d.LogProof)
+	if d.BuilderID != "" {
+		fmt.Fprintf(&b, "  Builder:        %s\n", d.BuilderID)
+	}
+	if m := i.Manifest; m != nil {
+		fmt.Fprintf(&b, "Manifest:         version %d\n", m.Version)
+		fmt.Fprintf(&b, "  Label:          %s\n", m.Label)
+		if len(m.Entries) > 0 {
+			for _, e := range m.Entries {
+				fmt.Fprintf(&b, "  Entry %-9s %s, %s\n", e.Arch+":", e.KernelPath, e.InitramfsPath)
+				if e.DTBPath != "" {
+					fmt.Fprintf(&b, "    DTB:          %s\n", e.DTBPath)
+				}
+				fmt.Fprintf(&b, "    Cmdline:      %s\n", e.Cmdline)
+			}
+		} else if m.UKIPath != "" {
+			fmt.Fprintf(&b, "  UKI:            %s\n", m.UKIPath)
+		} else {
+			fmt.Fprintf(&b, "  Kernel:         %s\n", m.KernelPath)
+			fmt.Fprintf(&b, "  Initramfs:      %s\n", m.InitramfsPath)
+			fmt.Fprintf(&b, "  Cmdline:        %s\n", m.Cmdline)
+		}
+		if mb := m.multiboot(); mb != nil {
+			protocol := mb.Protocol
+			if protocol == "" {
+				protocol = MultibootV1
+			}
+			fmt.Fprintf(&b, "  Multiboot:      %s, %s, TXT required: %t\n", mb.KernelPath, protocol, mb.TXT)
+			fmt.Fprintf(&b, "    Cmdline:      %s\n", mb.Cmdline)
+			for n, mod := range mb.Modules {
+				fmt.Fprintf(&b, "    Module %d:     %s\n", n+1, strings.TrimSpace(mod.Path+" "+mod.Cmdline))
+			}
+		}
+	}
+	fmt.Fprintf(&b, "Members:\n")
+	for _, m := range i.Members {
+		fmt.Fprintf(&b, "  %s: %d bytes (%d compressed), SHA-256 %s\n", m.Name, m.Size, m.CompressedSize, m.SHA256)
+	}
+	fmt.Fprintf(&b, "Signatures:       %d\n", len(i.Signatures))
+	for n, s := range i.Signatures {
+		if s.Error != "" {
+			fmt.Fprintf(&b, "  %d: invalid certificate: %s\n", n+1, s.Error)
+			continue
+		}
+		fmt.Fprintf(&b, "  %d: %s\n", n+1, s.Subject)
+		fmt.Fprintf(&b, "     Issuer:      %s\n", s.Issuer)
+		fmt.Fprintf(&b, "     Validity:    %s - %s\n", s.NotBefore.UTC().Format(time.RFC3339), s.NotAfter.UTC().Format(time.RFC3339))
+		fmt.Fprintf(&b, "     Key:         %s\n", s.KeyType)
+		fmt.Fprintf(&b, "     Fingerprint: %s\n", s.Fingerprint)
+		fmt.Fprintf(&b, "     Chain:       %d intermediate(s), timestamped: %t\n", s.Intermediates, s.Timestamped)
+	}
+	return b.String()
+}
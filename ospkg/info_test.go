@@ -0,0 +1,56 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/trust"
+)
+
+func TestInfo(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, signCert := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.SetSecurityVersion(2, true))
+	require.NoError(t, osp.Sign(key, cert))
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	info, err := osp.Info()
+	require.NoError(t, err)
+
+	archiveHash := sha256.Sum256(archive)
+	require.Equal(t, hex.EncodeToString(archiveHash[:]), info.ArchiveSHA256)
+	require.Equal(t, "json", info.Descriptor.Format)
+	require.Equal(t, "test", info.Descriptor.Label)
+	require.Equal(t, uint64(2), info.Descriptor.SecurityVersion)
+	require.True(t, info.Descriptor.AllowDowngrade)
+	require.Equal(t, "console=ttyS0", info.Manifest.Cmdline)
+
+	require.Len(t, info.Members, 3)
+	kernelHash := sha256.Sum256(testKernel)
+	require.Equal(t, info.Manifest.KernelPath, info.Members[0].Name)
+	require.Equal(t, uint64(len(testKernel)), info.Members[0].Size)
+	require.Equal(t, hex.EncodeToString(kernelHash[:]), info.Members[0].SHA256)
+
+	require.Len(t, info.Signatures, 1)
+	require.Empty(t, info.Signatures[0].Error)
+	require.Equal(t, "ED25519", info.Signatures[0].KeyType)
+	require.Equal(t, trust.Fingerprint(signCert), info.Signatures[0].Fingerprint)
+	require.True(t, signCert.NotAfter.Equal(info.Signatures[0].NotAfter))
+	require.Contains(t, info.String(), info.Signatures[0].Fingerprint)
+}
@@ -5,12 +5,15 @@
 package ospkg
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -29,9 +32,83 @@ type OSManifest struct {
 	InitramfsPath string `json:"initramfs"`
 	Cmdline       string `json:"cmdline"`
 
+	// TbootPath, TbootArgs and ACMPaths describe a tboot setup in manifests
+	// of older OS packages. New OS packages describe tboot as Multiboot.
 	TbootPath string   `json:"tboot"`
 	TbootArgs string   `json:"tboot_args"`
 	ACMPaths  []string `json:"acms"`
+
+	// Multiboot describes a multiboot kernel, which is booted instead of
+	// the Linux kernel if present.
+	Multiboot *MultibootConfig `json:"multiboot,omitempty"`
+
+	// UKIPath names a Unified Kernel Image, which replaces kernel,
+	// initramfs and cmdline.
+	UKIPath string `json:"uki,omitempty"`
+
+	// Entries describe per-architecture Linux kernels, which replace
+	// kernel, initramfs and cmdline. The entry matching the host's
+	// architecture is booted.
+	Entries []BootEntry `json:"entries,omitempty"`
+
+	// Digests maps the path of each boot file to its hex encoded
+	// SHA-256 digest. Manifests of older OS packages may lack it.
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// Multiboot protocols
+const (
+	MultibootV1 = "multiboot"
+	MultibootV2 = "multiboot2"
+)
+
+// MultibootConfig describes a multiboot kernel, e.g. a hypervisor like Xen
+// or tboot, and the modules passed to it in order.
+type MultibootConfig struct {
+	KernelPath string            `json:"kernel"`
+	Cmdline    string            `json:"cmdline"`
+	Modules    []MultibootModule `json:"modules"`
+	// Protocol is MultibootV1 or MultibootV2. Defaults to MultibootV1.
+	Protocol string `json:"protocol,omitempty"`
+	// TXT marks kernels requiring Intel TXT, like tboot. They are only
+	// booted on hosts supporting TXT.
+	TXT bool `json:"txt,omitempty"`
+}
+
+// MultibootModule is a module passed to a multiboot kernel. Its path may
+// refer to the Linux kernel or initramfs of the manifest.
+type MultibootModule struct {
+	Path    string `json:"path"`
+	Cmdline string `json:"cmdline"`
+}
+
+// BootEntry describes the Linux kernel booted on one architecture.
+type BootEntry struct {
+	// Arch is the architecture as named by Go, e.g. amd64 or arm64.
+	Arch          string `json:"arch"`
+	KernelPath    string `json:"kernel"`
+	InitramfsPath string `json:"initramfs"`
+	// DTBPath names a device tree blob passed to the kernel.
+	DTBPath string `json:"dtb,omitempty"`
+	Cmdline string `json:"cmdline"`
+}
+
+// tbootMultiboot returns the multiboot setup of tboot, which passes the
+// Linux kernel, the initramfs and the ACMs as modules.
+func tbootMultiboot(kernelPath, initramfsPath, cmdline, tbootPath, tbootArgs string, acmPaths []string) *MultibootConfig {
+	mb := &MultibootConfig{
+		KernelPath: tbootPath,
+		Cmdline:    tbootArgs,
+		Modules: []MultibootModule{
+			{Path: kernelPath, Cmdline: "os-kernel " + cmdline},
+			{Path: initramfsPath, Cmdline: "os-initramfs"},
+		},
+		TXT: true,
+	}
+	for n, acm := range acmPaths {
+		mb.Modules = append(mb.Modules, MultibootModule{Path: acm, Cmdline: fmt.Sprintf("ACM%d", n+1)})
+	}
+	return mb
 }
 
 func NewOSManifest(label, kernelPath, initramfsPath, cmdline, tbootPath, tbootArgs string, acmPaths []string) *OSManifest {
@@ -93,17 +170,115 @@ func (m *OSManifest) Validate() error {
 	if m.Version != ManifestVersion {
 		return fmt.Errorf("manifest: invalid version %d. Want %d", m.Version, ManifestVersion)
 	}
-	// Kernel path is mandatory
-	if m.KernelPath == "" {
-		return errors.New("manifest: missing kernel path")
-	}
-	// Initramfs path is mandatory
-	if m.InitramfsPath == "" {
-		return errors.New("manifest: missing initramfs path")
+	if len(m.Entries) > 0 {
+		// entries contain kernel, initramfs and cmdline
+		if m.KernelPath != "" || m.InitramfsPath != "" || m.Cmdline != "" || m.UKIPath != "" || m.TbootPath != "" || m.Multiboot != nil {
+			return errors.New("manifest: entries cannot be combined with kernel, initramfs, cmdline, uki or multiboot")
+		}
+		arches := make(map[string]bool)
+		for n, e := range m.Entries {
+			if e.Arch == "" {
+				return fmt.Errorf("manifest: missing architecture of entry %d", n+1)
+			}
+			if arches[e.Arch] {
+				return fmt.Errorf("manifest: multiple entries for architecture %s", e.Arch)
+			}
+			arches[e.Arch] = true
+			if e.KernelPath == "" {
+				return fmt.Errorf("manifest: missing kernel path of entry %s", e.Arch)
+			}
+			if e.InitramfsPath == "" {
+				return fmt.Errorf("manifest: missing initramfs path of entry %s", e.Arch)
+			}
+		}
+	} else if m.UKIPath != "" {
+		// UKI contains kernel, initramfs and cmdline
+		if m.KernelPath != "" || m.InitramfsPath != "" || m.Cmdline != "" || m.TbootPath != "" || m.Multiboot != nil {
+			return errors.New("manifest: uki cannot be combined with kernel, initramfs, cmdline or multiboot")
+		}
+	} else {
+		// Kernel path is mandatory
+		if m.KernelPath == "" {
+			return errors.New("manifest: missing kernel path")
+		}
+		// Initramfs path is mandatory
+		if m.InitramfsPath == "" {
+			return errors.New("manifest: missing initramfs path")
+		}
 	}
 	// tboot
 	if m.TbootPath != "" && len(m.ACMPaths) == 0 {
 		return errors.New("manifest: tboot provided but missing ACM")
 	}
+	if m.TbootPath != "" && m.Multiboot != nil {
+		return errors.New("manifest: tboot cannot be combined with multiboot")
+	}
+	// multiboot
+	if mb := m.Multiboot; mb != nil {
+		if mb.KernelPath == "" {
+			return errors.New("manifest: missing multiboot kernel path")
+		}
+		if mb.Protocol != "" && mb.Protocol != MultibootV1 && mb.Protocol != MultibootV2 {
+			return fmt.Errorf("manifest: unknown multiboot protocol %q", mb.Protocol)
+		}
+		for n, mod := range mb.Modules {
+			if mod.Path == "" {
+				return fmt.Errorf("manifest: missing path of multiboot module %d", n+1)
+			}
+		}
+	}
+	// paths must denote files inside the archive
+	for _, p := range m.paths() {
+		if err := checkMemberName(p); err != nil || strings.HasSuffix(p, "/") {
+			return fmt.Errorf("manifest: invalid path %q", p)
+		}
+	}
+	// digests are optional, but must be complete if present
+	if m.Digests != nil {
+		for _, p := range m.paths() {
+			d, ok := m.Digests[p]
+			if !ok {
+				return fmt.Errorf("manifest: missing digest for %s", p)
+			}
+			if b, err := hex.DecodeString(d); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("manifest: invalid digest for %s", p)
+			}
+		}
+	}
 	return nil
 }
+
+// multiboot returns the multiboot setup of m, if any. A tboot setup of
+// older manifests is converted.
+func (m *OSManifest) multiboot() *MultibootConfig {
+	if m.Multiboot != nil {
+		return m.Multiboot
+	}
+	if m.TbootPath != "" {
+		return tbootMultiboot(m.KernelPath, m.InitramfsPath, m.Cmdline, m.TbootPath, m.TbootArgs, m.ACMPaths)
+	}
+	return nil
+}
+
+// paths returns the paths of all boot files referenced by m, each once.
+func (m *OSManifest) paths() []string {
+	candidates := []string{m.KernelPath, m.InitramfsPath, m.UKIPath}
+	for _, e := range m.Entries {
+		candidates = append(candidates, e.KernelPath, e.InitramfsPath, e.DTBPath)
+	}
+	if mb := m.multiboot(); mb != nil {
+		candidates = append(candidates, mb.KernelPath)
+		for _, mod := range mb.Modules {
+			candidates = append(candidates, mod.Path)
+		}
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, p := range candidates {
+		if p != "" && !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
@@ -7,15 +7,28 @@ package ospkg
 import (
 	"archive/zip"
 	"bytes"
+	"crypto"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/system-transparency/stboot/arm64"
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/multiboot2"
 	"github.com/system-transparency/stboot/stlog"
 	"github.com/system-transparency/stboot/trust"
 	"github.com/u-root/u-root/pkg/boot"
@@ -30,44 +43,223 @@ const (
 	OSPackageExt string = ".zip"
 
 	bootfilesDir string = "boot"
-	acmDir       string = "boot/acms"
 )
 
+// goarch is the architecture boot entries are selected for. Kernels of
+// packages without boot entries must be built for it.
+var goarch = runtime.GOARCH
+
+// bootEntryFiles are the boot files of a BootEntry.
+type bootEntryFiles struct {
+	kernel    sizeReaderAt
+	initramfs sizeReaderAt
+	dtb       sizeReaderAt
+}
+
 // OSPackage represents an OS package ZIP archive and and related data.
 type OSPackage struct {
-	raw        []byte
-	descriptor *Descriptor
-	hash       [32]byte
-	manifest   *OSManifest
-	kernel     []byte
-	initramfs  []byte
-	tboot      []byte
-	acms       [][]byte
-	signer     trust.Signer
+	archive     io.ReaderAt
+	archiveSize int64
+	descriptor  *Descriptor
+	hash        [32]byte
+	manifest    *OSManifest
+	kernel      sizeReaderAt
+	initramfs   sizeReaderAt
+	uki         sizeReaderAt
+	mbKernel    sizeReaderAt
+	mbModules   []sizeReaderAt
+	entries     []bootEntryFiles
+	limits      ArchiveLimits
+	// extractDir is the directory boot files are extracted to, instead of
+	// memory, and extracted holds the files opened there.
+	extractDir string
+	extracted  []*os.File
 	isVerified bool
+	// modTime is the modification time of the members of archives created
+	// from the content of osp.
+	modTime time.Time
 }
 
-// CreateOSPackage constructs a OSPackage from the passed files.
+// CreateOSPackage constructs a OSPackage from the passed files. If tboot is
+// set, the OS package contains a multiboot setup booting the kernel via tboot.
 func CreateOSPackage(label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs string, acms []string) (*OSPackage, error) {
+	var mb *MultibootConfig
+	if tboot != "" {
+		if len(acms) == 0 {
+			return nil, fmt.Errorf("os package: tboot requires at least one ACM")
+		}
+		mb = tbootMultiboot(kernel, initramfs, cmdline, tboot, tbootArgs, acms)
+	}
+	return CreateMultibootOSPackage(label, pkgURL, kernel, initramfs, cmdline, mb)
+}
+
+// CreateMultibootOSPackage constructs a OSPackage from the passed files and
+// the multiboot setup mb, if not nil. The paths of mb name the files of the
+// multiboot kernel and the modules. Modules may name the kernel or the
+// initramfs, which are stored once.
+func CreateMultibootOSPackage(label, pkgURL, kernel, initramfs, cmdline string, mb *MultibootConfig) (*OSPackage, error) {
+	var m = &OSManifest{
+		Version: ManifestVersion,
+		Label:   label,
+		Cmdline: cmdline,
+	}
+
+	osp, err := newOSPackage(m, pkgURL)
+	if err != nil {
+		return nil, err
+	}
+
+	files := newBootFileSet()
+	if kernel != "" {
+		if m.KernelPath, err = files.add(kernel); err != nil {
+			return nil, fmt.Errorf("os package: kernel path: %v", err)
+		}
+	}
+	if initramfs != "" {
+		if m.InitramfsPath, err = files.add(initramfs); err != nil {
+			return nil, fmt.Errorf("os package: initramfs path: %v", err)
+		}
+	}
+	if mb != nil {
+		m.Multiboot = &MultibootConfig{
+			Cmdline:  mb.Cmdline,
+			Protocol: mb.Protocol,
+			TXT:      mb.TXT,
+		}
+		if mb.KernelPath != "" {
+			if m.Multiboot.KernelPath, err = files.add(mb.KernelPath); err != nil {
+				return nil, fmt.Errorf("os package: multiboot kernel path: %v", err)
+			}
+		}
+		for _, mod := range mb.Modules {
+			p, err := files.add(mod.Path)
+			if err != nil {
+				return nil, fmt.Errorf("os package: multiboot module path: %v", err)
+			}
+			m.Multiboot.Modules = append(m.Multiboot.Modules, MultibootModule{Path: p, Cmdline: mod.Cmdline})
+		}
+	}
+	osp.setBootFiles(files.files)
+
+	if err := osp.finishCreate(); err != nil {
+		return nil, err
+	}
+	return osp, nil
+}
+
+// bootFileSet collects the files of a new OS package by their path in the
+// archive.
+type bootFileSet struct {
+	files map[string]sizeReaderAt
+	// names maps source files to their path in the archive
+	names map[string]string
+}
+
+func newBootFileSet() *bootFileSet {
+	return &bootFileSet{
+		files: make(map[string]sizeReaderAt),
+		names: make(map[string]string),
+	}
+}
+
+// add reads the file named by src, unless added before, and returns its
+// path in the archive.
+func (s *bootFileSet) add(src string) (string, error) {
+	src = filepath.Clean(src)
+	if name, ok := s.names[src]; ok {
+		return name, nil
+	}
+	name := filepath.Join(bootfilesDir, filepath.Base(src))
+	if _, ok := s.files[name]; ok {
+		return "", fmt.Errorf("%s: another file is named %s already", src, name)
+	}
+	f, err := readFile(src)
+	if err != nil {
+		return "", err
+	}
+	s.files[name] = f
+	s.names[src] = name
+	return name, nil
+}
+
+// CreateOSPackageFromUKI constructs a OSPackage from a Unified Kernel Image,
+// which contains kernel, initramfs and cmdline as PE sections.
+func CreateOSPackageFromUKI(label, pkgURL, uki string) (*OSPackage, error) {
 	var m = &OSManifest{
-		Version:   ManifestVersion,
-		Label:     label,
-		Cmdline:   cmdline,
-		TbootArgs: tbootArgs,
+		Version: ManifestVersion,
+		Label:   label,
+	}
+
+	osp, err := newOSPackage(m, pkgURL)
+	if err != nil {
+		return nil, err
 	}
 
+	osp.uki, err = readFile(uki)
+	if err != nil {
+		return nil, fmt.Errorf("os package: uki path: %v", err)
+	}
+	osp.manifest.UKIPath = filepath.Join(bootfilesDir, filepath.Base(uki))
+
+	if err := osp.finishCreate(); err != nil {
+		return nil, err
+	}
+	return osp, nil
+}
+
+// CreateOSPackageFromDir constructs a OSPackage from a directory containing
+// a manifest and the boot files at the paths given by the manifest, as
+// written by OSPackage.Unpack. Digests of the boot files are recomputed, so
+// files may be modified or replaced.
+func CreateOSPackageFromDir(dir, pkgURL string) (*OSPackage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
+	}
+	m, err := OSManifestFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
+	}
+	// paths are checked before files are read from them
+	m.Digests = nil
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
+	}
+
+	osp, err := newOSPackage(m, pkgURL)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]sizeReaderAt)
+	for _, p := range m.paths() {
+		if files[p], err = readFile(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			return nil, fmt.Errorf("os package: %v", err)
+		}
+	}
+	osp.setBootFiles(files)
+
+	if err := osp.finishCreate(); err != nil {
+		return nil, err
+	}
+	return osp, nil
+}
+
+// newOSPackage returns an OSPackage with manifest m and a new descriptor
+// for pkgURL. Boot files need to be added.
+func newOSPackage(m *OSManifest, pkgURL string) (*OSPackage, error) {
 	var d = &Descriptor{
 		Version: DescriptorVersion,
+		Label:   m.Label,
+		Created: time.Now().Unix(),
 	}
 
 	var osp = &OSPackage{
 		descriptor: d,
 		manifest:   m,
-		signer:     trust.ED25519Signer{},
 		isVerified: false,
+		modTime:    time.Unix(d.Created, 0),
 	}
 
-	var err error
 	if pkgURL != "" {
 		u, err := url.Parse(pkgURL)
 		if err != nil {
@@ -78,63 +270,72 @@ func CreateOSPackage(label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs
 		}
 		osp.descriptor.PkgURL = pkgURL
 	}
+	return osp, nil
+}
 
-	if kernel != "" {
-		osp.kernel, err = ioutil.ReadFile(kernel)
-		if err != nil {
-			return nil, fmt.Errorf("os package: kernel path: %v", err)
-		}
-		osp.manifest.KernelPath = filepath.Join(bootfilesDir, filepath.Base(kernel))
-	}
-
-	if initramfs != "" {
-		osp.initramfs, err = ioutil.ReadFile(initramfs)
-		if err != nil {
-			return nil, fmt.Errorf("os package: initramfs path: %v", err)
-		}
-		osp.manifest.InitramfsPath = filepath.Join(bootfilesDir, filepath.Base(initramfs))
-	}
-
-	if tboot != "" {
-		osp.tboot, err = ioutil.ReadFile(tboot)
-		if err != nil {
-			return nil, fmt.Errorf("os package: tboot path: %v", err)
+// finishCreate records the digests of the boot files of a newly created
+// osp in its manifest and validates osp. A UKI must be a well-formed PE file.
+func (osp *OSPackage) finishCreate() error {
+	if osp.uki != nil {
+		if _, err := parseUKI(osp.uki); err != nil {
+			return fmt.Errorf("os package: %v", err)
 		}
-		osp.manifest.TbootPath = filepath.Join(bootfilesDir, filepath.Base(tboot))
 	}
-
-	for _, acm := range acms {
-		a, err := ioutil.ReadFile(acm)
+	osp.manifest.Digests = make(map[string]string)
+	for name, f := range osp.bootFiles() {
+		hash, err := calculateHash(io.NewSectionReader(f, 0, f.Size()))
 		if err != nil {
-			return nil, fmt.Errorf("os package: acm path: %v", err)
+			return fmt.Errorf("os package: hashing %s: %v", name, err)
 		}
-		osp.acms = append(osp.acms, a)
-		name := filepath.Join(acmDir, filepath.Base(acm))
-		osp.manifest.ACMPaths = append(osp.manifest.ACMPaths, name)
+		osp.manifest.Digests[name] = hex.EncodeToString(hash[:])
 	}
-
 	if err := osp.validate(); err != nil {
-		return nil, err
+		return fmt.Errorf("os package: %v", err)
 	}
-
-	return osp, nil
+	return nil
 }
 
 // NewOSPackage constructs a new OSPackage initialized with raw bytes
 // and valid internal state.
 func NewOSPackage(archiveZIP, descriptorJSON []byte) (*OSPackage, error) {
+	return NewOSPackageFromReaderAt(bytes.NewReader(archiveZIP), int64(len(archiveZIP)), descriptorJSON)
+}
 
-	// check archive
-	_, err := zip.NewReader(bytes.NewReader(archiveZIP), int64(len(archiveZIP)))
+// NewOSPackageFromReaderAt constructs a new OSPackage backed by archiveZIP
+// of the given size, e.g. an *os.File. The archive is never read into memory
+// as a whole. Boot files are read into memory once when they are first
+// needed, so archiveZIP must stay accessible and unchanged until then. The
+// caller is responsible for archiveZIP not being modified by others, e.g. by
+// passing a private copy.
+func NewOSPackageFromReaderAt(archiveZIP io.ReaderAt, size int64, descriptorJSON []byte) (*OSPackage, error) {
+	return NewOSPackageWithLimits(archiveZIP, size, descriptorJSON, DefaultArchiveLimits)
+}
+
+// NewOSPackageWithLimits is like NewOSPackageFromReaderAt, but rejects
+// archives exceeding limits instead of DefaultArchiveLimits.
+// Archives with duplicate entries, non-canonical paths or members not
+// referenced by the manifest are rejected as well.
+func NewOSPackageWithLimits(archiveZIP io.ReaderAt, size int64, descriptorJSON []byte, limits ArchiveLimits) (*OSPackage, error) {
+	hash, err := calculateHash(io.NewSectionReader(archiveZIP, 0, size))
 	if err != nil {
-		return nil, fmt.Errorf("os package: %v", err)
+		return nil, fmt.Errorf("os package: calculate hash failed: %v", err)
+	}
+	return NewOSPackageWithHash(archiveZIP, size, hash, descriptorJSON, limits)
+}
+
+// NewOSPackageWithHash is like NewOSPackageWithLimits, but takes the SHA-256
+// hash of archiveZIP from the caller instead of reading the archive once
+// more, e.g. if it has been hashed while downloading.
+func NewOSPackageWithHash(archiveZIP io.ReaderAt, size int64, hash [32]byte, descriptorJSON []byte, limits ArchiveLimits) (*OSPackage, error) {
+
+	// check archive
+	if err := checkArchive(archiveZIP, size, limits); err != nil {
+		return nil, fmt.Errorf("os package: invalid archive: %v", err)
 	}
 	// check descriptor
 	descriptor, err := DescriptorFromBytes(descriptorJSON)
 	if err != nil {
-		if err != nil {
-			return nil, fmt.Errorf("os package: %v", err)
-		}
+		return nil, fmt.Errorf("os package: %v", err)
 	}
 
 	if err = descriptor.Validate(); err != nil {
@@ -142,15 +343,12 @@ func NewOSPackage(archiveZIP, descriptorJSON []byte) (*OSPackage, error) {
 	}
 
 	osp := OSPackage{
-		raw:        archiveZIP,
-		descriptor: descriptor,
-		signer:     trust.ED25519Signer{},
-		isVerified: false,
-	}
-
-	osp.hash, err = calculateHash(osp.raw)
-	if err != nil {
-		return nil, fmt.Errorf("os package: calculate hash failed: %v", err)
+		archive:     archiveZIP,
+		archiveSize: size,
+		descriptor:  descriptor,
+		hash:        hash,
+		limits:      limits,
+		isVerified:  false,
 	}
 
 	return &osp, nil
@@ -169,29 +367,167 @@ func (osp *OSPackage) validate() error {
 	} else if err := osp.descriptor.Validate(); err != nil {
 		return err
 	}
+	// UKI replaces kernel and initramfs
+	if osp.manifest.UKIPath != "" {
+		if osp.uki == nil || osp.uki.Size() == 0 {
+			return fmt.Errorf("missing uki")
+		}
+		u, err := parseUKI(osp.uki)
+		if err != nil {
+			return err
+		}
+		if got, err := kernelArch(u.kernel); err != nil {
+			return fmt.Errorf("invalid kernel of uki: %v", err)
+		} else if got != goarch {
+			return fmt.Errorf("kernel of uki is built for %s, need %s", got, goarch)
+		}
+		if u.initramfs != nil {
+			if err := checkInitramfs(u.initramfs); err != nil {
+				return fmt.Errorf("invalid initramfs of uki: %v", err)
+			}
+		}
+		return nil
+	}
+	// entries replace kernel and initramfs
+	if len(osp.manifest.Entries) > 0 {
+		if len(osp.entries) != len(osp.manifest.Entries) {
+			return fmt.Errorf("missing boot entries")
+		}
+		for i, e := range osp.entries {
+			arch := osp.manifest.Entries[i].Arch
+			if e.kernel == nil || e.kernel.Size() == 0 {
+				return fmt.Errorf("missing kernel of entry %s", arch)
+			}
+			if got, err := kernelArch(e.kernel); err != nil {
+				return fmt.Errorf("invalid kernel of entry %s: %v", arch, err)
+			} else if got != arch {
+				return fmt.Errorf("kernel of entry %s is built for %s", arch, got)
+			}
+			if e.initramfs == nil || e.initramfs.Size() == 0 {
+				return fmt.Errorf("missing initramfs of entry %s", arch)
+			}
+			if err := checkInitramfs(e.initramfs); err != nil {
+				return fmt.Errorf("invalid initramfs of entry %s: %v", arch, err)
+			}
+			if osp.manifest.Entries[i].DTBPath != "" && (e.dtb == nil || e.dtb.Size() == 0) {
+				return fmt.Errorf("missing dtb of entry %s", arch)
+			}
+		}
+		return nil
+	}
 	// kernel is mandatory
-	if len(osp.kernel) == 0 {
+	if osp.kernel == nil || osp.kernel.Size() == 0 {
 		return fmt.Errorf("missing kernel")
 	}
+	if got, err := kernelArch(osp.kernel); err != nil {
+		return fmt.Errorf("invalid kernel: %v", err)
+	} else if got != goarch {
+		return fmt.Errorf("kernel is built for %s, need %s", got, goarch)
+	}
 	// initrmafs is mandatory
-	if len(osp.initramfs) == 0 {
+	if osp.initramfs == nil || osp.initramfs.Size() == 0 {
 		return fmt.Errorf("missing initramfs")
 	}
-	// tboot
-	if len(osp.tboot) != 0 && len(osp.acms) == 0 {
-		return fmt.Errorf("tboot requires at least one ACM")
+	if err := checkInitramfs(osp.initramfs); err != nil {
+		return fmt.Errorf("invalid initramfs: %v", err)
+	}
+	// multiboot
+	if mb := osp.manifest.multiboot(); mb != nil {
+		if osp.mbKernel == nil || osp.mbKernel.Size() == 0 {
+			return fmt.Errorf("missing multiboot kernel")
+		}
+		if len(osp.mbModules) != len(mb.Modules) {
+			return fmt.Errorf("missing multiboot modules")
+		}
+		for n, mod := range osp.mbModules {
+			if mod == nil {
+				return fmt.Errorf("missing multiboot module %d", n+1)
+			}
+		}
 	}
 	return nil
 }
 
+// setBootFiles assigns the boot files referenced by the manifest of osp
+// from files, which maps paths to content.
+func (osp *OSPackage) setBootFiles(files map[string]sizeReaderAt) {
+	m := osp.manifest
+	osp.kernel = files[m.KernelPath]
+	osp.initramfs = files[m.InitramfsPath]
+	osp.uki = files[m.UKIPath]
+	osp.mbKernel = nil
+	osp.mbModules = nil
+	osp.entries = nil
+	for _, e := range m.Entries {
+		osp.entries = append(osp.entries, bootEntryFiles{
+			kernel:    files[e.KernelPath],
+			initramfs: files[e.InitramfsPath],
+			dtb:       files[e.DTBPath],
+		})
+	}
+	if mb := m.multiboot(); mb != nil {
+		osp.mbKernel = files[mb.KernelPath]
+		for _, mod := range mb.Modules {
+			osp.mbModules = append(osp.mbModules, files[mod.Path])
+		}
+	}
+}
+
+// bootFiles maps the paths of all boot files in osp to their content.
+func (osp *OSPackage) bootFiles() map[string]sizeReaderAt {
+	files := make(map[string]sizeReaderAt)
+	if osp.kernel != nil {
+		files[osp.manifest.KernelPath] = osp.kernel
+	}
+	if osp.initramfs != nil {
+		files[osp.manifest.InitramfsPath] = osp.initramfs
+	}
+	if osp.uki != nil {
+		files[osp.manifest.UKIPath] = osp.uki
+	}
+	for i, e := range osp.entries {
+		entry := osp.manifest.Entries[i]
+		if e.kernel != nil {
+			files[entry.KernelPath] = e.kernel
+		}
+		if e.initramfs != nil {
+			files[entry.InitramfsPath] = e.initramfs
+		}
+		if e.dtb != nil {
+			files[entry.DTBPath] = e.dtb
+		}
+	}
+	if mb := osp.manifest.multiboot(); mb != nil {
+		if osp.mbKernel != nil {
+			files[mb.KernelPath] = osp.mbKernel
+		}
+		for i, mod := range osp.mbModules {
+			if mod != nil {
+				files[mb.Modules[i].Path] = mod
+			}
+		}
+	}
+	return files
+}
+
 // ArchiveBytes return the zip compressed archive part of osp.
 func (osp *OSPackage) ArchiveBytes() ([]byte, error) {
-	if len(osp.raw) == 0 {
+	r, err := osp.ArchiveReader()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// ArchiveReader returns a reader for the zip compressed archive part of osp
+// without copying it into memory.
+func (osp *OSPackage) ArchiveReader() (io.Reader, error) {
+	if osp.archive == nil {
 		if err := osp.zip(); err != nil {
 			return nil, fmt.Errorf("os package: %v", err)
 		}
 	}
-	return osp.raw, nil
+	return io.NewSectionReader(osp.archive, 0, osp.archiveSize), nil
 }
 
 // DescriptorBytes return the zip compressed archive part of osp.
@@ -203,46 +539,105 @@ func (osp *OSPackage) DescriptorBytes() ([]byte, error) {
 	return b, nil
 }
 
-// zip packs the content stored in osp and (over)writes osp.Raw
-func (osp *OSPackage) zip() error {
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
+// Unpack writes the manifest and the boot files of osp to dir, at the paths
+// given by the manifest. dir is created if needed. The descriptor is not
+// written. Boot files are checked against the digests of the manifest, but
+// osp is not verified.
+func (osp *OSPackage) Unpack(dir string) error {
+	if osp.archive != nil {
+		if err := osp.unzip(); err != nil {
+			return fmt.Errorf("os package: %v", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os package: %v", err)
+	}
+	if err := osp.manifest.Write(dir); err != nil {
+		return fmt.Errorf("os package: %v", err)
+	}
+	for name, f := range osp.bootFiles() {
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("os package: %v", err)
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return fmt.Errorf("os package: %v", err)
+		}
+		_, err = io.Copy(out, io.NewSectionReader(f, 0, f.Size()))
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("os package: writing %s failed: %v", name, err)
+		}
+	}
+	return nil
+}
 
-	// directories
-	if err := zipDir(zipWriter, bootfilesDir); err != nil {
-		return fmt.Errorf("zip dir failed: %v", err)
+// Rebuild reproducibly rebuilds the archive of osp with modification time t,
+// see MakeReproducible. The manifest of osp is reused, while the boot files
+// are taken from dir at the paths given by the manifest. This way OS
+// packages of any kind can be rebuilt from independently built boot files.
+// If dir is empty, the boot files of osp are used.
+func (osp *OSPackage) Rebuild(dir string, t time.Time) ([]byte, error) {
+	tmp, err := ioutil.TempDir("", "ospkg-rebuild")
+	if err != nil {
+		return nil, fmt.Errorf("os package: %v", err)
 	}
-	if len(osp.acms) > 0 {
-		if err := zipDir(zipWriter, acmDir); err != nil {
-			return fmt.Errorf("zip dir failed: %v", err)
+	defer os.RemoveAll(tmp)
+	if err := osp.Unpack(tmp); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		for _, p := range osp.manifest.paths() {
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+			if err != nil {
+				return nil, fmt.Errorf("os package: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(tmp, filepath.FromSlash(p)), data, 0644); err != nil {
+				return nil, fmt.Errorf("os package: %v", err)
+			}
 		}
 	}
-	// kernel
-	name := osp.manifest.KernelPath
-	if err := zipFile(zipWriter, name, osp.kernel); err != nil {
-		return fmt.Errorf("zip kernel failed: %v", err)
+	rebuilt, err := CreateOSPackageFromDir(tmp, "")
+	if err != nil {
+		return nil, err
 	}
-	// initramfs
-	if len(osp.initramfs) > 0 {
-		name = osp.manifest.InitramfsPath
-		if err := zipFile(zipWriter, name, osp.initramfs); err != nil {
-			return fmt.Errorf("zip initramfs failed: %v", err)
+	if err := rebuilt.MakeReproducible(t); err != nil {
+		return nil, err
+	}
+	return rebuilt.ArchiveBytes()
+}
+
+// zip packs the content stored in osp and (over)writes osp.archive
+func (osp *OSPackage) zip() error {
+	buf := new(bytes.Buffer)
+	zipWriter := newZipWriter(buf)
+
+	// directories
+	paths := osp.manifest.paths()
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			dirs[d] = true
 		}
 	}
-	// tboot
-	if len(osp.tboot) > 0 {
-		name = osp.manifest.TbootPath
-		if err := zipFile(zipWriter, name, osp.tboot); err != nil {
-			return fmt.Errorf("zip tboot failed: %v", err)
+	var sorted []string
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	for _, d := range sorted {
+		if err := zipDir(zipWriter, d, osp.modTime); err != nil {
+			return fmt.Errorf("zip dir failed: %v", err)
 		}
 	}
-	// ACMs
-	if len(osp.acms) > 0 {
-		for i, acm := range osp.acms {
-			name = osp.manifest.ACMPaths[i]
-			if err := zipFile(zipWriter, name, acm); err != nil {
-				return fmt.Errorf("zip ACMs failed: %v", err)
-			}
+	// boot files
+	files := osp.bootFiles()
+	for _, p := range paths {
+		if err := zipFile(zipWriter, p, files[p], osp.modTime); err != nil {
+			return fmt.Errorf("zip %s failed: %v", p, err)
 		}
 	}
 	// manifest
@@ -250,68 +645,135 @@ func (osp *OSPackage) zip() error {
 	if err != nil {
 		return fmt.Errorf("serializing manifest failed: %v", err)
 	}
-	if err := zipFile(zipWriter, ManifestName, mbytes); err != nil {
+	if err := zipFile(zipWriter, ManifestName, bytes.NewReader(mbytes), osp.modTime); err != nil {
 		return fmt.Errorf("zip manifest failed: %v", err)
 	}
 	if err := zipWriter.Close(); err != nil {
 		return fmt.Errorf("zip writer: %v", err)
 	}
 
-	osp.raw = buf.Bytes()
+	osp.archive = bytes.NewReader(buf.Bytes())
+	osp.archiveSize = int64(buf.Len())
 	return nil
 }
 
+// ExtractTo makes osp extract its boot files to unnamed files in dir instead
+// of memory when they are first read. It has no effect on OS packages
+// created from files. The files are released by Close.
+func (osp *OSPackage) ExtractTo(dir string) {
+	osp.extractDir = dir
+}
+
+// Close releases the files boot files have been extracted to. Boot images
+// returned by OSImage cannot be loaded afterwards.
+func (osp *OSPackage) Close() error {
+	var err error
+	for _, f := range osp.extracted {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	osp.extracted = nil
+	return err
+}
+
+// unzip reads the boot files from the archive into memory, or into files
+// if set by ExtractTo. Each file is read once and checked against its digest
+// in the same pass, so the checked bytes are the ones measured and booted.
 func (osp *OSPackage) unzip() error {
-	reader := bytes.NewReader(osp.raw)
-	size := int64(len(osp.raw))
-	archive, err := zip.NewReader(reader, size)
+	if osp.manifest != nil {
+		// already unzipped or created from files
+		return nil
+	}
+	archive, err := zip.NewReader(osp.archive, osp.archiveSize)
 	if err != nil {
 		return fmt.Errorf("zip reader failed: %v", err)
 	}
 	// manifest
-	m, err := unzipFile(archive, ManifestName)
+	mf, err := unzipFile(archive, ManifestName)
 	if err != nil {
 		return fmt.Errorf("unzip manifest failed: %v", err)
 	}
-	osp.manifest, err = OSManifestFromBytes(m)
+	m, err := readZipFile(mf)
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return fmt.Errorf("unzip manifest failed: %v", err)
 	}
-	// kernel
-	osp.kernel, err = unzipFile(archive, osp.manifest.KernelPath)
+	manifest, err := OSManifestFromBytes(m)
 	if err != nil {
-		return fmt.Errorf("unzip kernel failed: %v", err)
+		return fmt.Errorf("%v", err)
 	}
-	// initramfs
-	osp.initramfs, err = unzipFile(archive, osp.manifest.InitramfsPath)
-	if err != nil {
-		return fmt.Errorf("unzip initramfs failed: %v", err)
+	if manifest.Digests == nil {
+		stlog.Debug("os package: manifest contains no digests, skip checking boot files")
 	}
-	// tboot
-	if osp.manifest.TbootPath != "" {
-		osp.tboot, err = unzipFile(archive, osp.manifest.TbootPath)
+	// boot files
+	files := make(map[string]sizeReaderAt)
+	for _, p := range manifest.paths() {
+		f, err := unzipFile(archive, p)
 		if err != nil {
-			return fmt.Errorf("unzip tboot failed: %v", err)
+			return fmt.Errorf("unzip %s failed: %v", p, err)
 		}
-	}
-	// ACMs
-	if len(osp.manifest.ACMPaths) > 0 {
-		for _, acm := range osp.manifest.ACMPaths {
-			a, err := unzipFile(archive, acm)
-			if err != nil {
-				return fmt.Errorf("unzip ACMs failed: %v", err)
+		var tmp *os.File
+		if osp.extractDir != "" {
+			if tmp, err = ioutil.TempFile(osp.extractDir, "bootfile-*"); err != nil {
+				return fmt.Errorf("unzip %s failed: %v", p, err)
 			}
-			osp.acms = append(osp.acms, a)
+			// the file is released once closed
+			os.Remove(tmp.Name())
+			osp.extracted = append(osp.extracted, tmp)
+		}
+		files[p], err = readMember(f, manifest.Digests[p], tmp)
+		if err != nil {
+			return fmt.Errorf("unzip %s failed: %v", p, err)
 		}
 	}
+	osp.manifest = manifest
+	osp.setBootFiles(files)
 	return nil
 }
 
-// Sign signes osp.HashValue using osp.Signer.
+// readMember reads f into memory, or into the empty file dst if not nil, and
+// compares the SHA-256 digest of the content to the hex encoded want, if not
+// empty.
+func readMember(f *zip.File, want string, dst *os.File) (sizeReaderAt, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	var buf *bytes.Buffer
+	var w io.Writer = dst
+	if dst == nil {
+		buf = newMemberBuffer(f)
+		w = buf
+	}
+	n, err := copyMember(io.MultiWriter(w, h), rc, f)
+	if err != nil {
+		return nil, err
+	}
+	if want != "" {
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			return nil, fmt.Errorf("digest mismatch: got %s, want %s", got, want)
+		}
+	}
+	if dst != nil {
+		return io.NewSectionReader(dst, 0, n), nil
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
+
+// Sign signes osp.HashValue using the trust.Signer matching the key type
+// of the certificate.
 // Both, the signature and the certificate are stored into the OSPackage.
-func (osp *OSPackage) Sign(keyBlock, certBlock *pem.Block) error {
+// Intermediate certificates needed to chain the certificate to the
+// signing root can be passed as chain and are stored along.
+func (osp *OSPackage) Sign(keyBlock, certBlock *pem.Block, chain ...*pem.Block) error {
 
-	hash, err := calculateHash(osp.raw)
+	r, err := osp.ArchiveReader()
+	if err != nil {
+		return err
+	}
+	hash, err := calculateHash(r)
 	if err != nil {
 		return err
 	}
@@ -339,51 +801,448 @@ func (osp *OSPackage) Sign(keyBlock, certBlock *pem.Block) error {
 		}
 	}
 
-	// sign with private key
+	// make sure key and certificate belong together
+	if s, ok := priv.(crypto.Signer); ok {
+		pub, ok := s.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if ok && !pub.Equal(cert.PublicKey) {
+			return errors.New("os package sign: private key does not match certificate")
+		}
+	}
 
-	sig, err := osp.signer.Sign(priv, osp.hash[:])
+	// sign with private key
+	signer, err := trust.SignerFor(cert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("os package sign: %v", err)
+	}
+	signed, err := osp.descriptor.SignatureInput(osp.hash, cert.PublicKey)
+	if err != nil {
+		return fmt.Errorf("os package sign: %v", err)
+	}
+	sig, err := signer.Sign(priv, signed)
 	if err != nil {
 		return fmt.Errorf("signing failed: %v", err)
 	}
 
+	var chainPEM []byte
+	for _, c := range chain {
+		if _, err := x509.ParseCertificate(c.Bytes); err != nil {
+			return fmt.Errorf("os package sign: parse intermediate certificate: %v", err)
+		}
+		chainPEM = append(chainPEM, pem.EncodeToMemory(c)...)
+	}
+	if len(chainPEM) > 0 || len(osp.descriptor.Intermediates) > 0 {
+		// keep intermediates aligned with signatures
+		for len(osp.descriptor.Intermediates) < len(osp.descriptor.Signatures) {
+			osp.descriptor.Intermediates = append(osp.descriptor.Intermediates, nil)
+		}
+		osp.descriptor.Intermediates = append(osp.descriptor.Intermediates, chainPEM)
+	}
+
 	certPEM := pem.EncodeToMemory(certBlock)
 	osp.descriptor.Certificates = append(osp.descriptor.Certificates, certPEM)
 	osp.descriptor.Signatures = append(osp.descriptor.Signatures, sig)
+	if len(osp.descriptor.Timestamps) > 0 {
+		// keep timestamps aligned with signatures
+		osp.descriptor.Timestamps = append(osp.descriptor.Timestamps, nil)
+	}
+	return nil
+}
+
+// TimestampSignature obtains a RFC 3161 timestamp token over the most recent
+// signature of osp from tsa and stores it in the descriptor.
+func (osp *OSPackage) TimestampSignature(tsa trust.TSA) error {
+	n := len(osp.descriptor.Signatures)
+	if n == 0 {
+		return errors.New("os package: no signature to timestamp")
+	}
+	token, err := tsa.Timestamp(sha256.Sum256(osp.descriptor.Signatures[n-1]))
+	if err != nil {
+		return fmt.Errorf("os package: %v", err)
+	}
+	for len(osp.descriptor.Timestamps) < n {
+		osp.descriptor.Timestamps = append(osp.descriptor.Timestamps, nil)
+	}
+	osp.descriptor.Timestamps[n-1] = token
+	return nil
+}
+
+// MakeReproducible makes the archive and the descriptor of a newly created
+// osp depend on its content and t only. t is used as modification time of
+// all archive members and as creation time in the descriptor, see
+// SourceDateEpoch. Archives are written with stable member order, fixed
+// compression settings and normalized file modes in any case.
+func (osp *OSPackage) MakeReproducible(t time.Time) error {
+	if osp.archive != nil {
+		return errors.New("os package: archive already exists")
+	}
+	if len(osp.descriptor.Signatures) > 0 || osp.descriptor.IsDSSE() {
+		return errors.New("os package: cannot change signed metadata")
+	}
+	if t.Before(ReproducibleEpoch) {
+		t = ReproducibleEpoch
+	}
+	osp.modTime = t
+	osp.descriptor.Created = t.Unix()
+	return nil
+}
+
+// UpgradeDescriptor converts a legacy descriptor of osp to the current
+// descriptor version. The label is taken from the manifest and the creation
+// time is set to now. Existing signatures do not cover the new metadata,
+// so they are dropped and osp needs to be signed again.
+// The number of dropped signatures is returned.
+func (osp *OSPackage) UpgradeDescriptor() (int, error) {
+	if osp.descriptor.Version == DescriptorVersion {
+		return 0, fmt.Errorf("os package: descriptor is already at version %d", DescriptorVersion)
+	}
+	if osp.manifest == nil {
+		if err := osp.unzip(); err != nil {
+			return 0, fmt.Errorf("os package: %v", err)
+		}
+	}
+
+	dropped := len(osp.descriptor.Signatures)
+	osp.descriptor = &Descriptor{
+		Version: DescriptorVersion,
+		PkgURL:  osp.descriptor.PkgURL,
+		Label:   osp.manifest.Label,
+		Created: time.Now().Unix(),
+	}
+	osp.isVerified = false
+	return dropped, nil
+}
+
+// MaxSecurityVersion is the highest security version. stboot raises the
+// high-water mark in the TPM one step at a time, and by at most this many
+// steps per boot.
+const MaxSecurityVersion = 4096
+
+// SetSecurityVersion sets the security version used for rollback protection
+// and whether osp may be booted even if a higher version has been booted
+// before. It needs to be called before signing.
+func (osp *OSPackage) SetSecurityVersion(version uint64, allowDowngrade bool) error {
+	if osp.descriptor.Version == DescriptorVersionLegacy {
+		return fmt.Errorf("os package: descriptor version %d does not support security versions", osp.descriptor.Version)
+	}
+	if version > MaxSecurityVersion {
+		return fmt.Errorf("os package: security version %d exceeds %d", version, MaxSecurityVersion)
+	}
+	if len(osp.descriptor.Signatures) > 0 || osp.descriptor.LogProof != nil {
+		return errors.New("os package: cannot change signed metadata")
+	}
+	osp.descriptor.SecurityVersion = version
+	osp.descriptor.AllowDowngrade = allowDowngrade
+	return nil
+}
+
+// SecurityVersion returns the security version of osp and whether a
+// downgrade is allowed. The values are only trustworthy after osp has
+// been verified.
+func (osp *OSPackage) SecurityVersion() (version uint64, allowDowngrade bool) {
+	return osp.descriptor.SecurityVersion, osp.descriptor.AllowDowngrade
+}
+
+// SetExpiry sets the time after which osp is not booted anymore. It needs
+// to be called before signing. A zero t removes the expiry.
+func (osp *OSPackage) SetExpiry(t time.Time) error {
+	if osp.descriptor.Version == DescriptorVersionLegacy {
+		return fmt.Errorf("os package: descriptor version %d does not support expiry", osp.descriptor.Version)
+	}
+	if len(osp.descriptor.Signatures) > 0 || osp.descriptor.LogProof != nil {
+		return errors.New("os package: cannot change signed metadata")
+	}
+	var expires int64
+	if !t.IsZero() {
+		expires = t.Unix()
+		if expires < osp.descriptor.Created {
+			return errors.New("os package: expiry before creation")
+		}
+	}
+	osp.descriptor.Expires = expires
+	return nil
+}
+
+// Expiry returns the time after which osp is not booted anymore, or the
+// zero time. It is only trustworthy after osp has been verified.
+func (osp *OSPackage) Expiry() time.Time {
+	if osp.descriptor.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(osp.descriptor.Expires, 0)
+}
+
+// CheckExpiry returns an error if osp expired more than grace before now.
+// osp must be verified before. now should come from ExpiryTime: a clock
+// that can be set back, like the RTC, only makes the check best-effort.
+func (osp *OSPackage) CheckExpiry(now time.Time, grace time.Duration) error {
+	if !osp.isVerified {
+		return errors.New("os package: content not verified")
+	}
+	expiry := osp.Expiry()
+	if expiry.IsZero() {
+		return nil
+	}
+	if now.After(expiry.Add(grace)) {
+		return fmt.Errorf("os package: expired at %s", expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ExpiryTime returns the latest of rtc and the trusted times, e.g. the
+// system time fix or the times proven by timestamp tokens. Zero trusted
+// times are ignored. Since trusted times only bound the current time from
+// below, setting the RTC back can still delay expiry down to the latest of
+// them.
+func ExpiryTime(rtc time.Time, trusted ...time.Time) time.Time {
+	latest := rtc
+	for _, t := range trusted {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// SetHostConstraints restricts the hosts booting osp. It needs to be called
+// before signing. A nil c removes the restrictions.
+func (osp *OSPackage) SetHostConstraints(c *HostConstraints) error {
+	if osp.descriptor.Version == DescriptorVersionLegacy {
+		return fmt.Errorf("os package: descriptor version %d does not support host constraints", osp.descriptor.Version)
+	}
+	if len(osp.descriptor.Signatures) > 0 || osp.descriptor.LogProof != nil {
+		return errors.New("os package: cannot change signed metadata")
+	}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("os package: invalid host constraints: %v", err)
+	}
+	if c.IsZero() {
+		c = nil
+	}
+	osp.descriptor.Constraints = c
+	return nil
+}
+
+// HostConstraints returns the host constraints of osp, or nil. They are
+// only trustworthy after osp has been verified.
+func (osp *OSPackage) HostConstraints() *HostConstraints {
+	return osp.descriptor.Constraints
+}
+
+// CheckHost returns an error if the host constraints of osp do not match
+// h. osp must be verified before.
+func (osp *OSPackage) CheckHost(h HostInfo) error {
+	if !osp.isVerified {
+		return errors.New("os package: content not verified")
+	}
+	if err := osp.descriptor.Constraints.Match(h); err != nil {
+		return fmt.Errorf("os package: not for this host: %v", err)
+	}
+	return nil
+}
+
+// UseDSSE switches the descriptor of osp to the DSSE encoding. Its payload
+// is an in-toto statement about the OS package archive carrying the
+// descriptor metadata. provenance may hold an in-toto statement, whose
+// predicate, e.g. SLSA provenance, is taken over. It needs to be called
+// before signing.
+func (osp *OSPackage) UseDSSE(provenance []byte) error {
+	if osp.descriptor.Version == DescriptorVersionLegacy {
+		return fmt.Errorf("os package: descriptor version %d does not support DSSE", osp.descriptor.Version)
+	}
+	if len(osp.descriptor.Signatures) > 0 || osp.descriptor.LogProof != nil {
+		return errors.New("os package: cannot change signed metadata")
+	}
+	var predicateType string
+	var predicate json.RawMessage
+	if len(provenance) > 0 {
+		var err error
+		predicateType, predicate, err = provenanceFromStatement(provenance)
+		if err != nil {
+			return fmt.Errorf("os package: provenance: %v", err)
+		}
+	}
+	r, err := osp.ArchiveReader()
+	if err != nil {
+		return err
+	}
+	osp.hash, err = calculateHash(r)
+	if err != nil {
+		return err
+	}
+	name := "os-package.zip"
+	if u, err := url.Parse(osp.descriptor.PkgURL); err == nil && path.Base(u.Path) != "." && path.Base(u.Path) != "/" {
+		name = path.Base(u.Path)
+	}
+	return osp.descriptor.setDSSE(name, osp.hash, predicateType, predicate)
+}
+
+// IsDSSE reports whether the descriptor of osp is encoded as DSSE envelope.
+func (osp *OSPackage) IsDSSE() bool {
+	return osp.descriptor.IsDSSE()
+}
+
+// LogMessage returns the message to be logged in a Sigsum log for osp. It
+// is the hash of the data covered by the signatures, see
+// Descriptor.SignedHash. The checksum of the Sigsum leaf is its hash.
+func (osp *OSPackage) LogMessage() ([32]byte, error) {
+	return osp.descriptor.SignedHash(osp.hash)
+}
+
+// AttachLogProof stores proof in the descriptor of osp, after making sure
+// that it proves inclusion of the message of osp. Signatures of the
+// submitter, the log and the witnesses are checked during verification only.
+func (osp *OSPackage) AttachLogProof(proof *trust.LogProof) error {
+	message, err := osp.LogMessage()
+	if err != nil {
+		return fmt.Errorf("os package: %v", err)
+	}
+	if err := proof.CheckInclusion(message); err != nil {
+		return fmt.Errorf("os package: log proof: %v", err)
+	}
+	osp.descriptor.LogProof = proof
 	return nil
 }
 
 // Verify first verifies the certificates stored together with the signatures
 // in the os package descriptor against the provided root certificates and then
-// verifies the signatures.
-// The number of found signatures and the number of valid signatures are returned.
+// verifies the signatures. Signatures of legacy descriptors cover the
+// archive hash only, those of version 2 descriptors cover the archive hash
+// together with the descriptor metadata.
+// The number of found and valid signatures are returned together with the
+// evaluation of the signature policy of vopts.
+// If vopts requires a log proof, verification fails unless the descriptor
+// carries a valid proof for the signed hash. If vopts requires a builder
+// ID, the descriptor must be a DSSE envelope with provenance of that builder.
 // A signature is valid if:
-// * Its certificate was signed by the root certificate
+// * Its certificate chains to one of the root certificates, possibly via the
+//   intermediate certificates stored along with the signature
+// * Neither its certificate nor an intermediate is revoked by the CRLs of vopts
+// * Its certificate satisfies the key usages required by vopts
+// * The chain is valid at the time defined by vopts, or at the time of a
+//   timestamp token over the signature if vopts contains TSA roots, unless
+//   vopts disables validity checks
 // * It passed verification
 // * Its certificate is not a duplicate of a previous one
-// The validity bounds of all in volved certificates are ignored.
-func (osp *OSPackage) Verify(rootCert *x509.Certificate) (found, valid uint, err error) {
-	found = 0
-	valid = 0
+func (osp *OSPackage) Verify(roots []*x509.Certificate, vopts VerifyOptions) (*VerifyResult, error) {
+	signed, err := osp.descriptor.SignedHash(osp.hash)
+	if err != nil {
+		return nil, fmt.Errorf("verify: %v", err)
+	}
+	verifyTime := vopts.verifyTime()
+	extKeyUsages := vopts.ExtKeyUsages
+	if len(extKeyUsages) == 0 {
+		extKeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	}
+	if vopts.Log != nil {
+		if osp.descriptor.LogProof == nil {
+			return nil, fmt.Errorf("verify: missing log proof")
+		}
+		if err := osp.descriptor.LogProof.Verify(signed, vopts.Log); err != nil {
+			return nil, fmt.Errorf("verify: log proof: %v", err)
+		}
+	}
+	if vopts.BuilderID != "" {
+		id, err := osp.descriptor.BuilderID()
+		if err != nil {
+			return nil, fmt.Errorf("verify: provenance: %v", err)
+		}
+		if id != vopts.BuilderID {
+			return nil, fmt.Errorf("verify: provenance: builder %q, want %q", id, vopts.BuilderID)
+		}
+	}
+	if vopts.RequireCRL {
+		for _, root := range roots {
+			if err := vopts.checkCRL(root); err != nil {
+				return nil, fmt.Errorf("verify: %v", err)
+			}
+		}
+	}
 
+	result := &VerifyResult{}
+	validByRoot := make([]uint, len(roots))
 	var certsUsed []*x509.Certificate
 	for i, sig := range osp.descriptor.Signatures {
-		found++
+		result.Found++
 		block, _ := pem.Decode(osp.descriptor.Certificates[i])
+		if block == nil {
+			return nil, fmt.Errorf("verify: certificate %d: decoding PEM failed", i+1)
+		}
 		cert, err := x509.ParseCertificate(block.Bytes)
 		if err != nil {
-			return 0, 0, fmt.Errorf("verify: certificate %d: parsing failed: %v", i+1, err)
+			return nil, fmt.Errorf("verify: certificate %d: parsing failed: %v", i+1, err)
 		}
 
-		// verify certificate: only make sure that cert was signed by roots.
-		// no further verification opions, not even validity dates.
-		roots := x509.NewCertPool()
-		roots.AddCert(rootCert)
-		opts := x509.VerifyOptions{
-			Roots: roots,
+		if err := vopts.checkKeyUsage(cert); err != nil {
+			result.skip(i, cert, err)
+			continue
 		}
-		_, err = cert.Verify(opts)
-		if err != nil {
-			stlog.Debug("skip signature %d: invalid certificate: %v", i+1, err)
+
+		// a valid timestamp token proves the time of signing and replaces
+		// the verification time for this signature.
+		certTime := verifyTime
+		var stamped bool
+		if len(vopts.TSARoots) > 0 {
+			if len(osp.descriptor.Timestamps) > i && osp.descriptor.Timestamps[i] != nil {
+				t, err := trust.VerifyTimestamp(osp.descriptor.Timestamps[i], sha256.Sum256(sig), vopts.TSARoots)
+				if err != nil {
+					stlog.Debug("signature %d: invalid timestamp: %v", i+1, err)
+				} else {
+					certTime, stamped = t, true
+				}
+			}
+			if !stamped && vopts.RequireTimestamp {
+				result.skip(i, cert, errors.New("no valid timestamp"))
+				continue
+			}
+		}
+
+		// verify certificate: make sure that cert chains to roots and
+		// that the chain is valid at the verification time.
+		intermediates := x509.NewCertPool()
+		var chain []*x509.Certificate
+		if len(osp.descriptor.Intermediates) > i {
+			for rest := osp.descriptor.Intermediates[i]; len(rest) > 0; {
+				var b *pem.Block
+				if b, rest = pem.Decode(rest); b == nil {
+					break
+				}
+				if c, err := x509.ParseCertificate(b.Bytes); err == nil {
+					intermediates.AddCert(c)
+					chain = append(chain, c)
+				}
+			}
+		}
+		var chainsTo []int
+		for j, root := range roots {
+			pool := x509.NewCertPool()
+			pool.AddCert(root)
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				CurrentTime:   certTime,
+				KeyUsages:     extKeyUsages,
+			}
+			if vopts.IgnoreValidity {
+				if opts.CurrentTime, err = validWithin(append(chain, cert, root)...); err != nil {
+					continue
+				}
+			}
+			var chains [][]*x509.Certificate
+			if chains, err = cert.Verify(opts); err != nil {
+				continue
+			}
+			for _, chain := range chains {
+				if err = vopts.checkRevocation(chain); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				continue
+			}
+			chainsTo = append(chainsTo, j)
+		}
+		if len(chainsTo) == 0 {
+			result.skip(i, cert, fmt.Errorf("invalid certificate: %v", err))
 			continue
 		}
 
@@ -396,28 +1255,65 @@ func (osp *OSPackage) Verify(rootCert *x509.Certificate) (found, valid uint, err
 			}
 		}
 		if dublicate {
-			stlog.Debug("skip signature %d: dublicate", i+1)
+			result.skip(i, cert, errors.New("duplicate certificate"))
 			continue
 		}
 		certsUsed = append(certsUsed, cert)
 
 		// verify signature
-		err = osp.signer.Verify(sig, osp.hash[:], cert.PublicKey)
+		signer, err := trust.SignerFor(cert.PublicKey)
+		if err != nil {
+			result.skip(i, cert, err)
+			continue
+		}
+		input, err := osp.descriptor.SignatureInput(osp.hash, cert.PublicKey)
+		if err != nil {
+			result.skip(i, cert, err)
+			continue
+		}
+		err = signer.Verify(sig, input, cert.PublicKey)
 		if err != nil {
-			stlog.Debug("skip signature %d: verification failed: %v", i+1, err)
+			result.skip(i, cert, fmt.Errorf("verification failed: %v", err))
 			continue
 		}
-		valid++
+		result.Valid++
+		sr := SignatureResult{Index: i, Cert: cert}
+		for _, j := range chainsTo {
+			validByRoot[j]++
+			sr.Roots = append(sr.Roots, roots[j])
+		}
+		if stamped {
+			sr.Timestamp = certTime
+		}
+		result.Signatures = append(result.Signatures, sr)
+	}
+
+	for _, clause := range vopts.Policy {
+		cr := ClauseResult{SignatureClause: clause}
+		if clause.Root == nil {
+			cr.Valid = result.Valid
+		} else {
+			for j, root := range roots {
+				if root.Equal(clause.Root) {
+					cr.Valid = validByRoot[j]
+				}
+			}
+		}
+		result.Clauses = append(result.Clauses, cr)
 	}
 	osp.isVerified = true
-	return found, valid, nil
+	return result, nil
 }
 
-// OSImage parses a boot.OSImage from osp. If tryTboot is set to false
-// a boot.LinuxImage is returned. If tryTboot is true and ospk contains a
-// tboot setup, a boot.MultibootImage is returned, else a boot.LinuxImage
-//
-func (osp *OSPackage) OSImage(tryTboot bool) (boot.OSImage, error) {
+// OSImage parses a boot.OSImage from osp. If osp contains a multiboot
+// setup, a boot.MultibootImage or a multiboot2.Image is returned depending
+// on the protocol, else a boot.LinuxImage.
+// Multiboot kernels requiring TXT, like tboot, are only returned if txt is
+// set, else the Linux kernel is booted directly.
+// If osp contains a UKI, the boot.LinuxImage is built from its sections.
+// If osp contains boot entries, the entry for the running architecture is
+// returned, as arm64.Image if it has a device tree.
+func (osp *OSPackage) OSImage(txt bool) (boot.OSImage, error) {
 	if !osp.isVerified {
 		return nil, fmt.Errorf("os package: content not verified")
 	}
@@ -428,49 +1324,184 @@ func (osp *OSPackage) OSImage(tryTboot bool) (boot.OSImage, error) {
 		return nil, fmt.Errorf("os package: %v", err)
 	}
 
-	if tryTboot && len(osp.tboot) >= 0 {
+	if mb := osp.manifest.multiboot(); mb != nil && (txt || !mb.TXT) {
 		// multiboot image
 		var modules []multiboot.Module
-		kernel := multiboot.Module{
-			Module:  bytes.NewReader(osp.kernel),
-			Cmdline: "os-kernel " + osp.manifest.Cmdline,
-		}
-		modules = append(modules, kernel)
-
-		initramfs := multiboot.Module{
-			Module:  bytes.NewReader(osp.initramfs),
-			Cmdline: "os-initramfs",
+		for i, mod := range osp.mbModules {
+			modules = append(modules, multiboot.Module{
+				Module:  mod,
+				Cmdline: mb.Modules[i].Cmdline,
+			})
 		}
-		modules = append(modules, initramfs)
 
-		for n, a := range osp.acms {
-			acm := multiboot.Module{
-				Module:  bytes.NewReader(a),
-				Cmdline: fmt.Sprintf("ACM%d", n+1),
-			}
-			modules = append(modules, acm)
+		if mb.Protocol == MultibootV2 {
+			limits := osp.limits.withDefaults()
+			return &multiboot2.Image{
+				Name:          osp.manifest.Label,
+				Kernel:        osp.mbKernel,
+				Cmdline:       mb.Cmdline,
+				Modules:       modules,
+				MaxModuleSize: limits.MaxMemberSize,
+				MaxTotalSize:  limits.MaxTotalSize,
+			}, nil
 		}
-
 		return &boot.MultibootImage{
 			Name:    osp.manifest.Label,
-			Kernel:  bytes.NewReader(osp.tboot),
-			Cmdline: osp.manifest.TbootArgs,
+			Kernel:  osp.mbKernel,
+			Cmdline: mb.Cmdline,
 			Modules: modules,
 		}, nil
 	}
 
+	if len(osp.manifest.Entries) > 0 {
+		return osp.entryImage()
+	}
+
+	if osp.uki != nil {
+		u, err := parseUKI(osp.uki)
+		if err != nil {
+			return nil, fmt.Errorf("os package: %v", err)
+		}
+		kernel, err := osp.decompressKernel(u.kernel)
+		if err != nil {
+			return nil, err
+		}
+		img := &boot.LinuxImage{
+			Name:    osp.manifest.Label,
+			Kernel:  kernel,
+			Cmdline: u.cmdline,
+		}
+		if u.initramfs != nil {
+			img.Initrd = u.initramfs
+		}
+		return img, nil
+	}
+
 	// linuxboot image
+	kernel, err := osp.decompressKernel(osp.kernel)
+	if err != nil {
+		return nil, err
+	}
 	return &boot.LinuxImage{
 		Name:    osp.manifest.Label,
-		Kernel:  bytes.NewReader(osp.kernel),
-		Initrd:  bytes.NewReader(osp.initramfs),
+		Kernel:  kernel,
+		Initrd:  osp.initramfs,
 		Cmdline: osp.manifest.Cmdline,
 	}, nil
 }
 
-func calculateHash(data []byte) ([32]byte, error) {
-	if len(data) == 0 {
-		return [32]byte{}, fmt.Errorf("empty input")
+// CheckCmdline checks all command lines osp may pass to a Linux kernel
+// against policy: the command line of the manifest, those of its boot
+// entries, those of all multiboot modules and the command line embedded in
+// a UKI. Any multiboot module may be a Linux kernel started by the multiboot
+// kernel, so the command lines of initramfs modules need to satisfy the
+// policy as well. Like OSImage, it needs osp to be verified.
+func (osp *OSPackage) CheckCmdline(policy config.CmdlinePolicy) error {
+	if policy.IsZero() {
+		return nil
+	}
+	if !osp.isVerified {
+		return fmt.Errorf("os package: content not verified")
+	}
+	if err := osp.unzip(); err != nil {
+		return fmt.Errorf("os package: %v", err)
+	}
+
+	m := osp.manifest
+	var cmdlines []string
+	if m.KernelPath != "" {
+		cmdlines = append(cmdlines, m.Cmdline)
+	}
+	for _, e := range m.Entries {
+		cmdlines = append(cmdlines, e.Cmdline)
+	}
+	if mb := m.multiboot(); mb != nil {
+		for _, mod := range mb.Modules {
+			cmdlines = append(cmdlines, mod.Cmdline)
+		}
+	}
+	if osp.uki != nil {
+		u, err := parseUKI(osp.uki)
+		if err != nil {
+			return fmt.Errorf("os package: %v", err)
+		}
+		cmdlines = append(cmdlines, u.cmdline)
+	}
+
+	checked := make(map[string]bool)
+	for _, cmdline := range cmdlines {
+		if checked[cmdline] {
+			continue
+		}
+		checked[cmdline] = true
+		if v := policy.Violations(cmdline); len(v) > 0 {
+			return fmt.Errorf("os package: kernel command line %q violates policy: %s", cmdline, strings.Join(v, ", "))
+		}
+	}
+	return nil
+}
+
+// entryImage returns the boot entry of osp for goarch.
+func (osp *OSPackage) entryImage() (boot.OSImage, error) {
+	var arches []string
+	for i, entry := range osp.manifest.Entries {
+		if entry.Arch != goarch {
+			arches = append(arches, entry.Arch)
+			continue
+		}
+		e := osp.entries[i]
+		kernel, err := osp.decompressKernel(e.kernel)
+		if err != nil {
+			return nil, err
+		}
+		if e.dtb != nil {
+			return &arm64.Image{
+				Name:    osp.manifest.Label,
+				Kernel:  kernel,
+				Initrd:  e.initramfs,
+				DTB:     e.dtb,
+				Cmdline: entry.Cmdline,
+			}, nil
+		}
+		return &boot.LinuxImage{
+			Name:    osp.manifest.Label,
+			Kernel:  kernel,
+			Initrd:  e.initramfs,
+			Cmdline: entry.Cmdline,
+		}, nil
+	}
+	return nil, fmt.Errorf("os package: no boot entry for architecture %s, have %s", goarch, strings.Join(arches, ", "))
+}
+
+// decompressKernel decompresses a gzip compressed arm64 kernel of osp
+// within the archive limits of osp.
+func (osp *OSPackage) decompressKernel(r sizeReaderAt) (sizeReaderAt, error) {
+	kernel, err := decompressKernel(r, osp.limits.withDefaults().MaxMemberSize)
+	if err != nil {
+		return nil, fmt.Errorf("os package: invalid kernel: %v", err)
+	}
+	return kernel, nil
+}
+
+func calculateHash(r io.Reader) ([32]byte, error) {
+	var sum [32]byte
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return sum, err
+	}
+	if n == 0 {
+		return sum, fmt.Errorf("empty input")
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// readFile loads the file named by path to be packed into an OS package.
+func readFile(path string) (sizeReaderAt, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	return sha256.Sum256(data), nil
+	return bytes.NewReader(b), nil
 }
@@ -0,0 +1,864 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/arm64"
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/multiboot2"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+func writeTestFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(p, content, 0666))
+	return p
+}
+
+// newTestCert returns a PEM encoded ED25519 key and a certificate for it.
+// If parent is nil, the certificate is self signed.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey interface{}) (*pem.Block, *pem.Block, *x509.Certificate) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return newTestCertWithKey(t, priv, parent, parentKey)
+}
+
+// newTestCertWithKey returns priv PEM encoded and a certificate for it.
+// If parent is nil, the certificate is self signed.
+func newTestCertWithKey(t *testing.T, priv crypto.Signer, parent *x509.Certificate, parentKey interface{}) (*pem.Block, *pem.Block, *x509.Certificate) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+	}
+	return newTestCertFromTemplate(t, priv, template, parent, parentKey)
+}
+
+// newTestCertFromTemplate returns priv PEM encoded and a certificate for it
+// created from template. If parent is nil, the certificate is self signed.
+func newTestCertFromTemplate(t *testing.T, priv crypto.Signer, template, parent *x509.Certificate, parentKey interface{}) (*pem.Block, *pem.Block, *x509.Certificate) {
+	t.Helper()
+	if parent == nil {
+		parent = template
+		parentKey = priv
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, priv.Public(), parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: key}, &pem.Block{Type: "CERTIFICATE", Bytes: der}, cert
+}
+
+func createTestOSPackage(t *testing.T, kernel, initramfs []byte) *OSPackage {
+	t.Helper()
+	dir := t.TempDir()
+	k := writeTestFile(t, dir, "kernel", kernel)
+	i := writeTestFile(t, dir, "initramfs", initramfs)
+	osp, err := CreateOSPackage("test", "", k, i, "console=ttyS0", "", "", nil)
+	require.NoError(t, err)
+	return osp
+}
+
+func TestOSPackageFromFile(t *testing.T) {
+	kernel := newTestBzImage(strings.Repeat("kernel", 100000))
+	initramfs := newTestInitramfs(strings.Repeat("initramfs", 100000))
+
+	osp := createTestOSPackage(t, kernel, initramfs)
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	dir := t.TempDir()
+	p := writeTestFile(t, dir, "ospkg.zip", archive)
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	osp, err = NewOSPackageFromReaderAt(f, int64(len(archive)), descriptor)
+	require.NoError(t, err)
+	require.NoError(t, osp.Sign(key, cert))
+
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Found)
+	require.Equal(t, uint(1), res.Valid)
+
+	img, err := osp.OSImage(false)
+	require.NoError(t, err)
+	li, ok := img.(*boot.LinuxImage)
+	require.True(t, ok)
+
+	got, err := uio.ReadAll(li.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, kernel, got)
+	got, err = uio.ReadAll(li.Initrd)
+	require.NoError(t, err)
+	require.Equal(t, initramfs, got)
+	require.Equal(t, "console=ttyS0", li.Cmdline)
+}
+
+func TestOSImageNotVerified(t *testing.T) {
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	_, err = osp.OSImage(false)
+	require.Error(t, err)
+}
+
+// verifiedTestOSPackage serializes osp, parses it again and verifies it
+// with a single valid signature.
+func verifiedTestOSPackage(t *testing.T, osp *OSPackage) *OSPackage {
+	t.Helper()
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+	require.NoError(t, osp.Sign(key, cert))
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+	return osp
+}
+
+func TestExtractTo(t *testing.T) {
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	osp.ExtractTo(dir)
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+	require.NoError(t, osp.Sign(key, cert))
+	_, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+
+	img, err := osp.OSImage(false)
+	require.NoError(t, err)
+	li := img.(*boot.LinuxImage)
+	got, err := uio.ReadAll(li.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, testKernel, got)
+	require.Len(t, osp.extracted, 2)
+	// the files are unnamed
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, fis)
+
+	require.NoError(t, osp.Close())
+	_, err = uio.ReadAll(li.Kernel)
+	require.Error(t, err)
+}
+
+func TestCreateOSPackageDigests(t *testing.T) {
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+
+	want := map[string]string{
+		"boot/kernel":    "d6903d92b66cf29e956db20640eba7a2134da6afb481d348a08c035287d26080",
+		"boot/initramfs": "a294b69c9ee0015c913acd1378f85c0eacfb8a2458bc59e193951cd60d5b2787",
+	}
+	require.Equal(t, want, osp.manifest.Digests)
+	require.NoError(t, osp.manifest.Validate())
+
+	delete(osp.manifest.Digests, "boot/initramfs")
+	require.Error(t, osp.manifest.Validate())
+}
+
+func TestOSImageDigestMismatch(t *testing.T) {
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	osp.manifest.Digests["boot/initramfs"] = osp.manifest.Digests["boot/kernel"]
+
+	osp = verifiedTestOSPackage(t, osp)
+	_, err := osp.OSImage(false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boot/initramfs")
+}
+
+func TestBootFilesReadOnce(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	// the archive is backed by a buffer modified after loading the boot
+	// files, like a file changed on disk
+	buf := append([]byte{}, archive...)
+	osp, err = NewOSPackageFromReaderAt(bytes.NewReader(buf), int64(len(buf)), descriptor)
+	require.NoError(t, err)
+	_, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	img, err := osp.OSImage(false)
+	require.NoError(t, err)
+	for i := range buf {
+		buf[i] = 0
+	}
+	kernel, err := ioutil.ReadAll(io.NewSectionReader(img.(*boot.LinuxImage).Kernel, 0, int64(len(testKernel))+1))
+	require.NoError(t, err)
+	require.Equal(t, testKernel, kernel)
+}
+
+func TestNewOSPackageWithHash(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		hash  [32]byte
+		valid uint
+	}{
+		{sha256.Sum256(archive), 1},
+		{sha256.Sum256(nil), 0},
+	} {
+		osp, err := NewOSPackageWithHash(bytes.NewReader(archive), int64(len(archive)), tt.hash, descriptor, DefaultArchiveLimits)
+		require.NoError(t, err)
+		res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+		require.NoError(t, err)
+		require.Equal(t, tt.valid, res.Valid)
+	}
+}
+
+func TestSignAndVerifyKeyTypes(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	for _, priv := range []crypto.Signer{p256, p384, rsaKey, ed} {
+		key, cert, _ := newTestCertWithKey(t, priv, root, rootPriv)
+		require.NoError(t, osp.Sign(key, cert))
+	}
+
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(4), res.Found)
+	require.Equal(t, uint(4), res.Valid)
+}
+
+func TestSignKeyMismatch(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, _, _ := newTestCert(t, root, rootPriv)
+	_, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.Error(t, osp.Sign(key, cert))
+}
+
+func TestVerifyDescriptorMetadata(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	osp.descriptor.PkgURL = "https://example.com/ospkg.zip"
+	require.NoError(t, osp.Sign(key, cert))
+
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+
+	osp.descriptor.PkgURL = "https://evil.com/ospkg.zip"
+	res, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(0), res.Valid)
+}
+
+func TestUpgradeDescriptor(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	osp.descriptor = &Descriptor{Version: DescriptorVersionLegacy}
+	require.NoError(t, osp.Sign(key, cert))
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+
+	dropped, err := osp.UpgradeDescriptor()
+	require.NoError(t, err)
+	require.Equal(t, 1, dropped)
+	require.Equal(t, DescriptorVersion, osp.descriptor.Version)
+	require.Equal(t, "test", osp.descriptor.Label)
+	require.Empty(t, osp.descriptor.Signatures)
+
+	require.NoError(t, osp.Sign(key, cert))
+	res, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+}
+
+func TestSecurityVersion(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.Error(t, osp.SetSecurityVersion(MaxSecurityVersion+1, false))
+	require.NoError(t, osp.SetSecurityVersion(3, false))
+	require.NoError(t, osp.Sign(key, cert))
+	require.Error(t, osp.SetSecurityVersion(4, true))
+
+	version, allowDowngrade := osp.SecurityVersion()
+	require.Equal(t, uint64(3), version)
+	require.False(t, allowDowngrade)
+
+	// the security version is covered by the signature
+	osp.descriptor.SecurityVersion = 4
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(0), res.Valid)
+}
+
+func TestVerifyCertificateChain(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	_, interPEM, inter := newTestCertFromTemplate(t, priv, template, root, rootPriv)
+	key, cert, _ := newTestCert(t, inter, priv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(0), res.Valid, "signature must not verify without intermediate")
+
+	osp = createTestOSPackage(t, testKernel, testInitramfs)
+	otherKey, otherCert, _ := newTestCert(t, root, rootPriv)
+	require.NoError(t, osp.Sign(otherKey, otherCert))
+	require.NoError(t, osp.Sign(key, cert, interPEM))
+	require.Len(t, osp.descriptor.Intermediates, 2)
+	require.NoError(t, osp.descriptor.Validate())
+
+	res, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(2), res.Found)
+	require.Equal(t, uint(2), res.Valid)
+}
+
+func TestMakeReproducible(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	build := func() ([]byte, []byte) {
+		osp := createTestOSPackage(t, testKernel, testInitramfs)
+		require.NoError(t, osp.MakeReproducible(modTime))
+		archive, err := osp.ArchiveBytes()
+		require.NoError(t, err)
+		descriptor, err := osp.DescriptorBytes()
+		require.NoError(t, err)
+		require.Error(t, osp.MakeReproducible(modTime))
+		return archive, descriptor
+	}
+	archive1, descriptor1 := build()
+	archive2, descriptor2 := build()
+	require.Equal(t, archive1, archive2)
+	require.Equal(t, descriptor1, descriptor2)
+
+	r, err := zip.NewReader(bytes.NewReader(archive1), int64(len(archive1)))
+	require.NoError(t, err)
+	for _, f := range r.File {
+		require.True(t, modTime.Equal(f.Modified), f.Name)
+	}
+}
+
+func TestUnpackRoundTrip(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.MakeReproducible(modTime))
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "unpacked")
+	require.NoError(t, osp.Unpack(dir))
+
+	rebuilt, err := CreateOSPackageFromDir(dir, "")
+	require.NoError(t, err)
+	require.NoError(t, rebuilt.MakeReproducible(modTime))
+	got, err := rebuilt.ArchiveBytes()
+	require.NoError(t, err)
+	require.Equal(t, archive, got)
+
+	// modified boot files get new digests
+	initramfs := filepath.Join(dir, filepath.FromSlash(osp.manifest.InitramfsPath))
+	require.NoError(t, ioutil.WriteFile(initramfs, newTestInitramfs("patched"), 0644))
+	rebuilt, err = CreateOSPackageFromDir(dir, "")
+	require.NoError(t, err)
+	require.NotEqual(t, osp.manifest.Digests[osp.manifest.InitramfsPath], rebuilt.manifest.Digests[osp.manifest.InitramfsPath])
+
+	// paths must not leave the directory
+	m := *osp.manifest
+	m.KernelPath = "../kernel"
+	require.NoError(t, m.Write(dir))
+	_, err = CreateOSPackageFromDir(dir, "")
+	require.Error(t, err)
+}
+
+func TestRebuildMultiboot(t *testing.T) {
+	modTime := time.Unix(1600000000, 0)
+	src := t.TempDir()
+	k := writeTestFile(t, src, "vmlinuz", testKernel)
+	i := writeTestFile(t, src, "initrd", testInitramfs)
+	xen := writeTestFile(t, src, "xen.gz", []byte("xen"))
+	mb := &MultibootConfig{
+		KernelPath: xen,
+		Cmdline:    "dom0_mem=1G",
+		Modules:    []MultibootModule{{Path: k, Cmdline: "console=hvc0"}, {Path: i}},
+	}
+	osp, err := CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	require.NoError(t, osp.MakeReproducible(modTime))
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+
+	rebuilt, err := osp.Rebuild("", modTime)
+	require.NoError(t, err)
+	require.Equal(t, archive, rebuilt)
+
+	// independently built boot files at the paths of the manifest
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "boot"), 0755))
+	writeTestFile(t, filepath.Join(dir, "boot"), "vmlinuz", testKernel)
+	writeTestFile(t, filepath.Join(dir, "boot"), "initrd", testInitramfs)
+	writeTestFile(t, filepath.Join(dir, "boot"), "xen.gz", []byte("xen"))
+	rebuilt, err = osp.Rebuild(dir, modTime)
+	require.NoError(t, err)
+	require.Equal(t, archive, rebuilt)
+
+	writeTestFile(t, filepath.Join(dir, "boot"), "xen.gz", []byte("patched xen"))
+	rebuilt, err = osp.Rebuild(dir, modTime)
+	require.NoError(t, err)
+	require.NotEqual(t, archive, rebuilt)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "boot", "initrd")))
+	_, err = osp.Rebuild(dir, modTime)
+	require.Error(t, err, "missing boot file")
+}
+
+func TestMultibootOSPackage(t *testing.T) {
+	dir := t.TempDir()
+	k := writeTestFile(t, dir, "vmlinuz", testKernel)
+	i := writeTestFile(t, dir, "initrd", testInitramfs)
+	xen := writeTestFile(t, dir, "xen.gz", []byte("xen"))
+	mb := &MultibootConfig{
+		KernelPath: xen,
+		Cmdline:    "dom0_mem=1G",
+		Modules: []MultibootModule{
+			{Path: k, Cmdline: "console=hvc0"},
+			{Path: i},
+		},
+	}
+	osp, err := CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	require.Equal(t, []string{"boot/vmlinuz", "boot/initrd", "boot/xen.gz"}, osp.manifest.paths())
+
+	img, err := verifiedTestOSPackage(t, osp).OSImage(false)
+	require.NoError(t, err)
+	mbi, ok := img.(*boot.MultibootImage)
+	require.True(t, ok)
+	require.Equal(t, "dom0_mem=1G", mbi.Cmdline)
+	got, err := uio.ReadAll(mbi.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, []byte("xen"), got)
+	require.Len(t, mbi.Modules, 2)
+	require.Equal(t, "console=hvc0", mbi.Modules[0].Cmdline)
+	got, err = uio.ReadAll(mbi.Modules[1].Module)
+	require.NoError(t, err)
+	require.Equal(t, testInitramfs, got)
+
+	mb.Protocol = MultibootV2
+	osp, err = CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	img, err = verifiedTestOSPackage(t, osp).OSImage(false)
+	require.NoError(t, err)
+	mb2, ok := img.(*multiboot2.Image)
+	require.True(t, ok)
+	require.Equal(t, "dom0_mem=1G", mb2.Cmdline)
+	require.Len(t, mb2.Modules, 2)
+	require.Equal(t, DefaultArchiveLimits.MaxMemberSize, mb2.MaxModuleSize)
+	require.Equal(t, DefaultArchiveLimits.MaxTotalSize, mb2.MaxTotalSize)
+
+	mb.Protocol = "multiboot3"
+	_, err = CreateMultibootOSPackage("xen", "", k, i, "", mb)
+	require.Error(t, err)
+	mb.Protocol = ""
+
+	// different files must not share a name in the archive
+	other := writeTestFile(t, t.TempDir(), "vmlinuz", []byte("other"))
+	mb.Modules = []MultibootModule{{Path: other}}
+	_, err = CreateMultibootOSPackage("xen", "", k, i, "", mb)
+	require.Error(t, err)
+}
+
+func TestTbootOSPackage(t *testing.T) {
+	dir := t.TempDir()
+	k := writeTestFile(t, dir, "kernel", testKernel)
+	i := writeTestFile(t, dir, "initramfs", testInitramfs)
+	tboot := writeTestFile(t, dir, "tboot.gz", []byte("tboot"))
+	acm := writeTestFile(t, dir, "acm.bin", []byte("acm"))
+
+	_, err := CreateOSPackage("test", "", k, i, "console=ttyS0", tboot, "logging=serial", nil)
+	require.Error(t, err)
+	osp, err := CreateOSPackage("test", "", k, i, "console=ttyS0", tboot, "logging=serial", []string{acm})
+	require.NoError(t, err)
+	require.True(t, osp.manifest.Multiboot.TXT)
+
+	// manifests of older OS packages describe tboot separately
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "boot", "acms"), 0755))
+	for name, content := range map[string][]byte{"kernel": testKernel, "initramfs": testInitramfs, "tboot.gz": []byte("tboot"), "acms/acm.bin": []byte("acm")} {
+		writeTestFile(t, filepath.Join(src, "boot"), filepath.FromSlash(name), content)
+	}
+	m := NewOSManifest("test", "boot/kernel", "boot/initramfs", "console=ttyS0", "boot/tboot.gz", "logging=serial", []string{"boot/acms/acm.bin"})
+	require.NoError(t, m.Write(src))
+	legacy, err := CreateOSPackageFromDir(src, "")
+	require.NoError(t, err)
+
+	for _, osp := range []*OSPackage{osp, legacy} {
+		osp = verifiedTestOSPackage(t, osp)
+		img, err := osp.OSImage(true)
+		require.NoError(t, err)
+		mbi, ok := img.(*boot.MultibootImage)
+		require.True(t, ok)
+		require.Equal(t, "logging=serial", mbi.Cmdline)
+		var cmdlines []string
+		for _, mod := range mbi.Modules {
+			cmdlines = append(cmdlines, mod.Cmdline)
+		}
+		require.Equal(t, []string{"os-kernel console=ttyS0", "os-initramfs", "ACM1"}, cmdlines)
+
+		// without TXT the kernel is booted directly
+		img, err = osp.OSImage(false)
+		require.NoError(t, err)
+		require.IsType(t, &boot.LinuxImage{}, img)
+	}
+}
+
+func TestBootEntries(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "boot"), 0755))
+	bzImage := newTestBzImage("bzImage")
+	files := map[string][]byte{
+		"bzImage":         bzImage,
+		"initramfs-amd64": testInitramfs,
+		"Image.gz":        gzipped(t, newTestArm64Image("Image")),
+		"initramfs-arm64": testInitramfs,
+		"board.dtb":       []byte("board.dtb"),
+	}
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(src, "boot"), name, content)
+	}
+	m := &OSManifest{
+		Version: ManifestVersion,
+		Label:   "test",
+		Entries: []BootEntry{
+			{Arch: "amd64", KernelPath: "boot/bzImage", InitramfsPath: "boot/initramfs-amd64", Cmdline: "console=ttyS0"},
+			{Arch: "arm64", KernelPath: "boot/Image.gz", InitramfsPath: "boot/initramfs-arm64", DTBPath: "boot/board.dtb", Cmdline: "console=ttyAMA0"},
+		},
+	}
+	require.NoError(t, m.Write(src))
+	osp, err := CreateOSPackageFromDir(src, "")
+	require.NoError(t, err)
+	require.Len(t, osp.manifest.Digests, 5)
+	osp = verifiedTestOSPackage(t, osp)
+
+	defer func(arch string) { goarch = arch }(goarch)
+
+	goarch = "amd64"
+	img, err := osp.OSImage(false)
+	require.NoError(t, err)
+	li, ok := img.(*boot.LinuxImage)
+	require.True(t, ok)
+	require.Equal(t, "console=ttyS0", li.Cmdline)
+	got, err := uio.ReadAll(li.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, bzImage, got)
+
+	goarch = "arm64"
+	img, err = osp.OSImage(false)
+	require.NoError(t, err)
+	ai, ok := img.(*arm64.Image)
+	require.True(t, ok)
+	require.Equal(t, "console=ttyAMA0", ai.Cmdline)
+	got, err = uio.ReadAll(ai.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, newTestArm64Image("Image"), got, "kernel not decompressed")
+	got, err = uio.ReadAll(ai.DTB)
+	require.NoError(t, err)
+	require.Equal(t, []byte("board.dtb"), got)
+
+	goarch = "riscv64"
+	_, err = osp.OSImage(false)
+	require.EqualError(t, err, "os package: no boot entry for architecture riscv64, have amd64, arm64")
+
+	bad := []struct {
+		name string
+		edit func(m *OSManifest)
+	}{
+		{"kernel", func(m *OSManifest) { m.KernelPath = "boot/bzImage" }},
+		{"uki", func(m *OSManifest) { m.UKIPath = "boot/uki.efi" }},
+		{"missing arch", func(m *OSManifest) { m.Entries[0].Arch = "" }},
+		{"duplicate arch", func(m *OSManifest) { m.Entries[1].Arch = "amd64" }},
+		{"missing initramfs", func(m *OSManifest) { m.Entries[1].InitramfsPath = "" }},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			m := *m
+			m.Entries = append([]BootEntry(nil), m.Entries...)
+			tt.edit(&m)
+			require.Error(t, m.Validate())
+		})
+	}
+}
+
+func TestCheckCmdline(t *testing.T) {
+	policy := config.CmdlinePolicy{
+		Required:  []string{"console"},
+		Forbidden: []string{"init"},
+	}
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+	unverified, err := NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	require.Error(t, unverified.CheckCmdline(policy))
+
+	require.NoError(t, verifiedTestOSPackage(t, osp).CheckCmdline(policy))
+
+	dir := t.TempDir()
+	k := writeTestFile(t, dir, "vmlinuz", testKernel)
+	i := writeTestFile(t, dir, "initrd", testInitramfs)
+	xen := writeTestFile(t, dir, "xen.gz", []byte("xen"))
+	mb := &MultibootConfig{
+		KernelPath: xen,
+		Cmdline:    "init=ignored-by-xen",
+		Modules:    []MultibootModule{{Path: k, Cmdline: "console=hvc0 init=/bin/sh"}, {Path: i}},
+	}
+	osp, err = CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	err = verifiedTestOSPackage(t, osp).CheckCmdline(policy)
+	require.EqualError(t, err, `os package: kernel command line "console=hvc0 init=/bin/sh" violates policy: forbidden init=/bin/sh`)
+
+	// a kernel may be loaded from any module
+	other := writeTestFile(t, dir, "vmlinuz-other", testKernel)
+	mb.Modules = []MultibootModule{{Path: k, Cmdline: "console=hvc0"}, {Path: i, Cmdline: "console=hvc0"}, {Path: other, Cmdline: "init=/bin/sh"}}
+	osp, err = CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	err = verifiedTestOSPackage(t, osp).CheckCmdline(policy)
+	require.EqualError(t, err, `os package: kernel command line "init=/bin/sh" violates policy: missing console, forbidden init=/bin/sh`)
+	mb.Modules[2].Cmdline = "console=hvc0"
+	osp, err = CreateMultibootOSPackage("xen", "", k, i, "console=ttyS0", mb)
+	require.NoError(t, err)
+	require.NoError(t, verifiedTestOSPackage(t, osp).CheckCmdline(policy))
+
+	osp, err = createTestUKIOSPackage(t, newTestUKI(t,
+		testSection{ukiKernelSection, testKernel},
+		testSection{ukiCmdlineSection, []byte("quiet")},
+	))
+	require.NoError(t, err)
+	err = verifiedTestOSPackage(t, osp).CheckCmdline(policy)
+	require.EqualError(t, err, `os package: kernel command line "quiet" violates policy: missing console`)
+}
+
+func TestHostConstraints(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	c := &HostConstraints{
+		HostIDs:  []string{"rack1-*", "spare"},
+		Products: []string{"ProLiant DL360 Gen10"},
+	}
+	for _, dsse := range []bool{false, true} {
+		osp := createTestOSPackage(t, testKernel, testInitramfs)
+		require.Error(t, osp.SetHostConstraints(&HostConstraints{HostIDs: []string{""}}))
+		require.NoError(t, osp.SetHostConstraints(c))
+		if dsse {
+			require.NoError(t, osp.UseDSSE(nil))
+		}
+		require.NoError(t, osp.Sign(key, cert))
+		require.Error(t, osp.SetHostConstraints(nil))
+
+		archive, err := osp.ArchiveBytes()
+		require.NoError(t, err)
+		descriptor, err := osp.DescriptorBytes()
+		require.NoError(t, err)
+		osp, err = NewOSPackage(archive, descriptor)
+		require.NoError(t, err)
+		require.Equal(t, c, osp.HostConstraints())
+
+		require.Error(t, osp.CheckHost(HostInfo{}), "not verified")
+		res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+		require.NoError(t, err)
+		require.Equal(t, uint(1), res.Valid)
+
+		require.NoError(t, osp.CheckHost(HostInfo{ID: "rack1-07", Product: "ProLiant DL360 Gen10", CPUVendor: "GenuineIntel"}))
+		require.Error(t, osp.CheckHost(HostInfo{ID: "rack2-07", Product: "ProLiant DL360 Gen10"}))
+		require.Error(t, osp.CheckHost(HostInfo{ID: "spare"}))
+
+		// the constraints are covered by the signature
+		osp.descriptor.Constraints = &HostConstraints{HostIDs: []string{"*"}}
+		res, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+		if dsse {
+			require.Error(t, err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, uint(0), res.Valid)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	created := time.Unix(osp.descriptor.Created, 0)
+	require.Error(t, osp.SetExpiry(created.Add(-time.Hour)))
+	expiry := created.Add(24 * time.Hour)
+	require.NoError(t, osp.SetExpiry(expiry))
+	require.NoError(t, osp.Sign(key, cert))
+	require.Error(t, osp.SetExpiry(time.Time{}))
+
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	require.True(t, expiry.Equal(osp.Expiry()))
+
+	require.Error(t, osp.CheckExpiry(created, 0), "not verified")
+	res, err := osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+
+	require.NoError(t, osp.CheckExpiry(created, 0))
+	require.NoError(t, osp.CheckExpiry(expiry, 0))
+	require.Error(t, osp.CheckExpiry(expiry.Add(time.Second), 0))
+	require.NoError(t, osp.CheckExpiry(expiry.Add(time.Hour), 2*time.Hour))
+	require.Error(t, osp.CheckExpiry(expiry.Add(3*time.Hour), 2*time.Hour))
+
+	// a trusted time after expiry overrides an RTC set back
+	require.True(t, created.Equal(ExpiryTime(created, time.Time{})))
+	require.True(t, created.Equal(ExpiryTime(created, created.Add(-time.Hour))))
+	require.Error(t, osp.CheckExpiry(ExpiryTime(created, time.Time{}, expiry.Add(time.Hour)), 0))
+
+	// packages without expiry never expire
+	osp = createTestOSPackage(t, testKernel, testInitramfs)
+	require.True(t, osp.Expiry().IsZero())
+	require.NoError(t, osp.Sign(key, cert))
+	_, err = osp.Verify([]*x509.Certificate{root}, VerifyOptions{})
+	require.NoError(t, err)
+	require.NoError(t, osp.CheckExpiry(time.Now().Add(100*365*24*time.Hour), 0))
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"debug/pe"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// PE sections of a Unified Kernel Image (UKI) holding the boot files, see
+// https://uapi-group.org/specifications/specs/unified_kernel_image/.
+const (
+	ukiKernelSection    = ".linux"
+	ukiInitramfsSection = ".initrd"
+	ukiCmdlineSection   = ".cmdline"
+)
+
+// maxUKICmdlineSize is the maximum size of the command line embedded
+// in a UKI.
+const maxUKICmdlineSize = 64 << 10
+
+// ukiImage holds the boot files embedded in a UKI. The kernel and the
+// initramfs are read from the UKI on demand.
+type ukiImage struct {
+	kernel    *io.SectionReader
+	initramfs *io.SectionReader
+	cmdline   string
+}
+
+// parseUKI parses the PE sections of the UKI r. The kernel section is
+// mandatory, the initramfs and the command line are optional.
+func parseUKI(r sizeReaderAt) (*ukiImage, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("uki: invalid PE file: %v", err)
+	}
+
+	var u ukiImage
+	if u.kernel, err = ukiSection(f, ukiKernelSection, r.Size()); err != nil {
+		return nil, err
+	}
+	if u.kernel == nil {
+		return nil, fmt.Errorf("uki: missing %s section", ukiKernelSection)
+	}
+	if u.initramfs, err = ukiSection(f, ukiInitramfsSection, r.Size()); err != nil {
+		return nil, err
+	}
+	cmdline, err := ukiSection(f, ukiCmdlineSection, r.Size())
+	if err != nil {
+		return nil, err
+	}
+	if cmdline != nil {
+		if cmdline.Size() > maxUKICmdlineSize {
+			return nil, fmt.Errorf("uki: %s section exceeds %d bytes", ukiCmdlineSection, maxUKICmdlineSize)
+		}
+		b, err := ioutil.ReadAll(cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("uki: reading %s section failed: %v", ukiCmdlineSection, err)
+		}
+		u.cmdline = strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+	}
+	return &u, nil
+}
+
+// ukiSection returns the content of the section called name, or nil if f
+// has no such section. Sections must not be empty and must lie within the
+// file of the given size.
+func ukiSection(f *pe.File, name string, fileSize int64) (*io.SectionReader, error) {
+	s := f.Section(name)
+	if s == nil {
+		return nil, nil
+	}
+	// the raw data is padded to the file alignment, the virtual size is
+	// the actual size of the content
+	size := int64(s.Size)
+	if s.VirtualSize != 0 && int64(s.VirtualSize) < size {
+		size = int64(s.VirtualSize)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("uki: empty %s section", name)
+	}
+	if int64(s.Offset)+int64(s.Size) > fileSize {
+		return nil, fmt.Errorf("uki: %s section exceeds file", name)
+	}
+	return io.NewSectionReader(s, 0, size), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/u-root/u-root/pkg/boot"
+	"github.com/u-root/u-root/pkg/uio"
+)
+
+type testSection struct {
+	name string
+	data []byte
+}
+
+// newTestUKI returns a minimal PE file containing sections, with their raw
+// data padded to 512 bytes.
+func newTestUKI(t *testing.T, sections ...testSection) []byte {
+	t.Helper()
+	const (
+		peOffset  = 0x40
+		alignment = 512
+	)
+	var buf bytes.Buffer
+	dos := make([]byte, peOffset)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], peOffset)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+	fh := pe.FileHeader{
+		Machine:          pe.IMAGE_FILE_MACHINE_AMD64,
+		NumberOfSections: uint16(len(sections)),
+	}
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, fh))
+
+	offset := uint32(alignment)
+	for _, s := range sections {
+		var sh pe.SectionHeader32
+		copy(sh.Name[:], s.name)
+		sh.VirtualSize = uint32(len(s.data))
+		sh.SizeOfRawData = (uint32(len(s.data)) + alignment - 1) / alignment * alignment
+		sh.PointerToRawData = offset
+		offset += sh.SizeOfRawData
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, sh))
+	}
+	for _, s := range sections {
+		buf.Write(make([]byte, alignment-buf.Len()%alignment))
+		buf.Write(s.data)
+	}
+	buf.Write(make([]byte, int(offset)-buf.Len()))
+	return buf.Bytes()
+}
+
+func createTestUKIOSPackage(t *testing.T, uki []byte) (*OSPackage, error) {
+	t.Helper()
+	return CreateOSPackageFromUKI("test", "", writeTestFile(t, t.TempDir(), "linux.efi", uki))
+}
+
+func TestUKI(t *testing.T) {
+	kernel := newTestBzImage(strings.Repeat("kernel", 1000))
+	initramfs := newTestInitramfs(strings.Repeat("initramfs", 1000))
+	uki := newTestUKI(t,
+		testSection{ukiKernelSection, kernel},
+		testSection{ukiInitramfsSection, initramfs},
+		testSection{ukiCmdlineSection, []byte("console=ttyS0\n\x00")},
+	)
+
+	osp, err := createTestUKIOSPackage(t, uki)
+	require.NoError(t, err)
+	require.Equal(t, "boot/linux.efi", osp.manifest.UKIPath)
+	require.Empty(t, osp.manifest.KernelPath)
+
+	osp = verifiedTestOSPackage(t, osp)
+	img, err := osp.OSImage(true)
+	require.NoError(t, err)
+	li, ok := img.(*boot.LinuxImage)
+	require.True(t, ok)
+	require.Equal(t, "console=ttyS0", li.Cmdline)
+	got, err := uio.ReadAll(li.Kernel)
+	require.NoError(t, err)
+	require.Equal(t, kernel, got)
+	got, err = uio.ReadAll(li.Initrd)
+	require.NoError(t, err)
+	require.Equal(t, initramfs, got)
+
+	// initramfs and cmdline are optional
+	osp, err = createTestUKIOSPackage(t, newTestUKI(t, testSection{ukiKernelSection, kernel}))
+	require.NoError(t, err)
+	img, err = verifiedTestOSPackage(t, osp).OSImage(false)
+	require.NoError(t, err)
+	li = img.(*boot.LinuxImage)
+	require.Nil(t, li.Initrd)
+	require.Empty(t, li.Cmdline)
+}
+
+func TestUKIMalformed(t *testing.T) {
+	good := newTestUKI(t, testSection{ukiKernelSection, testKernel})
+	tests := []struct {
+		name string
+		uki  []byte
+	}{
+		{"not a PE file", []byte("kernel")},
+		{"truncated", good[:len(good)-100]},
+		{"missing kernel", newTestUKI(t, testSection{ukiInitramfsSection, testInitramfs})},
+		{"empty kernel", newTestUKI(t, testSection{ukiKernelSection, nil})},
+		{"invalid kernel", newTestUKI(t, testSection{ukiKernelSection, []byte("kernel")})},
+		{"invalid initramfs", newTestUKI(t,
+			testSection{ukiKernelSection, testKernel},
+			testSection{ukiInitramfsSection, []byte("initramfs")},
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := createTestUKIOSPackage(t, tt.uki)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestManifestUKI(t *testing.T) {
+	m := &OSManifest{Version: ManifestVersion, UKIPath: "boot/linux.efi"}
+	require.NoError(t, m.Validate())
+	require.Equal(t, []string{"boot/linux.efi"}, m.paths())
+
+	m.Cmdline = "console=ttyS0"
+	require.Error(t, m.Validate())
+}
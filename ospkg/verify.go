@@ -0,0 +1,308 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"time"
+
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/stlog"
+	"github.com/system-transparency/stboot/trust"
+)
+
+// VerifyOptions define the policy signing certificates are checked against
+// during verification of an OS package.
+type VerifyOptions struct {
+	// Time is the time validity periods are checked against, unless there
+	// is a valid timestamp token. If zero, the current time is used.
+	Time time.Time
+	// IgnoreValidity disables checking of validity periods.
+	IgnoreValidity bool
+	// KeyUsage bits, which must all be set in signing certificates.
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsages of which signing certificates must contain at least one.
+	// If empty, any extended key usage is accepted.
+	ExtKeyUsages []x509.ExtKeyUsage
+	// Policy lists clauses, which must all be satisfied by the valid
+	// signatures. If empty, at least one valid signature is required.
+	Policy []SignatureClause
+	// CRLs are consulted to skip signatures of revoked certificates. Each
+	// certificate of a chain is checked against the CRLs of its issuer.
+	CRLs []*pkix.CertificateList
+	// RequireCRL makes verification fail if there is no current CRL for
+	// each of the signing roots, and skips signatures if there is no
+	// current CRL for each intermediate of their certificate chain.
+	RequireCRL bool
+	// TSARoots are the roots of time stamping authorities. If set, a valid
+	// timestamp token over a signature defines the time its certificate
+	// chain is checked at.
+	TSARoots []*x509.Certificate
+	// RequireTimestamp skips signatures without a valid timestamp token.
+	RequireTimestamp bool
+	// Log requires a proof that the OS package is logged in the transparency
+	// log it defines. If nil, log proofs are not checked.
+	Log *trust.LogPolicy
+	// BuilderID requires a DSSE descriptor with SLSA provenance naming
+	// BuilderID as builder. If empty, provenance is not checked.
+	BuilderID string
+}
+
+// SignatureClause requires Threshold valid signatures chaining to Root.
+// If Root is nil, signatures may chain to any of the signing roots.
+type SignatureClause struct {
+	Root      *x509.Certificate
+	Threshold uint
+}
+
+func (c SignatureClause) String() string {
+	if c.Root == nil {
+		return fmt.Sprintf("%d signatures chaining to any root", c.Threshold)
+	}
+	return fmt.Sprintf("%d signatures chaining to %q (%s)", c.Threshold, c.Root.Subject.CommonName, trust.Fingerprint(c.Root))
+}
+
+// ClauseResult is the evaluation of a SignatureClause.
+type ClauseResult struct {
+	SignatureClause
+	// Valid is the number of valid signatures counting towards the clause.
+	Valid uint
+}
+
+// Satisfied reports whether enough valid signatures count towards c.
+func (c ClauseResult) Satisfied() bool {
+	return c.Valid >= c.Threshold
+}
+
+func (c ClauseResult) String() string {
+	verdict := "satisfied"
+	if !c.Satisfied() {
+		verdict = "not satisfied"
+	}
+	return fmt.Sprintf("%s: %d valid, %s", c.SignatureClause, c.Valid, verdict)
+}
+
+// SignatureResult is the verdict on a single signature.
+type SignatureResult struct {
+	// Index is the position of the signature in the descriptor.
+	Index int
+	Cert  *x509.Certificate
+	// Roots are the signing roots the certificate chains to.
+	Roots []*x509.Certificate
+	// Timestamp is the time proven by a valid timestamp token, if any.
+	Timestamp time.Time
+	// Err is the reason the signature is invalid, or nil if it is valid.
+	Err error
+}
+
+func (s SignatureResult) String() string {
+	var subject string
+	if s.Cert != nil {
+		subject = fmt.Sprintf(" (%q, %s)", s.Cert.Subject.CommonName, trust.Fingerprint(s.Cert))
+	}
+	if s.Err != nil {
+		return fmt.Sprintf("signature %d%s: invalid: %v", s.Index+1, subject, s.Err)
+	}
+	verdict := fmt.Sprintf("signature %d%s: valid, chains to", s.Index+1, subject)
+	for i, r := range s.Roots {
+		if i > 0 {
+			verdict += ","
+		}
+		verdict += fmt.Sprintf(" %q", r.Subject.CommonName)
+	}
+	if !s.Timestamp.IsZero() {
+		verdict += fmt.Sprintf(", timestamped %s", s.Timestamp.UTC().Format(time.RFC3339))
+	}
+	return verdict
+}
+
+// VerifyResult is the outcome of OSPackage.Verify.
+type VerifyResult struct {
+	// Found is the number of signatures in the descriptor.
+	Found uint
+	// Valid is the number of valid signatures, regardless of their root.
+	Valid uint
+	// Signatures holds the verdict on each signature.
+	Signatures []SignatureResult
+	// Clauses holds the evaluation of each clause of the signature policy.
+	Clauses []ClauseResult
+}
+
+// skip records signature i with cert as invalid due to err.
+func (r *VerifyResult) skip(i int, cert *x509.Certificate, err error) {
+	stlog.Debug("skip signature %d: %v", i+1, err)
+	r.Signatures = append(r.Signatures, SignatureResult{Index: i, Cert: cert, Err: err})
+}
+
+// Accepted reports whether the signatures satisfy the signature policy.
+func (r *VerifyResult) Accepted() bool {
+	if len(r.Clauses) == 0 {
+		return r.Valid > 0
+	}
+	for _, c := range r.Clauses {
+		if !c.Satisfied() {
+			return false
+		}
+	}
+	return true
+}
+
+// LatestTimestamp returns the latest time proven by the timestamp token of a
+// valid signature, or the zero time.
+func (r *VerifyResult) LatestTimestamp() time.Time {
+	var latest time.Time
+	for _, s := range r.Signatures {
+		if s.Err == nil && s.Timestamp.After(latest) {
+			latest = s.Timestamp
+		}
+	}
+	return latest
+}
+
+// NewVerifyOptions returns the VerifyOptions configured in cfg. timeFix is
+// used as verification time if cfg selects the system time fix file. If cfg
+// selects the signed time, timestamp tokens are required, and the TSA roots
+// need to be set by the caller. The signature policy of cfg refers to roots
+// by their fingerprint.
+func NewVerifyOptions(cfg *config.SecurityCfg, timeFix time.Time, roots []*x509.Certificate) (VerifyOptions, error) {
+	opts := VerifyOptions{
+		IgnoreValidity:   !cfg.EnforceCertValidity,
+		KeyUsage:         cfg.SigningKeyUsage,
+		ExtKeyUsages:     cfg.SigningExtKeyUsage,
+		RequireCRL:       cfg.RequireCRL,
+		RequireTimestamp: cfg.RequireTimestamp,
+		BuilderID:        cfg.ProvenanceBuilderID,
+	}
+	if len(cfg.SignaturePolicy) == 0 {
+		opts.Policy = []SignatureClause{{Threshold: cfg.ValidSignatureThreshold}}
+	}
+	for _, clause := range cfg.SignaturePolicy {
+		var root *x509.Certificate
+		for _, r := range roots {
+			if trust.Fingerprint(r) == clause.RootFingerprint {
+				root = r
+				break
+			}
+		}
+		if root == nil {
+			return VerifyOptions{}, fmt.Errorf("signature policy: no signing root with fingerprint %s", clause.RootFingerprint)
+		}
+		opts.Policy = append(opts.Policy, SignatureClause{Root: root, Threshold: clause.Threshold})
+	}
+	switch cfg.TimeSource {
+	case config.RTCTime:
+		opts.Time = time.Now()
+	case config.TimeFixTime:
+		if timeFix.IsZero() {
+			return VerifyOptions{}, fmt.Errorf("no system time fix available")
+		}
+		opts.Time = timeFix
+	case config.SignedTime:
+		opts.Time = time.Now()
+		opts.RequireTimestamp = true
+	default:
+		return VerifyOptions{}, fmt.Errorf("unknown time source %v", cfg.TimeSource)
+	}
+	return opts, nil
+}
+
+// verifyTime returns o.Time or, if unset, the current time.
+func (o VerifyOptions) verifyTime() time.Time {
+	if o.Time.IsZero() {
+		return time.Now()
+	}
+	return o.Time
+}
+
+// checkKeyUsage makes sure that cert has all key usages required by o.
+// Other than x509.Certificate.Verify, a certificate without extended key
+// usages does not satisfy a required extended key usage.
+func (o VerifyOptions) checkKeyUsage(cert *x509.Certificate) error {
+	if cert.KeyUsage&o.KeyUsage != o.KeyUsage {
+		return fmt.Errorf("missing required key usage")
+	}
+	if len(o.ExtKeyUsages) == 0 {
+		return nil
+	}
+	for _, have := range cert.ExtKeyUsage {
+		for _, want := range o.ExtKeyUsages {
+			if have == want || want == x509.ExtKeyUsageAny {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("missing required extended key usage")
+}
+
+// validWithin returns a point in time all certs are valid at, if any.
+// It is used to skip validity checks of x509.Certificate.Verify, which always
+// checks validity periods.
+func validWithin(certs ...*x509.Certificate) (time.Time, error) {
+	var from, until time.Time
+	for i, c := range certs {
+		if i == 0 || c.NotBefore.After(from) {
+			from = c.NotBefore
+		}
+		if i == 0 || c.NotAfter.Before(until) {
+			until = c.NotAfter
+		}
+	}
+	if from.After(until) {
+		return time.Time{}, fmt.Errorf("validity periods of certificate chain do not overlap")
+	}
+	return from, nil
+}
+
+// crlsBy returns the CRLs issued by issuer.
+func (o VerifyOptions) crlsBy(issuer *x509.Certificate) []*pkix.CertificateList {
+	var crls []*pkix.CertificateList
+	for _, crl := range o.CRLs {
+		if issuer.CheckCRLSignature(crl) == nil {
+			crls = append(crls, crl)
+		}
+	}
+	return crls
+}
+
+// checkCRL makes sure that there is a CRL issued by issuer, which is not
+// stale. Other than certificate validity, staleness of CRLs is always
+// checked against o.Time or the current time, never a timestamp.
+func (o VerifyOptions) checkCRL(issuer *x509.Certificate) error {
+	now := o.verifyTime()
+	crls := o.crlsBy(issuer)
+	if len(crls) == 0 {
+		return fmt.Errorf("no CRL issued by %q", issuer.Subject.CommonName)
+	}
+	for _, crl := range crls {
+		if !crl.HasExpired(now) {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL issued by %q is stale", issuer.Subject.CommonName)
+}
+
+// checkRevocation checks each certificate of chain against the CRLs of its
+// issuer, which must be current if o requires CRLs. The chain starts with
+// the leaf and ends with the root.
+func (o VerifyOptions) checkRevocation(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		if o.RequireCRL {
+			if err := o.checkCRL(issuer); err != nil {
+				return err
+			}
+		}
+		for _, crl := range o.crlsBy(issuer) {
+			for _, rc := range crl.TBSCertList.RevokedCertificates {
+				if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %q revoked by %q", cert.Subject.CommonName, issuer.Subject.CommonName)
+				}
+			}
+		}
+	}
+	return nil
+}
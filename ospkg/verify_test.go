@@ -0,0 +1,361 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/internal/tsatest"
+	"github.com/system-transparency/stboot/trust"
+	"github.com/system-transparency/stboot/trust/logtest"
+)
+
+func TestVerifyOptions(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+
+	// signing certificate expired 20 minutes ago
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signTime := time.Now().Add(-30 * time.Minute)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		NotBefore:    signTime.Add(-10 * time.Minute),
+		NotAfter:     signTime.Add(10 * time.Minute),
+	}
+	key, cert, _ := newTestCertFromTemplate(t, priv, template, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	osp.descriptor.Created = signTime.Unix()
+	require.NoError(t, osp.Sign(key, cert))
+
+	tests := []struct {
+		name  string
+		opts  VerifyOptions
+		valid uint
+	}{
+		// the signed creation time is set by the signer and never used
+		{"current time", VerifyOptions{}, 0},
+		{"time at signing", VerifyOptions{Time: signTime}, 1},
+		{"ignore validity", VerifyOptions{IgnoreValidity: true}, 1},
+		{"key usage", VerifyOptions{Time: signTime, KeyUsage: x509.KeyUsageDigitalSignature}, 1},
+		{"missing key usage", VerifyOptions{Time: signTime, KeyUsage: x509.KeyUsageContentCommitment}, 0},
+		{"ext key usage", VerifyOptions{Time: signTime, ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}}, 1},
+		{"missing ext key usage", VerifyOptions{Time: signTime, ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := osp.Verify([]*x509.Certificate{root}, tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, tt.valid, res.Valid)
+			require.Len(t, res.Signatures, 1)
+			if tt.valid > 0 {
+				require.NoError(t, res.Signatures[0].Err)
+				require.Equal(t, []*x509.Certificate{root}, res.Signatures[0].Roots)
+			} else {
+				require.Error(t, res.Signatures[0].Err)
+			}
+		})
+	}
+}
+
+func TestNewVerifyOptions(t *testing.T) {
+	timeFix := time.Unix(1600000000, 0)
+
+	opts, err := NewVerifyOptions(&config.SecurityCfg{TimeSource: config.TimeFixTime}, timeFix, nil)
+	require.NoError(t, err)
+	require.Equal(t, timeFix, opts.Time)
+
+	_, err = NewVerifyOptions(&config.SecurityCfg{TimeSource: config.TimeFixTime}, time.Time{}, nil)
+	require.Error(t, err)
+
+	// validity is only enforced if configured
+	require.True(t, opts.IgnoreValidity)
+	opts, err = NewVerifyOptions(&config.SecurityCfg{EnforceCertValidity: true}, timeFix, nil)
+	require.NoError(t, err)
+	require.False(t, opts.IgnoreValidity)
+
+	// the signed time is only taken from timestamp tokens
+	opts, err = NewVerifyOptions(&config.SecurityCfg{TimeSource: config.SignedTime, RequireTimestamp: true}, timeFix, nil)
+	require.NoError(t, err)
+	require.True(t, opts.RequireTimestamp)
+	require.False(t, opts.Time.IsZero())
+}
+
+func TestVerifySignaturePolicy(t *testing.T) {
+	buildKey, _, buildRoot := newTestCert(t, nil, nil)
+	buildPriv, err := x509.ParsePKCS8PrivateKey(buildKey.Bytes)
+	require.NoError(t, err)
+	securityKey, _, securityRoot := newTestCert(t, nil, nil)
+	securityPriv, err := x509.ParsePKCS8PrivateKey(securityKey.Bytes)
+	require.NoError(t, err)
+	roots := []*x509.Certificate{buildRoot, securityRoot}
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	for i := 0; i < 2; i++ {
+		key, cert, _ := newTestCert(t, buildRoot, buildPriv)
+		require.NoError(t, osp.Sign(key, cert))
+	}
+
+	cfg := &config.SecurityCfg{
+		SignaturePolicy: []config.SignatureClause{
+			{RootFingerprint: trust.Fingerprint(buildRoot), Threshold: 2},
+			{RootFingerprint: trust.Fingerprint(securityRoot), Threshold: 1},
+		},
+	}
+	opts, err := NewVerifyOptions(cfg, time.Time{}, roots)
+	require.NoError(t, err)
+
+	res, err := osp.Verify(roots, opts)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), res.Valid)
+	require.False(t, res.Accepted())
+	require.Len(t, res.Clauses, 2)
+	require.True(t, res.Clauses[0].Satisfied())
+	require.False(t, res.Clauses[1].Satisfied())
+
+	key, cert, _ := newTestCert(t, securityRoot, securityPriv)
+	require.NoError(t, osp.Sign(key, cert))
+	res, err = osp.Verify(roots, opts)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), res.Valid)
+	require.True(t, res.Accepted())
+
+	// fall back to a threshold over all roots
+	opts, err = NewVerifyOptions(&config.SecurityCfg{ValidSignatureThreshold: 3}, time.Time{}, roots)
+	require.NoError(t, err)
+	res, err = osp.Verify(roots, opts)
+	require.NoError(t, err)
+	require.True(t, res.Accepted())
+
+	// policy refers to an unknown root
+	_, err = NewVerifyOptions(cfg, time.Time{}, roots[:1])
+	require.Error(t, err)
+}
+
+func newTestCRL(t *testing.T, issuer *x509.Certificate, issuerKey crypto.Signer, nextUpdate time.Time, revoked ...*x509.Certificate) *pkix.CertificateList {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, c := range revoked {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   c.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer, issuerKey)
+	require.NoError(t, err)
+	crl, err := x509.ParseDERCRL(der)
+	require.NoError(t, err)
+	return crl
+}
+
+func TestVerifyRevocation(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	roots := []*x509.Certificate{root}
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	key, cert, revoked := newTestCert(t, root, rootPriv)
+	require.NoError(t, osp.Sign(key, cert))
+	key, cert, _ = newTestCert(t, root, rootPriv)
+	require.NoError(t, osp.Sign(key, cert))
+
+	signer := rootPriv.(crypto.Signer)
+	current := newTestCRL(t, root, signer, time.Now().Add(time.Hour), revoked)
+	stale := newTestCRL(t, root, signer, time.Now().Add(-time.Minute), revoked)
+
+	res, err := osp.Verify(roots, VerifyOptions{CRLs: []*pkix.CertificateList{current}})
+	require.NoError(t, err)
+	require.Equal(t, uint(2), res.Found)
+	require.Equal(t, uint(1), res.Valid)
+
+	res, err = osp.Verify(roots, VerifyOptions{CRLs: []*pkix.CertificateList{stale}})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid, "stale CRLs still revoke certificates")
+
+	_, err = osp.Verify(roots, VerifyOptions{RequireCRL: true, CRLs: []*pkix.CertificateList{current}})
+	require.NoError(t, err)
+	_, err = osp.Verify(roots, VerifyOptions{RequireCRL: true, CRLs: []*pkix.CertificateList{stale}})
+	require.Error(t, err)
+	_, err = osp.Verify(roots, VerifyOptions{RequireCRL: true})
+	require.Error(t, err)
+
+	// CRLs issued by other roots are ignored
+	otherKey, _, other := newTestCert(t, nil, nil)
+	otherPriv, err := x509.ParsePKCS8PrivateKey(otherKey.Bytes)
+	require.NoError(t, err)
+	foreign := newTestCRL(t, other, otherPriv.(crypto.Signer), time.Now().Add(time.Hour), revoked)
+	res, err = osp.Verify(roots, VerifyOptions{CRLs: []*pkix.CertificateList{foreign}})
+	require.NoError(t, err)
+	require.Equal(t, uint(2), res.Valid)
+}
+
+func TestVerifyIntermediateCRL(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	roots := []*x509.Certificate{root}
+
+	_, interPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	_, interPEM, inter := newTestCertFromTemplate(t, interPriv, template, root, rootPriv)
+	key, cert, _ := newTestCert(t, inter, interPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert, interPEM))
+
+	rootCRL := newTestCRL(t, root, rootPriv.(crypto.Signer), time.Now().Add(time.Hour))
+	current := newTestCRL(t, inter, interPriv, time.Now().Add(time.Hour))
+	stale := newTestCRL(t, inter, interPriv, time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name  string
+		crls  []*pkix.CertificateList
+		valid uint
+	}{
+		{"current intermediate CRL", []*pkix.CertificateList{rootCRL, current}, 1},
+		{"stale intermediate CRL", []*pkix.CertificateList{rootCRL, stale}, 0},
+		{"missing intermediate CRL", []*pkix.CertificateList{rootCRL}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := osp.Verify(roots, VerifyOptions{RequireCRL: true, CRLs: tt.crls})
+			require.NoError(t, err)
+			require.Equal(t, tt.valid, res.Valid)
+			if tt.valid == 0 {
+				require.Contains(t, res.Signatures[0].Err.Error(), "intermediate")
+			}
+		})
+	}
+
+	// without RequireCRL, a missing intermediate CRL is fine
+	res, err := osp.Verify(roots, VerifyOptions{CRLs: []*pkix.CertificateList{rootCRL}})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+}
+
+func TestVerifyLogProof(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	roots := []*x509.Certificate{root}
+	key, cert, _ := newTestCert(t, root, rootPriv)
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+
+	log, err := logtest.New(2)
+	require.NoError(t, err)
+	opts := VerifyOptions{Log: log.Policy(2)}
+	_, err = osp.Verify(roots, opts)
+	require.Error(t, err, "proof is missing")
+
+	message, err := osp.LogMessage()
+	require.NoError(t, err)
+	log.Add(sha256.Sum256([]byte("other")))
+	index := log.Add(message)
+	proof, err := log.Proof(index)
+	require.NoError(t, err)
+
+	other, err := log.Proof(0)
+	require.NoError(t, err)
+	require.Error(t, osp.AttachLogProof(other))
+
+	require.NoError(t, osp.AttachLogProof(proof))
+	res, err := osp.Verify(roots, opts)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+
+	// the proof survives serialization of the descriptor
+	archive, err := osp.ArchiveBytes()
+	require.NoError(t, err)
+	descriptor, err := osp.DescriptorBytes()
+	require.NoError(t, err)
+	osp, err = NewOSPackage(archive, descriptor)
+	require.NoError(t, err)
+	_, err = osp.Verify(roots, opts)
+	require.NoError(t, err)
+
+	_, err = osp.Verify(roots, VerifyOptions{Log: log.Policy(3)})
+	require.Error(t, err, "quorum not reached")
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	rootKey, _, root := newTestCert(t, nil, nil)
+	rootPriv, err := x509.ParsePKCS8PrivateKey(rootKey.Bytes)
+	require.NoError(t, err)
+	roots := []*x509.Certificate{root}
+
+	// signing certificate expired 20 minutes ago
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signTime := time.Now().Add(-30 * time.Minute)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotBefore:    signTime.Add(-10 * time.Minute),
+		NotAfter:     signTime.Add(10 * time.Minute),
+	}
+	key, cert, _ := newTestCertFromTemplate(t, priv, template, root, rootPriv)
+	otherKey, otherCert, _ := newTestCert(t, root, rootPriv)
+
+	tsa, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	tsa.Now = func() time.Time { return signTime }
+
+	osp := createTestOSPackage(t, testKernel, testInitramfs)
+	require.NoError(t, osp.Sign(key, cert))
+	require.NoError(t, osp.TimestampSignature(tsa))
+	require.NoError(t, osp.Sign(otherKey, otherCert))
+	require.Len(t, osp.descriptor.Timestamps, 2)
+	require.NoError(t, osp.descriptor.Validate())
+
+	res, err := osp.Verify(roots, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid, "expired signer without TSA roots")
+	require.True(t, res.LatestTimestamp().IsZero())
+
+	res, err = osp.Verify(roots, VerifyOptions{TSARoots: []*x509.Certificate{tsa.Root}})
+	require.NoError(t, err)
+	require.Equal(t, uint(2), res.Valid)
+	require.True(t, signTime.Truncate(time.Second).Equal(res.LatestTimestamp().Truncate(time.Second)))
+
+	res, err = osp.Verify(roots, VerifyOptions{TSARoots: []*x509.Certificate{tsa.Root}, RequireTimestamp: true})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid, "second signature has no timestamp")
+
+	// a timestamp over another signature does not count
+	osp.descriptor.Timestamps[1] = osp.descriptor.Timestamps[0]
+	res, err = osp.Verify(roots, VerifyOptions{TSARoots: []*x509.Certificate{tsa.Root}, RequireTimestamp: true})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), res.Valid)
+}
@@ -7,41 +7,340 @@ package ospkg
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func zipDir(archive *zip.Writer, name string) error {
+// ReproducibleEpoch is the earliest modification time zip archives can
+// represent. Earlier times are clamped to it.
+var ReproducibleEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// SourceDateEpoch returns the time defined by the SOURCE_DATE_EPOCH
+// environment variable, see https://reproducible-builds.org/specs/source-date-epoch/.
+// If it is unset, ReproducibleEpoch is returned.
+func SourceDateEpoch() (time.Time, error) {
+	v, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok || v == "" {
+		return ReproducibleEpoch, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// maxManifestSize is the maximum size of the manifest, which is read into
+// memory as a whole.
+const maxManifestSize = 1 << 20
+
+// ArchiveLimits bound the uncompressed size of the members of an OS package
+// archive. They are checked against the sizes recorded in the archive before
+// anything is extracted. Reading a member fails if its content exceeds the
+// recorded size. A zero limit means the limit of DefaultArchiveLimits.
+type ArchiveLimits struct {
+	// MaxMemberSize is the maximum uncompressed size of a single member.
+	MaxMemberSize uint64
+	// MaxTotalSize is the maximum uncompressed size of all members together.
+	MaxTotalSize uint64
+}
+
+// DefaultArchiveLimits are the limits used unless configured otherwise.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxMemberSize: 1 << 30,
+	MaxTotalSize:  2 << 30,
+}
+
+func (l ArchiveLimits) withDefaults() ArchiveLimits {
+	if l.MaxMemberSize == 0 {
+		l.MaxMemberSize = DefaultArchiveLimits.MaxMemberSize
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultArchiveLimits.MaxTotalSize
+	}
+	return l
+}
+
+// checkMemberName makes sure name is a canonical relative path, which cannot
+// be interpreted differently by different extractors. Directory names end
+// with a slash.
+func checkMemberName(name string) error {
+	p := strings.TrimSuffix(name, "/")
+	if p == "" {
+		return errors.New("empty path")
+	}
+	if strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\\:") {
+		return fmt.Errorf("%s: absolute or non-portable path", name)
+	}
+	if path.Clean(p) != p {
+		return fmt.Errorf("%s: non-canonical path", name)
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return fmt.Errorf("%s: path leaves archive", name)
+		}
+	}
+	return nil
+}
+
+// checkArchive makes sure the zip archive in r contains canonical and unique
+// members within limits and no data besides them, see checkLayout. Besides
+// directories, only the manifest and the boot files referenced by it may be
+// present.
+func checkArchive(r io.ReaderAt, size int64, limits ArchiveLimits) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if err := checkLayout(r, size, archive); err != nil {
+		return err
+	}
+	limits = limits.withDefaults()
+	members := make(map[string]*zip.File)
+	var total uint64
+	for _, file := range archive.File {
+		if err := checkMemberName(file.Name); err != nil {
+			return err
+		}
+		if _, ok := members[file.Name]; ok {
+			return fmt.Errorf("%s: duplicate entry", file.Name)
+		}
+		members[file.Name] = file
+		size := file.UncompressedSize64
+		if strings.HasSuffix(file.Name, "/") && size != 0 {
+			return fmt.Errorf("%s: directory with content", file.Name)
+		}
+		if size > limits.MaxMemberSize {
+			return fmt.Errorf("%s: size %d exceeds limit of %d bytes", file.Name, size, limits.MaxMemberSize)
+		}
+		total += size
+		if total > limits.MaxTotalSize {
+			return fmt.Errorf("total size exceeds limit of %d bytes", limits.MaxTotalSize)
+		}
+	}
+
+	mf, ok := members[ManifestName]
+	if !ok {
+		return fmt.Errorf("cannot find %s in archive", ManifestName)
+	}
+	if mf.UncompressedSize64 > maxManifestSize {
+		return fmt.Errorf("%s: size exceeds limit of %d bytes", ManifestName, maxManifestSize)
+	}
+	data, err := readZipFile(mf)
+	if err != nil {
+		return err
+	}
+	m, err := OSManifestFromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	expected := map[string]bool{ManifestName: true}
+	for _, p := range m.paths() {
+		expected[p] = true
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			expected[d+"/"] = true
+		}
+	}
+	for _, file := range archive.File {
+		if !expected[file.Name] {
+			return fmt.Errorf("%s: unexpected member", file.Name)
+		}
+	}
+	return nil
+}
+
+// sizeReaderAt is implemented by the contents of an OS package. They are
+// held in memory, so random access by the boot format parsers is cheap.
+type sizeReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// newZipWriter returns a zip.Writer producing the same output for the same
+// sequence of members, using fixed compression settings.
+func newZipWriter(w io.Writer) *zip.Writer {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.DefaultCompression)
+	})
+	return zw
+}
+
+// zipHeader returns a header with normalized mode and modification time.
+func zipHeader(name string, mode os.FileMode, modTime time.Time) *zip.FileHeader {
+	if modTime.Before(ReproducibleEpoch) {
+		modTime = ReproducibleEpoch
+	}
+	h := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime.UTC(),
+	}
+	h.SetMode(mode)
+	return h
+}
+
+func zipDir(archive *zip.Writer, name string, modTime time.Time) error {
 	if name[len(name)-1:] != "/" {
 		name += "/"
 	}
-	_, err := archive.Create(name)
+	h := zipHeader(name, os.ModeDir|0755, modTime)
+	h.Method = zip.Store
+	_, err := archive.CreateHeader(h)
 	return err
 }
 
-func zipFile(archive *zip.Writer, name string, src []byte) error {
-	f, err := archive.Create(name)
+func zipFile(archive *zip.Writer, name string, src sizeReaderAt, modTime time.Time) error {
+	f, err := archive.CreateHeader(zipHeader(name, 0644, modTime))
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(f, bytes.NewReader(src))
+	_, err = io.Copy(f, io.NewSectionReader(src, 0, src.Size()))
 	return err
 }
 
-func unzipFile(archive *zip.Reader, name string) ([]byte, error) {
+func unzipFile(archive *zip.Reader, name string) (*zip.File, error) {
 	for _, file := range archive.File {
 		if file.Name == name {
-			f, err := file.Open()
-			if err != nil {
-				return nil, fmt.Errorf("cannot open %s in archive: %v", name, err)
-			}
+			return file, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find %s in archive", name)
+}
+
+// readZipFile decompresses f into memory. Members are only ever read
+// sequentially and at most once, boot files are parsed from the in-memory
+// copy, see readMember.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s in archive: %v", f.Name, err)
+	}
+	defer rc.Close()
+	buf := newMemberBuffer(f)
+	if _, err := copyMember(buf, rc, f); err != nil {
+		return nil, fmt.Errorf("reading %s failed: %v", f.Name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// maxPrealloc limits the memory allocated for a member before reading it,
+// since its recorded size is not verified until then.
+const maxPrealloc = 1 << 20
+
+// newMemberBuffer returns an empty buffer for the content of f.
+func newMemberBuffer(f *zip.File) *bytes.Buffer {
+	size := f.UncompressedSize64
+	if size > maxPrealloc {
+		size = maxPrealloc
+	}
+	return bytes.NewBuffer(make([]byte, 0, size))
+}
+
+// copyMember copies the content of f from rc, which f.Open returned, to w.
+// It fails if the content is larger than the recorded size of f.
+func copyMember(w io.Writer, rc io.Reader, f *zip.File) (int64, error) {
+	size := f.UncompressedSize64
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("recorded size %d out of range", size)
+	}
+	n, err := io.Copy(w, io.LimitReader(rc, int64(size)+1))
+	if err != nil {
+		return n, err
+	}
+	if uint64(n) > size {
+		return n, fmt.Errorf("content exceeds recorded size of %d bytes", size)
+	}
+	return n, nil
+}
+
+// Signatures of the zip records checked by checkLayout.
+const (
+	zipLocalHeaderSig    = 0x04034b50
+	zipDataDescriptorSig = 0x08074b50
+	zipDirectoryEndSig   = 0x06054b50
+	zipLocalHeaderLen    = 30
+	zipDirectoryEndLen   = 22
+)
 
-			buf := new(bytes.Buffer)
-			if _, err = io.Copy(buf, f); err != nil {
-				return nil, fmt.Errorf("reading %s failed: %v", name, err)
+// checkLayout makes sure that r consists of the local entries of the members
+// of archive in order, followed by the central directory and its end record.
+// Data before, between or after them is rejected, as is a local header
+// naming another file than the central directory. Otherwise different zip
+// implementations could extract different content from the same archive.
+func checkLayout(r io.ReaderAt, size int64, archive *zip.Reader) error {
+	var off int64
+	for _, f := range archive.File {
+		var hdr [zipLocalHeaderLen]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return fmt.Errorf("%s: reading local header failed: %v", f.Name, err)
+		}
+		if binary.LittleEndian.Uint32(hdr[0:]) != zipLocalHeaderSig {
+			return fmt.Errorf("%s: no local header at offset %d", f.Name, off)
+		}
+		nameLen := int64(binary.LittleEndian.Uint16(hdr[26:]))
+		extraLen := int64(binary.LittleEndian.Uint16(hdr[28:]))
+		name := make([]byte, nameLen)
+		if _, err := r.ReadAt(name, off+zipLocalHeaderLen); err != nil {
+			return fmt.Errorf("%s: reading local header failed: %v", f.Name, err)
+		}
+		if string(name) != f.Name {
+			return fmt.Errorf("%s: local header names %q", f.Name, name)
+		}
+		dataOff, err := f.DataOffset()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if dataOff != off+zipLocalHeaderLen+nameLen+extraLen {
+			return fmt.Errorf("%s: local header not at offset %d", f.Name, off)
+		}
+		off = dataOff + int64(f.CompressedSize64)
+		if f.Flags&0x8 != 0 {
+			// data descriptor with optional signature
+			var sig [4]byte
+			if _, err := r.ReadAt(sig[:], off); err != nil {
+				return fmt.Errorf("%s: reading data descriptor failed: %v", f.Name, err)
+			}
+			if binary.LittleEndian.Uint32(sig[:]) == zipDataDescriptorSig {
+				off += 4
+			}
+			if f.CompressedSize64 >= math.MaxUint32 || f.UncompressedSize64 >= math.MaxUint32 {
+				off += 20
+			} else {
+				off += 12
 			}
-			return buf.Bytes(), nil
 		}
 	}
-	return nil, fmt.Errorf("cannot find %s in archive", name)
+
+	end := size - zipDirectoryEndLen - int64(len(archive.Comment))
+	if end < off {
+		return errors.New("truncated central directory")
+	}
+	var rec [zipDirectoryEndLen]byte
+	if _, err := r.ReadAt(rec[:], end); err != nil {
+		return fmt.Errorf("reading end of central directory failed: %v", err)
+	}
+	if binary.LittleEndian.Uint32(rec[0:]) != zipDirectoryEndSig ||
+		int(binary.LittleEndian.Uint16(rec[20:])) != len(archive.Comment) {
+		return errors.New("data after end of central directory")
+	}
+	dirSize := int64(binary.LittleEndian.Uint32(rec[12:]))
+	dirOff := binary.LittleEndian.Uint32(rec[16:])
+	if dirOff == math.MaxUint32 {
+		return errors.New("zip64 archives are not supported")
+	}
+	if int64(dirOff) != off || int64(dirOff)+dirSize != end {
+		return errors.New("unexpected data between members and central directory")
+	}
+	return nil
 }
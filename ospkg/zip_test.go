@@ -0,0 +1,220 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ospkg
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMember(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	require.NoError(t, zipFile(w, "boot/kernel", bytes.NewReader(content), ReproducibleEpoch))
+	require.NoError(t, w.Close())
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	f, err := unzipFile(archive, "boot/kernel")
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	dst, err := ioutil.TempFile(t.TempDir(), "member")
+	require.NoError(t, err)
+	defer dst.Close()
+	for _, dst := range []*os.File{nil, dst} {
+		m, err := readMember(f, hex.EncodeToString(sum[:]), dst)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), m.Size())
+		p := make([]byte, 100)
+		_, err = m.ReadAt(p, 1024*1024)
+		require.NoError(t, err)
+		require.Equal(t, content[1024*1024:1024*1024+100], p)
+	}
+
+	_, err = readMember(f, hex.EncodeToString(make([]byte, 32)), nil)
+	require.Error(t, err, "digest mismatch")
+}
+
+func TestReadMemberRecordedSize(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 1000)
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	fw, err := w.CreateHeader(&zip.FileHeader{Name: "boot/kernel", Method: zip.Store})
+	require.NoError(t, err)
+	_, err = fw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// record a smaller uncompressed size in the central directory
+	dir := bytes.Index(buf.Bytes(), []byte{0x50, 0x4b, 0x01, 0x02})
+	require.True(t, dir > 0)
+	binary.LittleEndian.PutUint32(buf.Bytes()[dir+24:], uint32(len(content)-10))
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	f, err := unzipFile(archive, "boot/kernel")
+	require.NoError(t, err)
+
+	_, err = readZipFile(f)
+	require.Error(t, err, "content larger than recorded")
+	_, err = readMember(f, "", nil)
+	require.Error(t, err, "content larger than recorded")
+
+	// the preallocation does not trust the recorded size
+	f.UncompressedSize64 = 1 << 40
+	require.Equal(t, maxPrealloc, newMemberBuffer(f).Cap())
+}
+
+func TestUnzipFileMissing(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	require.NoError(t, w.Close())
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	_, err = unzipFile(archive, "boot/kernel")
+	require.Error(t, err)
+}
+
+func TestCheckMemberName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"boot/kernel", true},
+		{"boot/", true},
+		{"manifest.json", true},
+		{"", false},
+		{"/boot/kernel", false},
+		{"../boot/kernel", false},
+		{"boot/../../kernel", false},
+		{"boot/./kernel", false},
+		{"boot//kernel", false},
+		{"boot\\kernel", false},
+		{"C:/boot/kernel", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMemberName(tt.name)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckArchive(t *testing.T) {
+	manifest := []byte(`{"version": 1, "kernel": "boot/kernel", "initramfs": "boot/initramfs"}`)
+	type member struct {
+		name    string
+		content []byte
+	}
+	valid := []member{
+		{"boot/", nil},
+		{"boot/kernel", []byte("kernel")},
+		{"boot/initramfs", []byte("initramfs")},
+		{ManifestName, manifest},
+	}
+
+	tests := []struct {
+		name    string
+		members []member
+		limits  ArchiveLimits
+		valid   bool
+	}{
+		{"valid", valid, ArchiveLimits{}, true},
+		{"duplicate", append(valid, member{"boot/kernel", []byte("other")}), ArchiveLimits{}, false},
+		{"unexpected member", append(valid, member{"boot/extra", nil}), ArchiveLimits{}, false},
+		{"unexpected directory", append(valid, member{"extra/", nil}), ArchiveLimits{}, false},
+		{"path traversal", append(valid, member{"../boot/kernel", nil}), ArchiveLimits{}, false},
+		{"absolute path", append(valid, member{"/boot/kernel", nil}), ArchiveLimits{}, false},
+		{"missing manifest", valid[:3], ArchiveLimits{}, false},
+		{"member size", valid, ArchiveLimits{MaxMemberSize: 8}, false},
+		{"total size", valid, ArchiveLimits{MaxTotalSize: 32}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := zip.NewWriter(buf)
+			for _, m := range tt.members {
+				require.NoError(t, zipFile(w, m.name, bytes.NewReader(m.content), ReproducibleEpoch))
+			}
+			require.NoError(t, w.Close())
+
+			err := checkArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), tt.limits)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckArchiveLayout(t *testing.T) {
+	manifest := []byte(`{"version": 1, "kernel": "boot/kernel", "initramfs": "boot/initramfs"}`)
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	require.NoError(t, zipFile(w, "boot/kernel", bytes.NewReader([]byte("kernel")), ReproducibleEpoch))
+	require.NoError(t, zipFile(w, "boot/initramfs", bytes.NewReader([]byte("initramfs")), ReproducibleEpoch))
+	require.NoError(t, zipFile(w, ManifestName, bytes.NewReader(manifest), ReproducibleEpoch))
+	require.NoError(t, w.Close())
+	archive := buf.Bytes()
+	require.NoError(t, checkArchive(bytes.NewReader(archive), int64(len(archive)), ArchiveLimits{}))
+
+	// the local header of the first member names another file
+	renamed := append([]byte{}, archive...)
+	i := bytes.Index(renamed, []byte("boot/kernel"))
+	copy(renamed[i:], "boot/kernex")
+
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{"prepended data", append([]byte("prefix"), archive...)},
+		{"trailing data", append(append([]byte{}, archive...), "suffix"...)},
+		{"local header name", renamed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Error(t, checkArchive(bytes.NewReader(tt.archive), int64(len(tt.archive)), ArchiveLimits{}))
+		})
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+	got, err := SourceDateEpoch()
+	require.NoError(t, err)
+	require.Equal(t, ReproducibleEpoch, got)
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	got, err = SourceDateEpoch()
+	require.NoError(t, err)
+	require.Equal(t, int64(1600000000), got.Unix())
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = SourceDateEpoch()
+	require.Error(t, err)
+}
@@ -7,22 +7,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/system-transparency/efivar/efivarfs"
+	"github.com/system-transparency/stboot/arm64"
 	"github.com/system-transparency/stboot/config"
 	"github.com/system-transparency/stboot/host"
 	"github.com/system-transparency/stboot/host/network"
+	"github.com/system-transparency/stboot/multiboot2"
 	"github.com/system-transparency/stboot/ospkg"
 	"github.com/system-transparency/stboot/stlog"
 	"github.com/system-transparency/stboot/trust"
@@ -44,9 +50,18 @@ var (
 const (
 	securityConfigFile = "/etc/security_configuration.json"
 	signingRootFile    = "/etc/ospkg_signing_root.pem"
+	signingCRLFile     = "/etc/ospkg_signing_crls.pem"
+	logKeyFile         = "/etc/ospkg_log_key.pub"
+	witnessKeysFile    = "/etc/ospkg_witness_keys.pub"
+	submitKeysFile     = "/etc/ospkg_submit_keys.pub"
+	tsaRootsFile       = "/etc/tsa_roots.pem"
 	httpsRootsFile     = "/etc/https_roots.pem"
+	tpmOwnerAuthFile   = "/etc/tpm_owner_auth"
 )
 
+// crlExt is the file extension of CRLs published next to a descriptor
+const crlExt = ".crl"
+
 const banner = `
   _____ _______   _____   ____   ____________
  / ____|__   __|  |  _ \ / __ \ / __ \__   __|
@@ -73,7 +88,18 @@ OS       //   //
 type ospkgSampl struct {
 	name       string
 	descriptor io.ReadCloser
-	archive    io.ReadCloser
+	// archive is the path of the archive file on STDATA
+	archive string
+	// isPrivate is set if archive is a copy in the work directory only
+	// stboot writes to, and hash is its SHA-256 hash computed while
+	// writing it
+	isPrivate bool
+	hash      [32]byte
+	// isDownload is set if archive has been downloaded, not taken from
+	// the cache
+	isDownload bool
+	// crls are fetched along with the descriptor, if any
+	crls []*pkix.CertificateList
 }
 
 func main() {
@@ -116,10 +142,10 @@ func main() {
 	scStr, _ := json.MarshalIndent(securityConfig, "", "  ")
 	stlog.Debug("Security configuration: %s", scStr)
 
-	// Signing root certificate
-	signingRoot, err := trust.LoadSigningRoot(signingRootFile)
+	// Signing root certificates
+	signingRoots, err := trust.LoadSigningRoots(signingRootFile)
 	if err != nil {
-		stlog.Error("load signing root: %v", err)
+		stlog.Error("load signing roots: %v", err)
 		host.Recover()
 	}
 
@@ -146,6 +172,16 @@ func main() {
 		stlog.Error("invalid partition: %v", err)
 		host.Recover()
 	}
+	// OS packages are processed on STDATA rather than in memory
+	workDir := filepath.Join(host.DataPartitionMountPoint, host.WorkDir)
+	if err = os.RemoveAll(workDir); err != nil {
+		stlog.Error("clear work directory: %v", err)
+		host.Recover()
+	}
+	if err = os.MkdirAll(workDir, 0700); err != nil {
+		stlog.Error("create work directory: %v", err)
+		host.Recover()
+	}
 
 	// Host configuration
 	var hostConfig = &config.HostCfg{}
@@ -186,6 +222,16 @@ func main() {
 		stlog.Debug("Boot mode %q not set, no HostConfig will be loaded", config.NetworkBoot)
 	}
 
+	// Host identity, matched against the host constraints of OS packages
+	hostInfo := ospkg.HostInfo{ID: hostConfig.ID}
+	if hostInfo.Product, err = host.SMBIOSProduct(); err != nil {
+		stlog.Debug("%v", err)
+	}
+	if hostInfo.CPUVendor, err = host.CPUVendor(); err != nil {
+		stlog.Debug("%v", err)
+	}
+	stlog.Debug("Host: ID %q, SMBIOS product %q, CPU vendor %q", hostInfo.ID, hostInfo.Product, hostInfo.CPUVendor)
+
 	// Boot order
 	var bootorder []string
 	if securityConfig.BootMode == config.LocalBoot {
@@ -209,6 +255,57 @@ func main() {
 		host.Recover()
 	}
 
+	// Signature verification policy
+	verifyOpts, err := ospkg.NewVerifyOptions(securityConfig, buildTime, signingRoots)
+	if err != nil {
+		stlog.Error("signature verification policy: %v", err)
+		host.Recover()
+	}
+	if securityConfig.EnforceCertValidity {
+		stlog.Debug("Signing certificates are checked against time source %q", securityConfig.TimeSource)
+	} else {
+		stlog.Debug("Validity periods of signing certificates are not checked")
+	}
+	// Expiry is checked against the latest of the system time and the
+	// trusted times seen so far: the system time fix and the timestamp
+	// tokens of verified OS packages. The time certificates are checked at
+	// may be earlier, e.g. the time fix itself, and would never let packages
+	// built after stboot expire. Without timestamps, whoever can set the RTC
+	// back can boot expired packages, so the check is best-effort.
+	trustedTime := buildTime
+	stlog.Debug("OS package expiry grace period %s", securityConfig.ExpiryGracePeriod)
+	verifyOpts.CRLs = loadCRLs()
+	if _, err := os.Stat(tsaRootsFile); err == nil {
+		verifyOpts.TSARoots, err = trust.LoadTSARoots(tsaRootsFile)
+		if err != nil {
+			stlog.Error("load TSA roots: %v", err)
+			host.Recover()
+		}
+	}
+	if verifyOpts.RequireTimestamp && len(verifyOpts.TSARoots) == 0 {
+		stlog.Error("timestamps are required but no TSA roots are present at %s", tsaRootsFile)
+		host.Recover()
+	}
+	if len(verifyOpts.TSARoots) == 0 {
+		stlog.Info("Without timestamps, OS package expiry is checked against the RTC, which is best-effort")
+	}
+	if securityConfig.RequireLogProof {
+		verifyOpts.Log, err = trust.LoadLogPolicy(logKeyFile, submitKeysFile, witnessKeysFile, securityConfig.WitnessQuorum)
+		if err != nil {
+			stlog.Error("transparency log policy: %v", err)
+			host.Recover()
+		}
+		stlog.Debug("OS packages must be logged, %d witness cosignature(s) required", securityConfig.WitnessQuorum)
+	}
+	archiveLimits := ospkg.ArchiveLimits{
+		MaxMemberSize: securityConfig.OSPkgMaxMemberSize,
+		MaxTotalSize:  securityConfig.OSPkgMaxSize,
+	}
+	if p := securityConfig.CmdlinePolicy; !p.IsZero() {
+		stlog.Debug("Kernel command lines are restricted: required %q, forbidden %q, forbidden patterns %q, max. length %d",
+			p.Required, p.Forbidden, p.ForbiddenPatterns, p.MaxLength)
+	}
+
 	// Network interface
 	if securityConfig.BootMode == config.NetworkBoot {
 		switch hostConfig.IPAddrMode {
@@ -235,6 +332,17 @@ func main() {
 		}
 	}
 
+	// Rollback protection
+	var minSecurityVersion uint64
+	if securityConfig.RollbackPolicy != config.RollbackDisabled {
+		minSecurityVersion, err = loadSecurityVersion()
+		if err != nil {
+			stlog.Error("load security version: %v", err)
+			host.Recover()
+		}
+		stlog.Debug("OS package security version high-water mark: %d", minSecurityVersion)
+	}
+
 	// TXT
 	stlog.Info("TXT self tests are not implementet yet.")
 	txtHostSuport := false
@@ -282,42 +390,122 @@ func main() {
 	//////////////////////
 	var bootImg boot.OSImage
 	var osp *ospkg.OSPackage
+	var bootSample *ospkgSampl
 	for _, sample := range ospkgSampls {
 		stlog.Info("Processing OS package %s", sample.name)
-		aBytes, err := ioutil.ReadAll(sample.archive)
+		if !sample.isPrivate {
+			// verify, measure and boot the same bytes, regardless of
+			// changes to the original file
+			p, hash, err := copyArchive(sample.archive)
+			if err != nil {
+				stlog.Debug("Copy archive: %v", err)
+				continue
+			}
+			sample.archive, sample.hash, sample.isPrivate = p, hash, true
+		}
+		archive, err := os.Open(sample.archive)
 		if err != nil {
-			stlog.Debug("Read archive: %v", err)
+			stlog.Debug("Open archive: %v", err)
+			continue
+		}
+		stat, err := archive.Stat()
+		if err != nil {
+			stlog.Debug("Open archive: %v", err)
+			archive.Close()
 			continue
 		}
 		dBytes, err := ioutil.ReadAll(sample.descriptor)
 		if err != nil {
-			stlog.Debug("Read archive: %v", err)
+			stlog.Debug("Read descriptor: %v", err)
+			archive.Close()
 			continue
 		}
-		osp, err = ospkg.NewOSPackage(aBytes, dBytes)
+		osp, err = ospkg.NewOSPackageWithHash(archive, stat.Size(), sample.hash, dBytes, archiveLimits)
 		if err != nil {
 			stlog.Debug("Create OS package: %v", err)
+			archive.Close()
 			continue
 		}
+		osp.ExtractTo(workDir)
 
 		////////////////////
 		// Verify OS package
 		////////////////////
 
-		//TODO: write ospkg.info method for debug output
+		if *doDebug {
+			if info, err := osp.Info(); err != nil {
+				stlog.Debug("OS package info: %v", err)
+			} else {
+				for _, line := range strings.Split(strings.TrimSuffix(info.String(), "\n"), "\n") {
+					stlog.Debug("%s", line)
+				}
+			}
+		}
 
-		n, valid, err := osp.Verify(signingRoot)
+		sampleOpts := verifyOpts
+		sampleOpts.CRLs = append(append([]*pkix.CertificateList{}, verifyOpts.CRLs...), sample.crls...)
+		res, err := osp.Verify(signingRoots, sampleOpts)
 		if err != nil {
 			stlog.Debug("Skip, error verifying OS package: %v", err)
+			osp.Close()
+			archive.Close()
 			continue
 		}
-		threshold := securityConfig.ValidSignatureThreshold
-		if valid < threshold {
-			stlog.Debug("Skip, not enough valid signatures: %d found, %d valid, %d required", n, valid, threshold)
+		stlog.Debug("Signatures: %d found, %d valid", res.Found, res.Valid)
+		for _, c := range res.Clauses {
+			stlog.Debug(" - %s", c)
+		}
+		if !res.Accepted() {
+			stlog.Debug("Skip, signature policy not satisfied")
+			osp.Close()
+			archive.Close()
 			continue
 		}
 
-		stlog.Debug("Signatures: %d found, %d valid, %d required", n, valid, threshold)
+		if securityConfig.RollbackPolicy != config.RollbackDisabled {
+			version, allowDowngrade := osp.SecurityVersion()
+			if version < minSecurityVersion {
+				switch {
+				case allowDowngrade:
+					stlog.Warn("OS package security version %d is below %d, downgrade allowed by signed metadata", version, minSecurityVersion)
+				case securityConfig.RollbackPolicy == config.RollbackEnforce:
+					stlog.Debug("Skip, security version %d is below %d", version, minSecurityVersion)
+					osp.Close()
+					archive.Close()
+					continue
+				default:
+					stlog.Warn("OS package security version %d is below %d", version, minSecurityVersion)
+				}
+			}
+		}
+		trustedTime = ospkg.ExpiryTime(trustedTime, res.LatestTimestamp())
+		now := time.Now()
+		expiryTime := ospkg.ExpiryTime(now, trustedTime)
+		if expiryTime.After(now) {
+			stlog.Warn("System time %s is before trusted time %s", now.UTC().Format(time.RFC3339), expiryTime.UTC().Format(time.RFC3339))
+		}
+		stlog.Debug("OS package expiry is checked at %s", expiryTime.UTC().Format(time.RFC3339))
+		if err := osp.CheckExpiry(expiryTime, securityConfig.ExpiryGracePeriod); err != nil {
+			stlog.Debug("Skip, %v", err)
+			osp.Close()
+			archive.Close()
+			continue
+		}
+		if expiry := osp.Expiry(); !expiry.IsZero() && expiryTime.After(expiry) {
+			stlog.Warn("OS package expired at %s, booting within grace period", expiry.UTC().Format(time.RFC3339))
+		}
+		if err := osp.CheckHost(hostInfo); err != nil {
+			stlog.Debug("Skip, %v", err)
+			osp.Close()
+			archive.Close()
+			continue
+		}
+		if err := osp.CheckCmdline(securityConfig.CmdlinePolicy); err != nil {
+			stlog.Debug("Skip, %v", err)
+			osp.Close()
+			archive.Close()
+			continue
+		}
 		stlog.Info("OS package passed verification")
 		stlog.Info(check)
 
@@ -327,6 +515,8 @@ func main() {
 		bootImg, err = osp.OSImage(txtHostSuport)
 		if err != nil {
 			stlog.Debug("Get boot image: %v", err)
+			osp.Close()
+			archive.Close()
 			continue
 		}
 		switch t := bootImg.(type) {
@@ -336,9 +526,15 @@ func main() {
 			}
 			stlog.Debug("Got linux boot image from os package")
 		case *boot.MultibootImage:
-			stlog.Debug("Got tboot multiboot image from os package")
+			stlog.Debug("Got multiboot image from os package")
+		case *multiboot2.Image:
+			stlog.Debug("Got multiboot2 image from os package")
+		case *arm64.Image:
+			stlog.Debug("Got arm64 image with device tree from os package")
 		default:
 			stlog.Debug("Skip, unknown boot image type %T", t)
+			osp.Close()
+			archive.Close()
 			continue
 		}
 
@@ -358,18 +554,24 @@ func main() {
 				stlog.Error("clear cache: %v", err)
 				host.Recover()
 			}
+			cached := filepath.Join(dir, sample.name)
 			for _, name := range names {
-				err = os.RemoveAll(filepath.Join(dir, name))
+				p := filepath.Join(dir, name)
+				if p == cached && !sample.isDownload {
+					continue
+				}
+				err = os.RemoveAll(p)
 				if err != nil {
 					stlog.Error("clear cache: %v", err)
 					host.Recover()
 				}
 			}
 			// write
-			p := filepath.Join(dir, sample.name)
-			if err := ioutil.WriteFile(p, aBytes, 0666); err != nil {
-				stlog.Error("write pkg cache: %v", err)
-				host.Recover()
+			if sample.isDownload {
+				if err := copyFile(sample.archive, cached); err != nil {
+					stlog.Error("write pkg cache: %v", err)
+					host.Recover()
+				}
 			}
 		}
 
@@ -383,11 +585,15 @@ func main() {
 		}
 		markCurrentOSpkg(currentPkgPath)
 
+		// the private copy of the archive stays open to be measured
+		bootSample = sample
 		break
 	} // end process-os-pkgs-loop
 	for _, s := range ospkgSampls {
-		s.archive.Close()
 		s.descriptor.Close()
+		if s != bootSample && s.isPrivate {
+			os.Remove(s.archive)
+		}
 	}
 	if bootImg == nil {
 		stlog.Error("No usable OS package")
@@ -399,22 +605,24 @@ func main() {
 	// TPM Measurement
 	///////////////////////
 	stlog.Info("Try TPM measurements")
-	var toBeMeasured = [][]byte{}
+	var toBeMeasured = []io.Reader{}
 
-	ospkgBytes, _ := osp.ArchiveBytes()
+	ospkgReader, _ := osp.ArchiveReader()
 	descriptorBytes, _ := osp.DescriptorBytes()
 	securityConfigBytes, _ := json.Marshal(securityConfig)
 
-	toBeMeasured = append(toBeMeasured, ospkgBytes)
-	stlog.Debug(" - OS package zip: %d bytes", len(ospkgBytes))
-	toBeMeasured = append(toBeMeasured, descriptorBytes)
+	toBeMeasured = append(toBeMeasured, ospkgReader)
+	stlog.Debug(" - OS package zip: %s", bootSample.archive)
+	toBeMeasured = append(toBeMeasured, bytes.NewReader(descriptorBytes))
 	stlog.Debug(" - OS package descriptor: %d bytes", len(descriptorBytes))
-	toBeMeasured = append(toBeMeasured, securityConfigBytes)
+	toBeMeasured = append(toBeMeasured, bytes.NewReader(securityConfigBytes))
 	stlog.Debug(" - Security configuration json: %d bytes", len(securityConfigBytes))
-	toBeMeasured = append(toBeMeasured, signingRoot.Raw)
-	stlog.Debug(" - Signing root cert ASN1 DER content: %d bytes", len(signingRoot.Raw))
+	for n, c := range signingRoots {
+		toBeMeasured = append(toBeMeasured, bytes.NewReader(c.Raw))
+		stlog.Debug(" - Signing root cert %d ASN1 DER content: %d bytes", n, len(c.Raw))
+	}
 	for n, c := range httpsRoots {
-		toBeMeasured = append(toBeMeasured, c.Raw)
+		toBeMeasured = append(toBeMeasured, bytes.NewReader(c.Raw))
 		stlog.Debug(" - HTTPS root %d: %d bytes", n, len(c.Raw))
 	}
 
@@ -430,6 +638,10 @@ func main() {
 		stlog.Info("Dryrun mode: will not boot")
 		return
 	}
+	if securityConfig.RollbackPolicy != config.RollbackDisabled {
+		version, _ := osp.SecurityVersion()
+		storeSecurityVersion(version, securityConfig.RollbackPolicy)
+	}
 	stlog.Info("Loading boot image into memory")
 	err = bootImg.Load(false)
 	if err != nil {
@@ -446,6 +658,56 @@ func main() {
 	host.Recover()
 }
 
+// loadSecurityVersion returns the OS package security version high-water
+// mark, which is the higher one of the values stored at STDATA and in the TPM.
+// Without a TPM 2.0, the value at STDATA is not protected from the booted OS.
+func loadSecurityVersion() (uint64, error) {
+	p := filepath.Join(host.DataPartitionMountPoint, host.SecurityVersionFile)
+	v, err := host.LoadSecurityVersion(p)
+	if err != nil {
+		return 0, err
+	}
+	t, err := host.ReadSecurityVersionTPM()
+	if errors.Is(err, host.ErrNoTPM) {
+		stlog.Warn("No TPM 2.0, the security version at STDATA is not protected from the booted OS")
+		return v, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("TPM: %v", err)
+	}
+	if t > v {
+		stlog.Warn("Security version at STDATA (%d) is below the one in the TPM (%d)", v, t)
+		return t, nil
+	}
+	return v, nil
+}
+
+// storeSecurityVersion raises the OS package security version high-water
+// mark to v and write-locks it in the TPM for the booted OS. Failures only
+// cause recovery if policy enforces rollback protection. STDATA is not
+// changed if the TPM fails, so later boots are not affected.
+func storeSecurityVersion(v uint64, policy config.RollbackPolicy) {
+	fail := stlog.Warn
+	if policy == config.RollbackEnforce {
+		fail = stlog.Error
+	}
+	ownerAuth, err := ioutil.ReadFile(tpmOwnerAuthFile)
+	if err != nil && !os.IsNotExist(err) {
+		fail("read TPM owner authorization: %v", err)
+		if policy == config.RollbackEnforce {
+			host.Recover()
+		}
+		return
+	}
+	p := filepath.Join(host.DataPartitionMountPoint, host.SecurityVersionFile)
+	if err := host.RaiseSecurityVersion(p, v, strings.TrimSuffix(string(ownerAuth), "\n")); err != nil {
+		fail("store security version: %v", err)
+		if policy == config.RollbackEnforce {
+			host.Recover()
+		}
+	}
+}
+
 func markCurrentOSpkg(pkgPath string) {
 	f := filepath.Join(host.DataPartitionMountPoint, host.CurrentOSPkgFile)
 	current := pkgPath + string('\n')
@@ -483,6 +745,10 @@ func doDownload(hc *config.HostCfg, useCache bool, insecure bool, roots *x509.Ce
 		stlog.Debug("Package descriptor:")
 		stlog.Debug("  Version: %d", descriptor.Version)
 		stlog.Debug("  Package URL: %s", descriptor.PkgURL)
+		if descriptor.Version >= ospkg.DescriptorVersion {
+			stlog.Debug("  Label: %s", descriptor.Label)
+			stlog.Debug("  Created: %s", time.Unix(descriptor.Created, 0).UTC())
+		}
 		stlog.Debug("  %d signature(s)", len(descriptor.Signatures))
 		stlog.Debug("  %d certificate(s)", len(descriptor.Certificates))
 		stlog.Info("Validating descriptor")
@@ -511,7 +777,7 @@ func doDownload(hc *config.HostCfg, useCache bool, insecure bool, roots *x509.Ce
 			continue
 		}
 
-		var aBytes []byte
+		var archive string
 		if useCache {
 			stlog.Debug("Look up OS package cache")
 			dir := filepath.Join(host.DataPartitionMountPoint, host.NetworkOSpkgCache)
@@ -522,45 +788,154 @@ func doDownload(hc *config.HostCfg, useCache bool, insecure bool, roots *x509.Ce
 			}
 			for _, fi := range fis {
 				if fi.Name() == filename {
-					p := filepath.Join(dir, filename)
-					stlog.Info("Using cached OS package %s", p)
-					aBytes, err = ioutil.ReadFile(p)
-					if err != nil {
-						stlog.Error("read cache: %v", err)
-						host.Recover()
-					}
+					archive = filepath.Join(dir, filename)
+					stlog.Info("Using cached OS package %s", archive)
 					break
 				}
 			}
-			if aBytes == nil {
+			if archive == "" {
 				stlog.Debug("%s is not cached", filename)
 			}
 		}
-		if aBytes == nil {
+		if archive == "" {
+			// download to the work directory, the package is cached
+			// after verification
 			stlog.Debug("Downloading %s", pkgURL.String())
-			aBytes, err = network.Download(pkgURL, roots, insecure, *doDebug)
+			archive, sample.hash, err = downloadArchive(pkgURL, roots, insecure)
 			if err != nil {
 				stlog.Debug("Skip %s: %v", url.String(), err)
 				continue
 			}
-			stlog.Debug("Content type: %s", http.DetectContentType(aBytes))
+			sample.isPrivate = true
+			sample.isDownload = true
 		}
 
+		sample.crls = downloadCRLs(url, roots, insecure)
+
 		// create sample
-		ar := uio.NewLazyOpener(func() (io.Reader, error) {
-			return bytes.NewReader(aBytes), nil
-		})
 		dr := uio.NewLazyOpener(func() (io.Reader, error) {
 			return bytes.NewReader(dBytes), nil
 		})
 		sample.name = filename
-		sample.archive = ar
+		sample.archive = archive
 		sample.descriptor = dr
 		return &sample, nil
 	}
 	return nil, fmt.Errorf("all provisioning URLs failed")
 }
 
+// loadCRLs returns the CRLs for signing certificates found at initramfs and
+// at STBOOT. Missing files are not an error, the security configuration
+// decides whether CRLs are required during verification.
+func loadCRLs() []*pkix.CertificateList {
+	var crls []*pkix.CertificateList
+	for _, p := range []string{signingCRLFile, filepath.Join(host.BootPartitionMountPoint, host.SigningCRLFile)} {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		c, err := trust.LoadCRLs(p)
+		if err != nil {
+			stlog.Warn("load CRLs from %s: %v", p, err)
+			continue
+		}
+		stlog.Debug("Loaded %d CRL(s) from %s", len(c), p)
+		crls = append(crls, c...)
+	}
+	return crls
+}
+
+// downloadCRLs fetches the CRLs published next to the descriptor at
+// descriptorURL. The CRL file has the name of the descriptor with the
+// extension .crl instead.
+func downloadCRLs(descriptorURL *url.URL, roots *x509.CertPool, insecure bool) []*pkix.CertificateList {
+	u := *descriptorURL
+	u.Path = strings.TrimSuffix(u.Path, ospkg.DescriptorExt) + crlExt
+	data, err := network.Download(&u, roots, insecure, *doDebug)
+	if err != nil {
+		stlog.Debug("No CRLs at %s: %v", u.String(), err)
+		return nil
+	}
+	crls, err := trust.ParseCRLs(data)
+	if err != nil {
+		stlog.Debug("Invalid CRLs at %s: %v", u.String(), err)
+		return nil
+	}
+	stlog.Debug("Downloaded %d CRL(s) from %s", len(crls), u.String())
+	return crls
+}
+
+// downloadArchive streams the content of u to a new file in the work
+// directory on STDATA and returns its path along with the SHA-256 hash
+// computed while downloading.
+func downloadArchive(u *url.URL, roots *x509.CertPool, insecure bool) (string, [32]byte, error) {
+	var hash [32]byte
+	f, err := ioutil.TempFile(filepath.Join(host.DataPartitionMountPoint, host.WorkDir), "download-*"+ospkg.OSPackageExt)
+	if err != nil {
+		return "", hash, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := network.DownloadTo(io.MultiWriter(f, h), u, roots, insecure, *doDebug)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", hash, err
+	}
+	copy(hash[:], h.Sum(nil))
+	stlog.Debug("Downloaded %d bytes, SHA256: %x", n, hash)
+	return f.Name(), hash, nil
+}
+
+// copyArchive copies the archive at src to a new file in the work directory
+// on STDATA and returns its path along with the SHA-256 hash computed while
+// copying. Unlike tmpfs, STDATA does not take memory away from the kernel
+// being loaded.
+func copyArchive(src string) (string, [32]byte, error) {
+	var hash [32]byte
+	in, err := os.Open(src)
+	if err != nil {
+		return "", hash, err
+	}
+	defer in.Close()
+	f, err := ioutil.TempFile(filepath.Join(host.DataPartitionMountPoint, host.WorkDir), "ospkg-*"+ospkg.OSPackageExt)
+	if err != nil {
+		return "", hash, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), in); err != nil {
+		os.Remove(f.Name())
+		return "", hash, err
+	}
+	copy(hash[:], h.Sum(nil))
+	return f.Name(), hash, nil
+}
+
+// copyFile copies src to dst and syncs dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
 func networkLoad(hc *config.HostCfg, useCache bool, httpsRoots []*x509.Certificate, insecure bool) (*ospkgSampl, error) {
 	stlog.Debug("Provisioning URLs:")
 	for _, u := range hc.ProvisioningURLs {
@@ -605,15 +980,12 @@ func diskLoad(names []string) ([]*ospkgSampl, error) {
 		if _, err := os.Stat(dp); err != nil {
 			return nil, err
 		}
-		ar := uio.NewLazyOpener(func() (io.Reader, error) {
-			return os.Open(ap)
-		})
 		dr := uio.NewLazyOpener(func() (io.Reader, error) {
 			return os.Open(dp)
 		})
 		s := &ospkgSampl{
 			name:       name,
-			archive:    ar,
+			archive:    ap,
 			descriptor: dr,
 		}
 		samples = append(samples, s)
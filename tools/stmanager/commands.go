@@ -5,25 +5,93 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
+	"os"
 	"time"
 
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/host"
 	"github.com/system-transparency/stboot/ospkg"
+	"github.com/system-transparency/stboot/trust"
 )
 
-func createCmd(out, label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs string, acms []string) error {
+func createCmd(out, label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs string, acms []string, meta packageMetadata, reproducible bool) error {
 	osp, err := ospkg.CreateOSPackage(label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs, acms)
 	if err != nil {
 		return err
 	}
+	return writeNewOSPackage(out, osp, meta, reproducible)
+}
+
+func createMultibootCmd(out, label, pkgURL, kernel, initramfs, cmdline string, mb *ospkg.MultibootConfig, meta packageMetadata, reproducible bool) error {
+	osp, err := ospkg.CreateMultibootOSPackage(label, pkgURL, kernel, initramfs, cmdline, mb)
+	if err != nil {
+		return err
+	}
+	return writeNewOSPackage(out, osp, meta, reproducible)
+}
+
+func createUKICmd(out, label, pkgURL, uki string, meta packageMetadata, reproducible bool) error {
+	osp, err := ospkg.CreateOSPackageFromUKI(label, pkgURL, uki)
+	if err != nil {
+		return err
+	}
+	return writeNewOSPackage(out, osp, meta, reproducible)
+}
+
+func createFromDirCmd(out, dir, pkgURL string, meta packageMetadata, reproducible bool) error {
+	osp, err := ospkg.CreateOSPackageFromDir(dir, pkgURL)
+	if err != nil {
+		return err
+	}
+	return writeNewOSPackage(out, osp, meta, reproducible)
+}
+
+// packageMetadata is the signed metadata set on newly created OS packages.
+type packageMetadata struct {
+	expires         time.Time
+	securityVersion uint64
+	allowDowngrade  bool
+	constraints     *ospkg.HostConstraints
+}
+
+// writeNewOSPackage sets the metadata of a newly created osp and writes its
+// archive and descriptor to out.
+func writeNewOSPackage(out string, osp *ospkg.OSPackage, meta packageMetadata, reproducible bool) error {
+	if reproducible {
+		t, err := ospkg.SourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		if err := osp.MakeReproducible(t); err != nil {
+			return err
+		}
+	}
+	if err := osp.SetSecurityVersion(meta.securityVersion, meta.allowDowngrade); err != nil {
+		return err
+	}
+	if err := osp.SetHostConstraints(meta.constraints); err != nil {
+		return err
+	}
+	if err := osp.SetExpiry(meta.expires); err != nil {
+		return err
+	}
 
 	archive, err := osp.ArchiveBytes()
 	if err != nil {
@@ -43,58 +111,427 @@ func createCmd(out, label, pkgURL, kernel, initramfs, cmdline, tboot, tbootArgs
 	return nil
 }
 
-func signCmd(pkgPath, privKeyPath, certPath string) error {
+func signCmd(pkgPath, privKeyPath, certPath, chainPath, tsaURL, format, provenancePath string) error {
+	osp, archive, err := openOSPackage(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	switch format {
+	case "":
+		if provenancePath != "" && !osp.IsDSSE() {
+			return errors.New("provenance requires the dsse format")
+		}
+	case "json":
+		if osp.IsDSSE() {
+			return errors.New("cannot convert a DSSE descriptor to json format")
+		}
+		if provenancePath != "" {
+			return errors.New("provenance requires the dsse format")
+		}
+	case "dsse":
+	default:
+		return fmt.Errorf("unknown descriptor format %q", format)
+	}
+	if format == "dsse" && (!osp.IsDSSE() || provenancePath != "") {
+		var provenance []byte
+		if provenancePath != "" {
+			provenance, err = ioutil.ReadFile(provenancePath)
+			if err != nil {
+				return err
+			}
+		}
+		if err := osp.UseDSSE(provenance); err != nil {
+			return err
+		}
+	}
+
+	privKey, err := loadPEM(privKeyPath)
+	if err != nil {
+		return err
+	}
+
+	cert, err := loadPEM(certPath)
+	if err != nil {
+		return err
+	}
+
+	var chain []*pem.Block
+	if chainPath != "" {
+		chain, err = loadPEMBundle(chainPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = osp.Sign(privKey, cert, chain...)
+	if err != nil {
+		return err
+	}
+	if tsaURL != "" {
+		if err := osp.TimestampSignature(trust.HTTPTSA{URL: tsaURL}); err != nil {
+			return err
+		}
+	}
+
+	descriptor, err := osp.DescriptorBytes()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pkgPath+ospkg.DescriptorExt, descriptor, 0666); err != nil {
+		return err
+	}
+	return nil
+}
+
+func rebuildCheckCmd(pkgPath, dir string) error {
+	osp, f, err := openOSPackage(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t, err := ospkg.SourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	rebuilt, err := osp.Rebuild(dir, t)
+	if err != nil {
+		return err
+	}
 	archive, err := ioutil.ReadFile(pkgPath + ospkg.OSPackageExt)
 	if err != nil {
 		return err
 	}
-	descriptor, err := ioutil.ReadFile(pkgPath + ospkg.DescriptorExt)
+
+	if bytes.Equal(archive, rebuilt) {
+		fmt.Printf("OK: archive matches rebuild, SHA-256 %x\n", sha256.Sum256(archive))
+		return nil
+	}
+	fmt.Printf("Archive SHA-256 %x, rebuild SHA-256 %x\n", sha256.Sum256(archive), sha256.Sum256(rebuilt))
+	diffs, err := diffArchives(archive, rebuilt)
 	if err != nil {
 		return err
 	}
-	osp, err := ospkg.NewOSPackage(archive, descriptor)
+	for _, d := range diffs {
+		fmt.Printf(" - %s\n", d)
+	}
+	return errors.New("archive does not match rebuild")
+}
+
+// diffArchives lists the differences between the members of two zip
+// archives.
+func diffArchives(a, b []byte) ([]string, error) {
+	za, err := zip.NewReader(bytes.NewReader(a), int64(len(a)))
+	if err != nil {
+		return nil, err
+	}
+	zb, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	rebuilt := make(map[string]*zip.File)
+	for _, f := range zb.File {
+		rebuilt[f.Name] = f
+	}
+	var diffs []string
+	for i, f := range za.File {
+		r, ok := rebuilt[f.Name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: missing in rebuild", f.Name))
+			continue
+		}
+		delete(rebuilt, f.Name)
+		switch {
+		case f.CRC32 != r.CRC32 || f.UncompressedSize64 != r.UncompressedSize64:
+			diffs = append(diffs, fmt.Sprintf("%s: content differs", f.Name))
+		case !f.Modified.Equal(r.Modified):
+			diffs = append(diffs, fmt.Sprintf("%s: modification time %s, rebuild %s", f.Name, f.Modified.UTC(), r.Modified.UTC()))
+		case f.Mode() != r.Mode():
+			diffs = append(diffs, fmt.Sprintf("%s: mode %s, rebuild %s", f.Name, f.Mode(), r.Mode()))
+		case f.Method != r.Method || f.CompressedSize64 != r.CompressedSize64:
+			diffs = append(diffs, fmt.Sprintf("%s: compression differs", f.Name))
+		case i >= len(zb.File) || zb.File[i].Name != f.Name:
+			diffs = append(diffs, fmt.Sprintf("%s: position differs", f.Name))
+		}
+	}
+	for _, f := range zb.File {
+		if _, ok := rebuilt[f.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("%s: only in rebuild", f.Name))
+		}
+	}
+	if len(diffs) == 0 {
+		diffs = append(diffs, "archive metadata differs")
+	}
+	return diffs, nil
+}
+
+func upgradeCmd(pkgPath string) error {
+	osp, archive, err := openOSPackage(pkgPath)
 	if err != nil {
 		return err
 	}
+	defer archive.Close()
 
-	privKey, err := loadPEM(privKeyPath)
+	dropped, err := osp.UpgradeDescriptor()
 	if err != nil {
 		return err
 	}
+	if dropped > 0 {
+		log.Printf("Dropped %d signature(s) of the old descriptor, the OS package needs to be signed again", dropped)
+	}
 
-	cert, err := loadPEM(certPath)
+	descriptor, err := osp.DescriptorBytes()
 	if err != nil {
 		return err
 	}
+	return ioutil.WriteFile(pkgPath+ospkg.DescriptorExt, descriptor, 0666)
+}
 
-	err = osp.Sign(privKey, cert)
+func logMessageCmd(pkgPath string) error {
+	osp, archive, err := openOSPackage(pkgPath)
 	if err != nil {
 		return err
 	}
+	defer archive.Close()
 
-	descriptor, err = osp.DescriptorBytes()
+	message, err := osp.LogMessage()
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(pkgPath+ospkg.DescriptorExt, descriptor, 0666); err != nil {
+	fmt.Printf("%x\n", message)
+	return nil
+}
+
+func attachProofCmd(pkgPath, proofPath, logKeyPath string) error {
+	osp, archive, err := openOSPackage(pkgPath)
+	if err != nil {
 		return err
 	}
+	defer archive.Close()
+
+	logKeys, err := trust.LoadLogKeys(logKeyPath)
+	if err != nil {
+		return fmt.Errorf("load log key: %v", err)
+	}
+	if len(logKeys) != 1 {
+		return fmt.Errorf("expected exactly one log key, found %d", len(logKeys))
+	}
+	proofBytes, err := ioutil.ReadFile(proofPath)
+	if err != nil {
+		return err
+	}
+	proof, err := trust.ParseSigsumProof(proofBytes, logKeys[0])
+	if err != nil {
+		return err
+	}
+	if err := osp.AttachLogProof(proof); err != nil {
+		return err
+	}
+
+	descriptor, err := osp.DescriptorBytes()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pkgPath+ospkg.DescriptorExt, descriptor, 0666)
+}
+
+// verifyArgs are the inputs stboot takes from its initramfs and
+// configuration to verify OS packages.
+type verifyArgs struct {
+	rootsPath       string
+	threshold       uint
+	securityCfgPath string
+	crlPaths        []string
+	tsaRootsPath    string
+	logKeyPath      string
+	submitKeysPath  string
+	witnessKeysPath string
+	timeFixPath     string
+}
+
+func verifyCmd(pkgPath string, args verifyArgs) error {
+	roots, err := trust.LoadSigningRoots(args.rootsPath)
+	if err != nil {
+		return err
+	}
+
+	cfg := &config.SecurityCfg{ValidSignatureThreshold: 1}
+	if args.securityCfgPath != "" {
+		f, err := os.Open(args.securityCfgPath)
+		if err != nil {
+			return err
+		}
+		cfg, err = config.LoadSecurityConfigFromJSON(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("security configuration: %v", err)
+		}
+	}
+	if args.threshold > 0 {
+		cfg.ValidSignatureThreshold = args.threshold
+	}
+
+	// stboot checks signing certificates at the system time fix, if
+	// configured, not at the current time
+	var timeFix time.Time
+	if args.timeFixPath != "" {
+		timeFix, err = host.LoadSystemTimeFix(args.timeFixPath)
+		if err != nil {
+			return fmt.Errorf("load system time fix: %v", err)
+		}
+	}
+	if cfg.TimeSource == config.TimeFixTime && timeFix.IsZero() {
+		return errors.New("the security configuration uses the system time fix but none is given")
+	}
+	vopts, err := ospkg.NewVerifyOptions(cfg, timeFix, roots)
+	if err != nil {
+		return fmt.Errorf("signature verification policy: %v", err)
+	}
+	for _, p := range args.crlPaths {
+		crls, err := trust.LoadCRLs(p)
+		if err != nil {
+			return fmt.Errorf("load CRLs from %s: %v", p, err)
+		}
+		vopts.CRLs = append(vopts.CRLs, crls...)
+	}
+	if args.tsaRootsPath != "" {
+		vopts.TSARoots, err = trust.LoadTSARoots(args.tsaRootsPath)
+		if err != nil {
+			return fmt.Errorf("load TSA roots: %v", err)
+		}
+	}
+	if vopts.RequireTimestamp && len(vopts.TSARoots) == 0 {
+		return errors.New("timestamps are required but no TSA roots are given")
+	}
+	if cfg.RequireLogProof {
+		if args.logKeyPath == "" {
+			return errors.New("log proofs are required but no log key is given")
+		}
+		if args.submitKeysPath == "" {
+			return errors.New("log proofs are required but no submitter keys are given")
+		}
+		if cfg.WitnessQuorum > 0 && args.witnessKeysPath == "" {
+			return errors.New("witness cosignatures are required but no witness keys are given")
+		}
+		vopts.Log, err = trust.LoadLogPolicy(args.logKeyPath, args.submitKeysPath, args.witnessKeysPath, cfg.WitnessQuorum)
+		if err != nil {
+			return fmt.Errorf("transparency log policy: %v", err)
+		}
+	}
+
+	archive, err := os.Open(pkgPath + ospkg.OSPackageExt)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	stat, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+	descriptor, err := ioutil.ReadFile(pkgPath + ospkg.DescriptorExt)
+	if err != nil {
+		return err
+	}
+	limits := ospkg.ArchiveLimits{MaxMemberSize: cfg.OSPkgMaxMemberSize, MaxTotalSize: cfg.OSPkgMaxSize}
+	osp, err := ospkg.NewOSPackageWithLimits(archive, stat.Size(), descriptor, limits)
+	if err != nil {
+		return fmt.Errorf("REJECTED: %v", err)
+	}
+
+	res, err := osp.Verify(roots, vopts)
+	if err != nil {
+		return fmt.Errorf("REJECTED: %v", err)
+	}
+	fmt.Printf("Signatures: %d found, %d valid\n", res.Found, res.Valid)
+	for _, s := range res.Signatures {
+		fmt.Printf(" - %s\n", s)
+	}
+	fmt.Println("Signature policy:")
+	for _, c := range res.Clauses {
+		fmt.Printf(" - %s\n", c)
+	}
+	if !res.Accepted() {
+		return errors.New("REJECTED: signature policy not satisfied")
+	}
+	if _, err := osp.OSImage(false); err != nil {
+		return fmt.Errorf("REJECTED: %v", err)
+	}
+	if err := osp.CheckCmdline(cfg.CmdlinePolicy); err != nil {
+		return fmt.Errorf("REJECTED: %v", err)
+	}
+	// like stboot, expiry is checked against the latest of the current time
+	// and the trusted times rather than the time certificates are checked at
+	expiryTime := ospkg.ExpiryTime(time.Now(), timeFix, res.LatestTimestamp())
+	if err := osp.CheckExpiry(expiryTime, cfg.ExpiryGracePeriod); err != nil {
+		return fmt.Errorf("REJECTED: %v", err)
+	}
+	if expiry := osp.Expiry(); !expiry.IsZero() {
+		fmt.Printf("Expires %s, checked at %s\n", expiry.UTC().Format(time.RFC3339), expiryTime.UTC().Format(time.RFC3339))
+		if res.LatestTimestamp().IsZero() {
+			fmt.Println("Expiry is checked against the system clock only, which is best-effort: stboot boots expired packages if the RTC is set back")
+		}
+	}
+	version, allowDowngrade := osp.SecurityVersion()
+	fmt.Printf("Security version %d, downgrade allowed: %t\n", version, allowDowngrade)
+	fmt.Printf("Host constraints: %s\n", osp.HostConstraints())
+	fmt.Println("OK: OS package passed verification")
 	return nil
 }
 
-func showCmd(ospkgPath string) error {
-	log.Print("Not yet implemented")
+func unpackCmd(pkgPath, dir string) error {
+	osp, archive, err := openOSPackage(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return osp.Unpack(dir)
+}
+
+func showCmd(pkgPath string, asJSON bool) error {
+	osp, archive, err := openOSPackage(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	info, err := osp.Info()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	fmt.Print(info)
 	return nil
 }
 
-func keygenCmd(rootCertPath, rootKeyPath string, validFrom, validUntil time.Time, certOut, keyOut string) error {
+// Key types supported by keygenCmd
+const (
+	KeyTypeED25519   = "ed25519"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeRSA2048   = "rsa2048"
+	KeyTypeRSA4096   = "rsa4096"
+)
+
+// keygenCmd writes a new key and certificate, self signed if rootCertPath or
+// rootKeyPath is empty. Certificates signed by a root get the extended key
+// usages ekus.
+func keygenCmd(keyType, rootCertPath, rootKeyPath string, validFrom, validUntil time.Time, ekus []x509.ExtKeyUsage, certOut, keyOut string) error {
 	var newCert *x509.Certificate
-	var newPriv ed25519.PrivateKey
+	var newPriv crypto.Signer
 	var err error
 
 	if rootCertPath == "" || rootKeyPath == "" {
 		// self signed certificate
-		newCert, newPriv, err = newCertWithED25519Keys(nil, nil, validFrom, validUntil)
+		newCert, newPriv, err = newCertWithKeys(keyType, nil, nil, validFrom, validUntil, nil)
 		if err != nil {
 			return fmt.Errorf("keygen: %v", err)
 		}
@@ -118,7 +555,7 @@ func keygenCmd(rootCertPath, rootKeyPath string, validFrom, validUntil time.Time
 			return fmt.Errorf("keygen: parsing root key failed: %v", err)
 		}
 
-		newCert, newPriv, err = newCertWithED25519Keys(rootCert, &rootKey, validFrom, validUntil)
+		newCert, newPriv, err = newCertWithKeys(keyType, rootCert, &rootKey, validFrom, validUntil, ekus)
 		if err != nil {
 			return fmt.Errorf("keygen: %v", err)
 		}
@@ -150,7 +587,7 @@ func keygenCmd(rootCertPath, rootKeyPath string, validFrom, validUntil time.Time
 	return nil
 }
 
-func newCertWithED25519Keys(rootCert *x509.Certificate, rootKey *interface{}, validFrom, validUntil time.Time) (*x509.Certificate, ed25519.PrivateKey, error) {
+func newCertWithKeys(keyType string, rootCert *x509.Certificate, rootKey *interface{}, validFrom, validUntil time.Time, ekus []x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer, error) {
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -165,21 +602,23 @@ func newCertWithED25519Keys(rootCert *x509.Certificate, rootKey *interface{}, va
 		NotAfter:     validUntil,
 	}
 
-	newPub, newPriv, err := ed25519.GenerateKey(rand.Reader)
+	newPriv, err := generateKey(keyType)
 	if err != nil {
 		return nil, nil, fmt.Errorf("new cert: failed to generate key: %v", err)
 	}
+	newPub := newPriv.Public()
 
 	var certBytes []byte
 
 	if rootCert == nil || rootKey == nil {
 		// creating self signed certificate
-		template.KeyUsage |= x509.KeyUsageCertSign
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 		template.BasicConstraintsValid = true
 		template.IsCA = true
 		certBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, newPub, newPriv)
 	} else {
 		// creating certificate signed by root
+		template.ExtKeyUsage = ekus
 		certBytes, err = x509.CreateCertificate(rand.Reader, &template, rootCert, newPub, *rootKey)
 	}
 	if err != nil {
@@ -194,6 +633,50 @@ func newCertWithED25519Keys(rootCert *x509.Certificate, rootKey *interface{}, va
 	return newCert, newPriv, nil
 }
 
+// openOSPackage loads the OS package at pkgPath without reading the archive
+// into memory. The returned file backs the OS package and needs to be closed
+// by the caller once the OS package is no longer used.
+func openOSPackage(pkgPath string) (*ospkg.OSPackage, *os.File, error) {
+	archive, err := os.Open(pkgPath + ospkg.OSPackageExt)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := archive.Stat()
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+	descriptor, err := ioutil.ReadFile(pkgPath + ospkg.DescriptorExt)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+	osp, err := ospkg.NewOSPackageFromReaderAt(archive, stat.Size(), descriptor)
+	if err != nil {
+		archive.Close()
+		return nil, nil, err
+	}
+	return osp, archive, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeED25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
 func loadPEM(path string) (*pem.Block, error) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -210,6 +693,31 @@ func loadPEM(path string) (*pem.Block, error) {
 	return block, nil
 }
 
+// loadPEMBundle returns all certificate PEM blocks of the file named by path.
+func loadPEMBundle(path string) ([]*pem.Block, error) {
+	rest, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block of type %s", block.Type)
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("no PEM block found")
+	}
+	return blocks, nil
+}
+
 func writePEM(b *pem.Block, path string) error {
 	pemBytes := pem.EncodeToMemory(b)
 	return ioutil.WriteFile(path, pemBytes, 0666)
@@ -0,0 +1,74 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/config"
+	"github.com/system-transparency/stboot/ospkg"
+	"github.com/system-transparency/stboot/trust"
+)
+
+// writeTestBootFiles writes a minimal x86 bzImage and newc initramfs to dir.
+func writeTestBootFiles(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	kernel := make([]byte, 0x238)
+	binary.LittleEndian.PutUint16(kernel[0x1FE:], 0xAA55)
+	copy(kernel[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(kernel[0x206:], 0x020F)
+	binary.LittleEndian.PutUint16(kernel[0x236:], 1)
+	initramfs := "070701" + strings.Repeat("0", 104)
+
+	k, i := filepath.Join(dir, "kernel"), filepath.Join(dir, "initramfs")
+	require.NoError(t, ioutil.WriteFile(k, kernel, 0644))
+	require.NoError(t, ioutil.WriteFile(i, []byte(initramfs), 0644))
+	return k, i
+}
+
+func TestKeygenExtKeyUsage(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	from, until := now.Add(-time.Hour), now.Add(time.Hour)
+	rootCert, rootKey := filepath.Join(dir, "root.pem"), filepath.Join(dir, "root.key")
+	require.NoError(t, keygenCmd(KeyTypeED25519, "", "", from, until, nil, rootCert, rootKey))
+	roots, err := trust.LoadSigningRoots(rootCert)
+	require.NoError(t, err)
+	kernel, initramfs := writeTestBootFiles(t, dir)
+
+	cfg := &config.SecurityCfg{
+		ValidSignatureThreshold: 1,
+		TimeSource:              config.RTCTime,
+		SigningKeyUsage:         x509.KeyUsageDigitalSignature,
+		SigningExtKeyUsage:      []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	opts, err := ospkg.NewVerifyOptions(cfg, time.Time{}, roots)
+	require.NoError(t, err)
+
+	for _, keyType := range []string{KeyTypeED25519, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeRSA2048} {
+		for _, ekus := range [][]x509.ExtKeyUsage{{x509.ExtKeyUsageCodeSigning}, nil} {
+			cert, key := filepath.Join(dir, "signing.pem"), filepath.Join(dir, "signing.key")
+			require.NoError(t, keygenCmd(keyType, rootCert, rootKey, from, until, ekus, cert, key))
+			certBlock, err := loadPEM(cert)
+			require.NoError(t, err)
+			keyBlock, err := loadPEM(key)
+			require.NoError(t, err)
+
+			osp, err := ospkg.CreateOSPackage("test", "", kernel, initramfs, "", "", "", nil)
+			require.NoError(t, err)
+			require.NoError(t, osp.Sign(keyBlock, certBlock))
+			res, err := osp.Verify(roots, opts)
+			require.NoError(t, err)
+			require.Equal(t, ekus != nil, res.Accepted(), "%s with extended key usages %v", keyType, ekus)
+		}
+	}
+}
@@ -9,6 +9,7 @@ package main
 // remote provisioning server.
 
 import (
+	"crypto/x509"
 	"fmt"
 	"log"
 	"os"
@@ -16,6 +17,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/system-transparency/stboot/config"
 	"github.com/system-transparency/stboot/ospkg"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -42,22 +44,72 @@ var (
 	createOut       = create.Flag("out", "OS package output path. Two files will be created: the archive ZIP file and the descriptor JSON file. A directory or a filename can be passed. In case of a filenema the file extensions will be set propperly. Default name is "+DefaultOutName).String()
 	createLabel     = create.Flag("label", "Short description of the boot configuration. Defaults to 'System Tarnsparency OS package <kernel>'").String()
 	createPkgURL    = create.Flag("url", "URL of the OS package zip file in case of network boot mode").String()
-	createKernel    = create.Flag("kernel", "Operation system kernel").Required().ExistingFile()
+	createKernel    = create.Flag("kernel", "Operation system kernel. Required unless --from-dir or --uki is set").ExistingFile()
 	createInitramfs = create.Flag("initramfs", "Operation system initramfs").ExistingFile()
 	createCmdline   = create.Flag("cmd", "Kernel command line").String()
 	createTboot     = create.Flag("tboot", "Pre-execution module that sets up TXT").ExistingFile()
 	createTbootArgs = create.Flag("tcmd", "tboot command line").String()
 	createACM       = create.Flag("acm", "Authenticated Code Module for TXT. This can be a path to single ACM or directory containig multiple ACMs.").ExistingFileOrDir()
+	createSecVer    = create.Flag("securityVersion", "Security version for rollback protection. stboot can be configured to refuse OS packages with a version lower than the highest one booted before").Uint64()
+	createDowngrade = create.Flag("allowDowngrade", "Allow booting this OS package even if its security version is lower than the highest one booted before").Bool()
+	createExpires   = create.Flag("expires", "Date formatted as '"+DateFormat+"' after which stboot refuses the OS package, extended by the grace period of its security configuration. Defaults to no expiry").String()
+	createHostIDs   = create.Flag("host-id", "Restrict booting to hosts with this host configuration ID. Shell patterns like 'rack1-*' are allowed. Can be repeated").Strings()
+	createProducts  = create.Flag("smbios-product", "Restrict booting to hosts with this SMBIOS product name. Can be repeated").Strings()
+	createCPUVendor = create.Flag("cpu-vendor", "Restrict booting to hosts with this CPU vendor, e.g. GenuineIntel or AuthenticAMD. Can be repeated").Strings()
+	createMBKernel  = create.Flag("mb-kernel", "Multiboot kernel, e.g. the Xen hypervisor, booted instead of the operating system kernel. The operating system kernel and initramfs may be passed as modules").ExistingFile()
+	createMBCmdline = create.Flag("mb-cmd", "Multiboot kernel command line").String()
+	createMBProto   = create.Flag("mb-protocol", "Protocol used to boot the multiboot kernel. Defaults to "+ospkg.MultibootV1).Enum(ospkg.MultibootV1, ospkg.MultibootV2)
+	createMBModules = create.Flag("module", "Multiboot module in the form 'FILE [CMDLINE]'. Can be repeated, modules are passed in order").Strings()
+	createUKI       = create.Flag("uki", "Unified Kernel Image containing kernel, initramfs and command line. Replaces --kernel, --initramfs and --cmd").ExistingFile()
+	createFromDir   = create.Flag("from-dir", "Directory containing a manifest and the boot files, as written by 'unpack'. Replaces the flags defining the content of the OS package").ExistingDir()
+	createRepro     = create.Flag("reproducible", "Create a byte-for-byte reproducible OS package. Archive timestamps and the creation time are taken from SOURCE_DATE_EPOCH, or set to 1980-01-01 if unset").Bool()
+
+	rebuildCheck          = kingpin.Command("rebuild-check", "Check that the archive of the provided OS package matches a reproducible rebuild, see 'create --reproducible'. The manifest of the OS package is reused, so OS packages of any kind can be checked")
+	rebuildCheckFromDir   = rebuildCheck.Flag("from-dir", "Directory containing the independently built boot files at the paths given by the manifest, as written by 'unpack'. Defaults to the boot files of the OS package").ExistingDir()
+	rebuildCheckOSPackage = rebuildCheck.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
 
 	sign            = kingpin.Command("sign", "Sign the provided OS package")
 	signPrivKeyFile = sign.Flag("key", "Private key for signing").Required().ExistingFile()
 	signCertFile    = sign.Flag("cert", "Certificate corresponding to the private key").Required().ExistingFile()
+	signChainFile   = sign.Flag("chain", "PEM bundle of intermediate certificates between the certificate and the signing root").ExistingFile()
+	signTSA         = sign.Flag("tsa", "URL of a RFC 3161 time stamping authority to timestamp the signature").String()
+	signFormat      = sign.Flag("format", "Descriptor format: 'json' or 'dsse' for a DSSE envelope with an in-toto statement. The format of an unsigned descriptor can be changed. Defaults to the current format").String()
+	signProvenance  = sign.Flag("provenance", "In-toto statement, e.g. SLSA provenance, whose predicate is included in a DSSE descriptor").ExistingFile()
 	signOSPackage   = sign.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
 
-	show          = kingpin.Command("show", "Unpack OS package  file into directory")
-	showOSPackage = show.Arg("OS package", "Archive containing the boot files").Required().ExistingFile()
+	upgrade          = kingpin.Command("upgrade", "Upgrade the descriptor of the provided OS package to the current version. Existing signatures are dropped")
+	upgradeOSPackage = upgrade.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+
+	logMessage          = kingpin.Command("log-message", "Print the hex encoded message to be submitted to a Sigsum log for the provided OS package")
+	logMessageOSPackage = logMessage.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+
+	attachProof          = kingpin.Command("attach-proof", "Attach a Sigsum log proof to the descriptor of the provided OS package")
+	attachProofFile      = attachProof.Flag("proof", "Sigsum proof of the message of the OS package, as written by sigsum-submit").Required().ExistingFile()
+	attachProofLogKey    = attachProof.Flag("log-key", "Key of the Sigsum log the proof was obtained from").Required().ExistingFile()
+	attachProofOSPackage = attachProof.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+
+	verify            = kingpin.Command("verify", "Verify the provided OS package the way stboot does. Exits non-zero if stboot would reject it")
+	verifyRoots       = verify.Flag("root", "PEM bundle of signing root certificates").Required().ExistingFile()
+	verifyThreshold   = verify.Flag("threshold", "Minimum number of valid signatures. Overrides the security configuration. Defaults to 1 without security configuration").Uint()
+	verifySecurityCfg = verify.Flag("security-config", "Security configuration as used by stboot").ExistingFile()
+	verifyCRLs        = verify.Flag("crl", "File containing CRLs of the signing roots or intermediates. Can be repeated").ExistingFiles()
+	verifyTSARoots    = verify.Flag("tsa-roots", "PEM bundle of time stamping authority root certificates").ExistingFile()
+	verifyLogKey      = verify.Flag("log-key", "Transparency log key, required if the security configuration requires log proofs").ExistingFile()
+	verifySubmitKeys  = verify.Flag("submit-keys", "Keys of the submitters of log leaves, required if the security configuration requires log proofs").ExistingFile()
+	verifyWitnessKeys = verify.Flag("witness-keys", "Witness keys, required if the security configuration requires witness cosignatures").ExistingFile()
+	verifyTimeFix     = verify.Flag("time-fix", "System time fix file as installed on STDATA, required if the security configuration uses it as time source").ExistingFile()
+	verifyOSPackage   = verify.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+
+	unpack          = kingpin.Command("unpack", "Write the manifest and the boot files of the provided OS package to a directory. Nothing is verified")
+	unpackOSPackage = unpack.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+	unpackDir       = unpack.Arg("dir", "Output directory").Required().String()
 
-	keygen           = kingpin.Command("keygen", "Generate certificates for signing OS packages using ED25529 keys")
+	show          = kingpin.Command("show", "Show the content of the provided OS package. Nothing is verified")
+	showJSON      = show.Flag("json", "Print JSON instead of text").Bool()
+	showOSPackage = show.Arg("OS package", "OS package archive or descriptor file. Both need to be present").Required().ExistingFile()
+
+	keygen           = kingpin.Command("keygen", "Generate certificates for signing OS packages using ED25519, ECDSA or RSA keys")
+	keygenKeyType    = kingpin.Flag("keyType", "Type of the generated key").Default(KeyTypeED25519).Enum(KeyTypeED25519, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeRSA2048, KeyTypeRSA4096)
 	keygenRootCert   = kingpin.Flag("rootCert", "Root certificate in PEM format to sign the new certificate. Ignored if --isCA is set").ExistingFile()
 	keygenRootKey    = kingpin.Flag("rootKey", "Root key in PEM format to sign the new certificate. Ignored if --isCA is set").ExistingFile()
 	keygenIsCA       = kingpin.Flag("isCA", "Generate a self signed root certificate.").Bool()
@@ -65,6 +117,7 @@ var (
 	keygenValidUntil = kingpin.Flag("validUntil", "Date formatted as '"+DateFormat+"'. Defaults to time of creation + "+DefaultValidityPeriod.String()).String()
 	keygenCertOut    = kingpin.Flag("certOut", "Output certificate file. Defaults to "+DefaultCertName+" or "+DefaultRootCertName+" if --isCA is set.").String()
 	keygenKeyOut     = kingpin.Flag("keyOut", "Output key file. Defaults to "+DefaultKeyName+" or "+DefaultRootKeyName+" if --isCA is set.").String()
+	keygenEKU        = kingpin.Flag("eku", "Extended key usage of the new certificate as named in the security configuration, can be repeated. Ignored if --isCA is set").Default("codeSigning").Strings()
 )
 
 func main() {
@@ -80,14 +133,87 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		label := parseLabel(*createLabel)
+		expires, err := parseExpires(*createExpires)
+		if err != nil {
+			log.Fatalf("failed to parse 'expires' date: %v, try --help", err)
+		}
+		meta := packageMetadata{
+			expires:         expires,
+			securityVersion: *createSecVer,
+			allowDowngrade:  *createDowngrade,
+			constraints: &ospkg.HostConstraints{
+				HostIDs:    *createHostIDs,
+				Products:   *createProducts,
+				CPUVendors: *createCPUVendor,
+			},
+		}
+		if *createFromDir != "" {
+			if *createLabel != "" || *createKernel != "" || *createInitramfs != "" || *createCmdline != "" || *createUKI != "" || *createTboot != "" || *createTbootArgs != "" || *createACM != "" || *createMBKernel != "" || *createMBCmdline != "" || *createMBProto != "" || len(*createMBModules) > 0 {
+				log.Fatal("--from-dir cannot be combined with flags defining the content, try --help")
+			}
+			if err := createFromDirCmd(outpath, *createFromDir, *createPkgURL, meta, *createRepro); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		if *createUKI != "" {
+			if *createKernel != "" || *createInitramfs != "" || *createCmdline != "" || *createTboot != "" || *createTbootArgs != "" || *createACM != "" || *createMBKernel != "" || *createMBCmdline != "" || *createMBProto != "" || len(*createMBModules) > 0 {
+				log.Fatal("--uki cannot be combined with --kernel, --initramfs, --cmd, tboot or multiboot flags, try --help")
+			}
+			label := parseLabel(*createLabel, *createUKI)
+			if err := createUKICmd(outpath, label, *createPkgURL, *createUKI, meta, *createRepro); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		if *createKernel == "" {
+			log.Fatal("missing flag --kernel, try --help")
+		}
+		label := parseLabel(*createLabel, *createKernel)
+
+		if *createMBKernel != "" || *createMBCmdline != "" || *createMBProto != "" || len(*createMBModules) > 0 {
+			if *createTboot != "" || *createTbootArgs != "" || *createACM != "" {
+				log.Fatal("multiboot flags cannot be combined with tboot flags, try --help")
+			}
+			if *createMBKernel == "" {
+				log.Fatal("missing flag --mb-kernel, try --help")
+			}
+			mb := &ospkg.MultibootConfig{
+				KernelPath: *createMBKernel,
+				Cmdline:    *createMBCmdline,
+				Modules:    parseModules(*createMBModules),
+				Protocol:   *createMBProto,
+			}
+			if err := createMultibootCmd(outpath, label, *createPkgURL, *createKernel, *createInitramfs, *createCmdline, mb, meta, *createRepro); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
 
 		acms, err := parseACMPaths(*createACM)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		if err := createCmd(outpath, label, *createPkgURL, *createKernel, *createInitramfs, *createCmdline, *createTboot, *createTbootArgs, acms); err != nil {
+		if err := createCmd(outpath, label, *createPkgURL, *createKernel, *createInitramfs, *createCmdline, *createTboot, *createTbootArgs, acms, meta, *createRepro); err != nil {
+			log.Fatal(err)
+		}
+
+	case unpack.FullCommand():
+		pkgPath, err := parsePkgPath(*unpackOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := unpackCmd(pkgPath, *unpackDir); err != nil {
+			log.Fatal(err)
+		}
+
+	case rebuildCheck.FullCommand():
+		pkgPath, err := parsePkgPath(*rebuildCheckOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := rebuildCheckCmd(pkgPath, *rebuildCheckFromDir); err != nil {
 			log.Fatal(err)
 		}
 
@@ -96,12 +222,63 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := signCmd(pkgPath, *signPrivKeyFile, *signCertFile); err != nil {
+		if err := signCmd(pkgPath, *signPrivKeyFile, *signCertFile, *signChainFile, *signTSA, *signFormat, *signProvenance); err != nil {
+			log.Fatal(err)
+		}
+
+	case upgrade.FullCommand():
+		pkgPath, err := parsePkgPath(*upgradeOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := upgradeCmd(pkgPath); err != nil {
+			log.Fatal(err)
+		}
+
+	case logMessage.FullCommand():
+		pkgPath, err := parsePkgPath(*logMessageOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := logMessageCmd(pkgPath); err != nil {
+			log.Fatal(err)
+		}
+
+	case attachProof.FullCommand():
+		pkgPath, err := parsePkgPath(*attachProofOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := attachProofCmd(pkgPath, *attachProofFile, *attachProofLogKey); err != nil {
+			log.Fatal(err)
+		}
+
+	case verify.FullCommand():
+		pkgPath, err := parsePkgPath(*verifyOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vargs := verifyArgs{
+			rootsPath:       *verifyRoots,
+			threshold:       *verifyThreshold,
+			securityCfgPath: *verifySecurityCfg,
+			crlPaths:        *verifyCRLs,
+			tsaRootsPath:    *verifyTSARoots,
+			logKeyPath:      *verifyLogKey,
+			submitKeysPath:  *verifySubmitKeys,
+			witnessKeysPath: *verifyWitnessKeys,
+			timeFixPath:     *verifyTimeFix,
+		}
+		if err := verifyCmd(pkgPath, vargs); err != nil {
 			log.Fatal(err)
 		}
 
 	case show.FullCommand():
-		if err := showCmd(*showOSPackage); err != nil {
+		pkgPath, err := parsePkgPath(*showOSPackage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := showCmd(pkgPath, *showJSON); err != nil {
 			log.Fatal(err)
 		}
 
@@ -125,14 +302,22 @@ func main() {
 		}
 
 		if *keygenIsCA {
-			if err := keygenCmd("", "", notBefore, notAfter, certOut, keyOut); err != nil {
+			if err := keygenCmd(*keygenKeyType, "", "", notBefore, notAfter, nil, certOut, keyOut); err != nil {
 				log.Fatal(err)
 			}
 		} else {
 			if *keygenRootCert == "" || *keygenRootKey == "" {
 				log.Fatal("missing flag, try --help")
 			}
-			if err := keygenCmd(*keygenRootCert, *keygenRootKey, notBefore, notAfter, certOut, keyOut); err != nil {
+			var ekus []x509.ExtKeyUsage
+			for _, name := range *keygenEKU {
+				eku, err := config.ParseExtKeyUsage(name)
+				if err != nil {
+					log.Fatalf("%v, try --help", err)
+				}
+				ekus = append(ekus, eku)
+			}
+			if err := keygenCmd(*keygenKeyType, *keygenRootCert, *keygenRootKey, notBefore, notAfter, ekus, certOut, keyOut); err != nil {
 				log.Fatal(err)
 			}
 		}
@@ -207,28 +392,43 @@ func parsePubKeyPath(k string, isCA bool) (string, error) {
 	return k, nil
 }
 
-func parseLabel(l string) string {
+func parseLabel(l, kernel string) string {
 	if l == "" {
-		k := filepath.Base(*createKernel)
+		k := filepath.Base(kernel)
 		return fmt.Sprintf("System Tarnsparency OS Package %s", k)
 	}
 	return l
 }
 
+// parseModules parses multiboot modules in the form 'FILE [CMDLINE]',
+// like the module commands of bootloaders.
+func parseModules(modules []string) []ospkg.MultibootModule {
+	var mods []ospkg.MultibootModule
+	for _, m := range modules {
+		fields := strings.SplitN(strings.TrimSpace(m), " ", 2)
+		mod := ospkg.MultibootModule{Path: fields[0]}
+		if len(fields) == 2 {
+			mod.Cmdline = strings.TrimSpace(fields[1])
+		}
+		mods = append(mods, mod)
+	}
+	return mods
+}
+
 func parseACMPaths(acm string) ([]string, error) {
 	var acms []string
-	if *createACM != "" {
-		stat, err := os.Stat(*createACM)
+	if acm != "" {
+		stat, err := os.Stat(acm)
 		if err != nil {
 			return []string{}, err
 		}
 		if stat.IsDir() {
-			err := filepath.Walk(*createACM, func(path string, info os.FileInfo, err error) error {
+			err := filepath.Walk(acm, func(path string, info os.FileInfo, err error) error {
 				if info.IsDir() {
-					if info.Name() == filepath.Base(*createACM) {
+					if info.Name() == filepath.Base(acm) {
 						return nil // skip root
 					}
-					log.Fatalf("%s must contain acm files only. Found %s", *createACM, path)
+					log.Fatalf("%s must contain acm files only. Found %s", acm, path)
 				}
 				acms = append(acms, path)
 				return nil
@@ -237,12 +437,19 @@ func parseACMPaths(acm string) ([]string, error) {
 				return []string{}, err
 			}
 		} else {
-			acms = append(acms, *createACM)
+			acms = append(acms, acm)
 		}
 	}
 	return acms, nil
 }
 
+func parseExpires(date string) (time.Time, error) {
+	if len(date) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(DateFormat, date)
+}
+
 func parseValidFrom(date string) (time.Time, error) {
 	if len(date) == 0 {
 		return time.Now(), nil
@@ -1,37 +1,66 @@
 package trust
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"time"
 
 	"github.com/system-transparency/stboot/stlog"
 )
 
-func LoadSigningRoot(path string) (*x509.Certificate, error) {
+// LoadSigningRoots loads the PEM encoded root certificates for OS package
+// signatures from path. Their validity periods are checked during verification
+// according to the verification policy.
+func LoadSigningRoots(path string) ([]*x509.Certificate, error) {
+	return loadRoots(path, "Signing root")
+}
+
+// LoadTSARoots loads the PEM encoded root certificates of time stamping
+// authorities from path.
+func LoadTSARoots(path string) ([]*x509.Certificate, error) {
+	return loadRoots(path, "TSA root")
+}
+
+func loadRoots(path, name string) ([]*x509.Certificate, error) {
 	pemBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read file: %v", err)
 	}
-	stlog.Debug("Signing root certificate:\n%s", string(pemBytes))
-	pemBlock, rest := pem.Decode(pemBytes)
-	if pemBlock == nil {
-		return nil, fmt.Errorf("decoding PEM failed")
-	}
-	if len(rest) > 0 {
-		return nil, fmt.Errorf("unexpeceted trailing data")
-	}
-	cert, err := x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("parsing x509 failed: %v", err)
+	stlog.Debug("%s certificates:\n%s", name, string(pemBytes))
+	var roots []*x509.Certificate
+	for len(bytes.TrimSpace(pemBytes)) > 0 {
+		var pemBlock *pem.Block
+		pemBlock, pemBytes = pem.Decode(pemBytes)
+		if pemBlock == nil {
+			return nil, fmt.Errorf("decoding PEM failed")
+		}
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing x509 failed: %v", err)
+		}
+		for _, r := range roots {
+			if r.Equal(cert) {
+				return nil, fmt.Errorf("duplicate certificate %s", Fingerprint(cert))
+			}
+		}
+		stlog.Debug("%s %d: %s, fingerprint %s", name, len(roots)+1, cert.Subject.CommonName, Fingerprint(cert))
+		roots = append(roots, cert)
 	}
-	now := time.Now()
-	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
-		return nil, fmt.Errorf("certificate has expired or is not yet valid")
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no certifiates found")
 	}
-	return cert, nil
+	return roots, nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the DER encoding of cert.
+func Fingerprint(cert *x509.Certificate) string {
+	fp := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(fp[:])
 }
 
 func LoadHTTPSRoots(path string) ([]*x509.Certificate, error) {
@@ -74,3 +103,45 @@ func LoadHTTPSRoots(path string) ([]*x509.Certificate, error) {
 	}
 	return roots, nil
 }
+
+// LoadCRLs loads the certificate revocation lists at path. The file may
+// contain several PEM encoded CRLs or a single DER encoded one.
+func LoadCRLs(path string) ([]*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %v", err)
+	}
+	return ParseCRLs(data)
+}
+
+// ParseCRLs parses several PEM encoded certificate revocation lists or a
+// single DER encoded one from data.
+func ParseCRLs(data []byte) ([]*pkix.CertificateList, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		crl, err := x509.ParseDERCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CRL failed: %v", err)
+		}
+		return []*pkix.CertificateList{crl}, nil
+	}
+	var crls []*pkix.CertificateList
+	for len(bytes.TrimSpace(data)) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("decoding PEM failed")
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CRL %d failed: %v", len(crls)+1, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("no CRLs found")
+	}
+	return crls, nil
+}
@@ -0,0 +1,412 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trust
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// LogProof proves that a message is logged in a Sigsum log. It is verified
+// offline against the keys of the log, its witnesses and the submitters.
+// The leaf is stored without its checksum, which is the SHA-256 hash of the
+// message, like in Sigsum proofs.
+type LogProof struct {
+	Leaf          Leaf     `json:"leaf"`
+	LeafIndex     uint64   `json:"leaf_index"`
+	InclusionPath [][]byte `json:"inclusion_path"`
+	TreeHead      TreeHead `json:"tree_head"`
+}
+
+// Leaf is a Sigsum leaf without its checksum.
+type Leaf struct {
+	// KeyHash is the SHA-256 hash of the submitter's public key.
+	KeyHash []byte `json:"key_hash"`
+	// Signature is the submitter's signature on LeafMessage of the checksum.
+	Signature []byte `json:"signature"`
+}
+
+// TreeHead is a signed and cosigned tree head of a transparency log.
+type TreeHead struct {
+	Size         uint64        `json:"size"`
+	RootHash     []byte        `json:"root_hash"`
+	Signature    []byte        `json:"signature"`
+	Cosignatures []Cosignature `json:"cosignatures"`
+}
+
+// Cosignature is a witness' signature on a tree head.
+type Cosignature struct {
+	// KeyHash is the SHA-256 hash of the witness' public key.
+	KeyHash   []byte `json:"key_hash"`
+	Timestamp uint64 `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// LogPolicy defines the log, the witnesses and the submitters a LogProof is
+// verified against. At least Quorum of the Witnesses must have cosigned the
+// tree head, and the leaf must be signed by one of the SubmitKeys.
+type LogPolicy struct {
+	LogKey     ed25519.PublicKey
+	SubmitKeys []ed25519.PublicKey
+	Witnesses  []ed25519.PublicKey
+	Quorum     uint
+}
+
+const (
+	// leafNamespace is the SSH signature namespace of Sigsum leaves.
+	leafNamespace = "sigsum.org/v1/tree-leaf"
+	// treeOriginPrefix prefixes the hex encoded log key hash in the origin
+	// line of Sigsum tree heads.
+	treeOriginPrefix = "sigsum.org/v1/tree/"
+	// proofVersion is the supported version of the Sigsum proof format.
+	proofVersion = 2
+)
+
+// LeafChecksum returns the checksum of the Sigsum leaf logging message.
+func LeafChecksum(message [32]byte) [32]byte {
+	return sha256.Sum256(message[:])
+}
+
+// LeafMessage returns the data signed by the submitter of a leaf holding
+// checksum. Other than in regular SSH signatures, the checksum is signed
+// as is instead of being hashed again.
+func LeafMessage(checksum [32]byte) []byte {
+	var b []byte
+	sshString := func(s []byte) {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(s)))
+		b = append(b, l[:]...)
+		b = append(b, s...)
+	}
+	b = append(b, "SSHSIG"...)
+	sshString([]byte(leafNamespace))
+	sshString(nil)
+	sshString([]byte("sha256"))
+	sshString(checksum[:])
+	return b
+}
+
+// LeafHash returns the RFC 9162 hash of the Sigsum leaf holding checksum,
+// the submitter's signature sig and the hash of the submitter's key keyHash.
+func LeafHash(checksum [32]byte, sig, keyHash []byte) [32]byte {
+	b := make([]byte, 0, 1+len(checksum)+len(sig)+len(keyHash))
+	b = append(b, 0x00)
+	b = append(b, checksum[:]...)
+	b = append(b, sig...)
+	b = append(b, keyHash...)
+	return sha256.Sum256(b)
+}
+
+// NodeHash returns the RFC 9162 hash of an interior node.
+func NodeHash(left, right []byte) [32]byte {
+	b := make([]byte, 0, 1+len(left)+len(right))
+	b = append(b, 0x01)
+	b = append(b, left...)
+	b = append(b, right...)
+	return sha256.Sum256(b)
+}
+
+// KeyHash returns the SHA-256 hash of key, used to identify logs and witnesses.
+func KeyHash(key ed25519.PublicKey) [32]byte {
+	return sha256.Sum256(key)
+}
+
+// TreeHeadMessage returns the message signed by the log with key logKey for
+// a tree head of size and rootHash. It is the body of a Sigsum checkpoint.
+func TreeHeadMessage(logKey ed25519.PublicKey, size uint64, rootHash []byte) []byte {
+	kh := KeyHash(logKey)
+	return []byte(fmt.Sprintf("%s%s\n%d\n%s\n", treeOriginPrefix, hex.EncodeToString(kh[:]), size, base64.StdEncoding.EncodeToString(rootHash)))
+}
+
+// CosignatureMessage returns the message signed by a witness cosigning a
+// tree head of the log with key logKey at timestamp, as defined by the
+// cosignature/v1 format.
+func CosignatureMessage(logKey ed25519.PublicKey, size uint64, rootHash []byte, timestamp uint64) []byte {
+	msg := []byte(fmt.Sprintf("cosignature/v1\ntime %d\n", timestamp))
+	return append(msg, TreeHeadMessage(logKey, size, rootHash)...)
+}
+
+// CheckInclusion makes sure that the inclusion path of p leads from the leaf
+// logging message to the root hash of the tree head. Signatures are not
+// checked.
+func (p *LogProof) CheckInclusion(message [32]byte) error {
+	size := p.TreeHead.Size
+	if p.LeafIndex >= size {
+		return fmt.Errorf("leaf index %d out of range for tree size %d", p.LeafIndex, size)
+	}
+	fn, sn := p.LeafIndex, size-1
+	r := LeafHash(LeafChecksum(message), p.Leaf.Signature, p.Leaf.KeyHash)
+	for _, h := range p.InclusionPath {
+		if sn == 0 {
+			return fmt.Errorf("inclusion path too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(h, r[:])
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r[:], h)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return fmt.Errorf("inclusion path too short")
+	}
+	if !bytes.Equal(r[:], p.TreeHead.RootHash) {
+		return fmt.Errorf("inclusion path does not lead to root hash")
+	}
+	return nil
+}
+
+// Verify makes sure that message is logged in the log defined by policy.
+// The leaf must be signed by a submitter and the tree head must be signed by
+// the log and cosigned by a quorum of witnesses. A witness key listed more
+// than once in policy counts once.
+func (p *LogProof) Verify(message [32]byte, policy *LogPolicy) error {
+	if err := p.verifyLeaf(message, policy.SubmitKeys); err != nil {
+		return err
+	}
+	th := p.TreeHead
+	if !ed25519.Verify(policy.LogKey, TreeHeadMessage(policy.LogKey, th.Size, th.RootHash), th.Signature) {
+		return fmt.Errorf("invalid tree head signature")
+	}
+	var cosigned uint
+	seen := make(map[[32]byte]bool)
+	for _, w := range policy.Witnesses {
+		kh := KeyHash(w)
+		if seen[kh] {
+			continue
+		}
+		seen[kh] = true
+		for _, c := range th.Cosignatures {
+			if !bytes.Equal(c.KeyHash, kh[:]) {
+				continue
+			}
+			if ed25519.Verify(w, CosignatureMessage(policy.LogKey, th.Size, th.RootHash, c.Timestamp), c.Signature) {
+				cosigned++
+				break
+			}
+		}
+	}
+	if cosigned < policy.Quorum {
+		return fmt.Errorf("witness quorum not reached: %d of %d required cosignatures", cosigned, policy.Quorum)
+	}
+	return p.CheckInclusion(message)
+}
+
+// verifyLeaf makes sure that the leaf of p is signed by one of submitKeys.
+func (p *LogProof) verifyLeaf(message [32]byte, submitKeys []ed25519.PublicKey) error {
+	for _, k := range submitKeys {
+		if kh := KeyHash(k); !bytes.Equal(kh[:], p.Leaf.KeyHash) {
+			continue
+		}
+		if !ed25519.Verify(k, LeafMessage(LeafChecksum(message)), p.Leaf.Signature) {
+			return fmt.Errorf("invalid leaf signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("leaf signed by unknown submitter key %x", p.Leaf.KeyHash)
+}
+
+// ParseSigsumProof parses a Sigsum proof of version 2 in its ASCII format,
+// as written by sigsum-submit. The log key hash of the proof must match
+// logKey.
+func ParseSigsumProof(data []byte, logKey ed25519.PublicKey) (*LogProof, error) {
+	pp := &proofParser{lines: strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")}
+	p := &LogProof{}
+
+	if v := pp.values("version", 1); pp.err == nil && v[0] != strconv.Itoa(proofVersion) {
+		return nil, fmt.Errorf("unsupported proof version %s", v[0])
+	}
+	if v := pp.values("log", 1); pp.err == nil {
+		kh := KeyHash(logKey)
+		if logKeyHash := pp.hex("log", v[0], sha256.Size); pp.err == nil && !bytes.Equal(logKeyHash, kh[:]) {
+			return nil, fmt.Errorf("proof of log %x, want %x", logKeyHash, kh)
+		}
+	}
+	if v := pp.values("leaf", 2); pp.err == nil {
+		p.Leaf.KeyHash = pp.hex("leaf key hash", v[0], sha256.Size)
+		p.Leaf.Signature = pp.hex("leaf signature", v[1], ed25519.SignatureSize)
+	}
+
+	pp.values("", 1)
+	if v := pp.values("size", 1); pp.err == nil {
+		p.TreeHead.Size = pp.uint("size", v[0])
+	}
+	if v := pp.values("root_hash", 1); pp.err == nil {
+		p.TreeHead.RootHash = pp.hex("root_hash", v[0], sha256.Size)
+	}
+	if v := pp.values("signature", 1); pp.err == nil {
+		p.TreeHead.Signature = pp.hex("signature", v[0], ed25519.SignatureSize)
+	}
+	for pp.err == nil && pp.has("cosignature") {
+		v := pp.values("cosignature", 3)
+		if pp.err == nil {
+			p.TreeHead.Cosignatures = append(p.TreeHead.Cosignatures, Cosignature{
+				KeyHash:   pp.hex("cosignature key hash", v[0], sha256.Size),
+				Timestamp: pp.uint("cosignature timestamp", v[1]),
+				Signature: pp.hex("cosignature", v[2], ed25519.SignatureSize),
+			})
+		}
+	}
+
+	// the inclusion proof is omitted for trees of size one
+	if pp.err == nil && p.TreeHead.Size > 1 {
+		pp.values("", 1)
+		if v := pp.values("leaf_index", 1); pp.err == nil {
+			p.LeafIndex = pp.uint("leaf_index", v[0])
+		}
+		for pp.err == nil && pp.has("node_hash") {
+			if v := pp.values("node_hash", 1); pp.err == nil {
+				p.InclusionPath = append(p.InclusionPath, pp.hex("node_hash", v[0], sha256.Size))
+			}
+		}
+	}
+	if pp.err == nil && pp.n < len(pp.lines) {
+		pp.err = fmt.Errorf("line %d: unexpected content", pp.n+1)
+	}
+	if pp.err != nil {
+		return nil, fmt.Errorf("parse Sigsum proof: %v", pp.err)
+	}
+	return p, nil
+}
+
+// proofParser reads the key=value lines of a Sigsum proof in order. The
+// first error is kept in err, after which all methods return zero values.
+type proofParser struct {
+	lines []string
+	n     int
+	err   error
+}
+
+// has reports whether the next line has key.
+func (pp *proofParser) has(key string) bool {
+	if pp.n >= len(pp.lines) {
+		return false
+	}
+	k := pp.lines[pp.n]
+	if i := strings.Index(k, "="); i >= 0 {
+		k = k[:i]
+	}
+	return k == key
+}
+
+// values consumes the next line, which must have key and want space
+// separated values. An empty key matches an empty line.
+func (pp *proofParser) values(key string, want int) []string {
+	if pp.err != nil {
+		return nil
+	}
+	if !pp.has(key) {
+		pp.err = fmt.Errorf("line %d: expected %q", pp.n+1, key)
+		return nil
+	}
+	line := pp.lines[pp.n]
+	pp.n++
+	v := strings.Split(strings.TrimPrefix(line, key+"="), " ")
+	if len(v) != want {
+		pp.err = fmt.Errorf("line %d: expected %d value(s) for %q", pp.n, want, key)
+		return nil
+	}
+	return v
+}
+
+func (pp *proofParser) hex(name, v string, size int) []byte {
+	if pp.err != nil {
+		return nil
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != size {
+		pp.err = fmt.Errorf("line %d: invalid %s", pp.n, name)
+		return nil
+	}
+	return b
+}
+
+func (pp *proofParser) uint(name, v string) uint64 {
+	if pp.err != nil {
+		return 0
+	}
+	i, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		pp.err = fmt.Errorf("line %d: invalid %s", pp.n, name)
+	}
+	return i
+}
+
+// LoadLogPolicy returns the LogPolicy defined by the log key at logKeyPath,
+// the submitter keys at submitKeysPath and, if quorum is not zero, the
+// witness keys at witnessKeysPath. The log key file must contain exactly one
+// key and there must be at least quorum distinct witnesses.
+func LoadLogPolicy(logKeyPath, submitKeysPath, witnessKeysPath string, quorum uint) (*LogPolicy, error) {
+	logKeys, err := LoadLogKeys(logKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load log key: %v", err)
+	}
+	if len(logKeys) != 1 {
+		return nil, fmt.Errorf("expected exactly one log key, found %d", len(logKeys))
+	}
+	policy := &LogPolicy{LogKey: logKeys[0], Quorum: quorum}
+	policy.SubmitKeys, err = LoadLogKeys(submitKeysPath)
+	if err != nil {
+		return nil, fmt.Errorf("load submitter keys: %v", err)
+	}
+	if quorum > 0 {
+		policy.Witnesses, err = LoadLogKeys(witnessKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("load witness keys: %v", err)
+		}
+		if uint(len(policy.Witnesses)) < quorum {
+			return nil, fmt.Errorf("witness quorum %d exceeds the number of witnesses", quorum)
+		}
+	}
+	return policy, nil
+}
+
+// LoadLogKeys loads hex encoded ED25519 public keys from path, one per line.
+// Empty lines and text following a '#' are ignored, as are repeated keys.
+func LoadLogKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %v", err)
+	}
+	var keys []ed25519.PublicKey
+	seen := make(map[[32]byte]bool)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		k, err := hex.DecodeString(line)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("line %d: invalid ED25519 public key", n)
+		}
+		if kh := KeyHash(k); !seen[kh] {
+			seen[kh] = true
+			keys = append(keys, ed25519.PublicKey(k))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trust_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/trust"
+	"github.com/system-transparency/stboot/trust/logtest"
+)
+
+func TestLogProofInclusion(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		log, err := logtest.New(0)
+		require.NoError(t, err)
+		for i := 0; i < size; i++ {
+			log.Add(sha256.Sum256([]byte(fmt.Sprint(i))))
+		}
+		for i := 0; i < size; i++ {
+			proof, err := log.Proof(uint64(i))
+			require.NoError(t, err)
+			require.NoError(t, proof.CheckInclusion(sha256.Sum256([]byte(fmt.Sprint(i)))), "size %d, index %d", size, i)
+			require.Error(t, proof.CheckInclusion(sha256.Sum256([]byte("other"))), "size %d, index %d", size, i)
+		}
+	}
+}
+
+func TestLogProofVerify(t *testing.T) {
+	log, err := logtest.New(3)
+	require.NoError(t, err)
+	checksum := sha256.Sum256([]byte("package"))
+	log.Add(sha256.Sum256([]byte("first")))
+	index := log.Add(checksum)
+	log.Add(sha256.Sum256([]byte("last")))
+
+	proof, err := log.Proof(index)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(checksum, log.Policy(3)))
+	require.Error(t, proof.Verify(checksum, log.Policy(4)), "quorum not reachable")
+
+	proof.TreeHead.Cosignatures = proof.TreeHead.Cosignatures[:1]
+	require.NoError(t, proof.Verify(checksum, log.Policy(1)))
+	require.Error(t, proof.Verify(checksum, log.Policy(2)))
+
+	other, err := logtest.New(0)
+	require.NoError(t, err)
+	require.Error(t, proof.Verify(checksum, other.Policy(0)), "tree head signed by other log")
+
+	proof.TreeHead.Size++
+	require.Error(t, proof.Verify(checksum, log.Policy(0)), "tree head modified")
+}
+
+func TestLogProofVerifyDuplicateWitness(t *testing.T) {
+	log, err := logtest.New(2)
+	require.NoError(t, err)
+	checksum := sha256.Sum256([]byte("package"))
+	index := log.Add(checksum)
+	proof, err := log.Proof(index)
+	require.NoError(t, err)
+
+	policy := log.Policy(2)
+	policy.Witnesses = []ed25519.PublicKey{policy.Witnesses[0], policy.Witnesses[0]}
+	require.Error(t, proof.Verify(checksum, policy), "witness counted twice")
+}
+
+func TestLoadLogKeysDuplicate(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "witnesses")
+	content := hex.EncodeToString(pub) + "\n" + hex.EncodeToString(other) + "\n" + strings.ToUpper(hex.EncodeToString(pub)) + " # again\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+	keys, err := trust.LoadLogKeys(path)
+	require.NoError(t, err)
+	require.Equal(t, []ed25519.PublicKey{pub, other}, keys)
+}
+
+func TestLoadLogPolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeKeys := func(name string, keys ...ed25519.PublicKey) string {
+		var lines []string
+		for _, k := range keys {
+			lines = append(lines, hex.EncodeToString(k))
+		}
+		p := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")), 0644))
+		return p
+	}
+	var keys []ed25519.PublicKey
+	for i := 0; i < 3; i++ {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		keys = append(keys, pub)
+	}
+	logKey := writeKeys("log", keys[0])
+	witnesses := writeKeys("witnesses", keys[1], keys[2], keys[1])
+	submitters := writeKeys("submitters", keys[2])
+
+	policy, err := trust.LoadLogPolicy(logKey, submitters, witnesses, 2)
+	require.NoError(t, err)
+	require.Equal(t, keys[0], policy.LogKey)
+	require.Equal(t, []ed25519.PublicKey{keys[2]}, policy.SubmitKeys)
+	require.Len(t, policy.Witnesses, 2)
+
+	_, err = trust.LoadLogPolicy(logKey, submitters, witnesses, 3)
+	require.Error(t, err, "quorum exceeds distinct witnesses")
+	_, err = trust.LoadLogPolicy(witnesses, submitters, witnesses, 0)
+	require.Error(t, err, "more than one log key")
+	_, err = trust.LoadLogPolicy(logKey, "", witnesses, 0)
+	require.Error(t, err, "submitters are needed")
+	policy, err = trust.LoadLogPolicy(logKey, submitters, "", 0)
+	require.NoError(t, err, "witnesses not needed")
+	require.Empty(t, policy.Witnesses)
+}
+
+// sigsumProof is a Sigsum proof of version 2 for the leaf at index 2 of a
+// log of size 5, whose leaves log the messages SHA-256("message <index>").
+// It was generated independently of this package, following the Sigsum
+// specification, with the keys derived from the seeds SHA-256("log"),
+// SHA-256("submitter"), SHA-256("witness 1") and SHA-256("witness 2").
+const sigsumProof = `version=2
+log=e747be1c4db119db109c095f4d8207be77d2ca3c9b6751b385a548f8e32ddc2f
+leaf=ca288f2df52cfe960ebe28cafe0db7cf9d48353c1ee479cc2ca330dd799bc4c5 2225f2262b16bc8df6729b4fed94ce521fc829ce07a4c9bfc78ca0991b28d7f5e732a213a67365753d554522058e2d27e7d87b2274ec06df95a19380bfee0f0d
+
+size=5
+root_hash=55d6987ab91594602baedaa7b27f1c1e85b631509b4c3ec56b1e5ba76e36d164
+signature=6c40401fa36d7d6c3cced4bd339f5d5dd2a2608a8aa80165a52254615803f9c0d4adbb0e581ff65b0233c3a8f92c3564571a4d05c5eaaf0627f8921cf96ce30e
+cosignature=56d53f053f19c44df0e44c5caa5032d1baf587f9bac0406c3bb00793542ed688 1700000000 7d0a18f6305ff8005a4bd24f910fd7e452db16bc8d93e014377a8fdb74abc95cdaa0378168e6f3b4729d64a26271e22fc6742472e4dca6c316dedde69bd4970a
+cosignature=5c3e899307d23c8b164b7b477fa5a248edde5c55e8d4376cd82f85ebaed411d5 1700000000 16c727f5283cd3d1621b8a6bd6c32c9357c3a900d4437c5e41972d556781976966b08d8fb94a436a94399f36fddf60a11677e3f1f668297c106349a13b35ca0f
+
+leaf_index=2
+node_hash=74812e3dbbbfa513d659fba9e87807a72837194048d4aeb27a7201d543d5a361
+node_hash=db5999e6df7bab07224b00c3bad250b1af75a88827d3fc1786272428670a2814
+node_hash=9ce4003cfde49d129c347b855727d945119e6dddbccc7612bab2218747d32d31
+`
+
+func testKey(t *testing.T, s string) ed25519.PublicKey {
+	t.Helper()
+	k, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return k
+}
+
+func TestParseSigsumProof(t *testing.T) {
+	policy := &trust.LogPolicy{
+		LogKey:     testKey(t, "9b1f84791cfc7663045854d389deb5ca95449d875f276a83840b060ab39cfc71"),
+		SubmitKeys: []ed25519.PublicKey{testKey(t, "dead3242867d134dee2ee7f5c42e2779f22b3c308ed37b7ef7295fb8a83f7e9e")},
+		Witnesses: []ed25519.PublicKey{
+			testKey(t, "f724ed46b874b3e19895567b63091beec53dfd1f7d9e449b1a0f8d5097db6d56"),
+			testKey(t, "acbe59ac4f5ffc040ec24071ab732623710e2cca2bd711f2a80c627ee1f63104"),
+		},
+		Quorum: 2,
+	}
+	message := sha256.Sum256([]byte("message 2"))
+
+	proof, err := trust.ParseSigsumProof([]byte(sigsumProof), policy.LogKey)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), proof.LeafIndex)
+	require.Equal(t, uint64(5), proof.TreeHead.Size)
+	require.Len(t, proof.TreeHead.Cosignatures, 2)
+	require.Len(t, proof.InclusionPath, 3)
+	require.NoError(t, proof.Verify(message, policy))
+	require.Error(t, proof.Verify(sha256.Sum256([]byte("message 1")), policy), "other message")
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = trust.ParseSigsumProof([]byte(sigsumProof), other)
+	require.Error(t, err, "proof of another log")
+
+	p := *policy
+	p.SubmitKeys = []ed25519.PublicKey{other}
+	require.Error(t, proof.Verify(message, &p), "unknown submitter")
+
+	proof.Leaf.Signature[0] ^= 1
+	require.Error(t, proof.Verify(message, policy), "invalid leaf signature")
+
+	for _, bad := range []string{
+		strings.Replace(sigsumProof, "version=2", "version=1", 1),
+		strings.Replace(sigsumProof, "\n\nsize", "\nsize", 1),
+		strings.Replace(sigsumProof, "leaf_index=2", "leaf_index=two", 1),
+		strings.Replace(sigsumProof, "root_hash=55", "root_hash=5", 1),
+		sigsumProof + "node_hash=00\n",
+		sigsumProof[:strings.Index(sigsumProof, "\n\nleaf_index")+1],
+	} {
+		_, err := trust.ParseSigsumProof([]byte(bad), policy.LogKey)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestParseSigsumProofStandIn(t *testing.T) {
+	for size := 1; size <= 3; size++ {
+		log, err := logtest.New(1)
+		require.NoError(t, err)
+		for i := 0; i < size; i++ {
+			log.Add(sha256.Sum256([]byte(fmt.Sprint(i))))
+		}
+		policy := log.Policy(1)
+		for i := 0; i < size; i++ {
+			ascii, err := log.SigsumProof(uint64(i))
+			require.NoError(t, err)
+			proof, err := trust.ParseSigsumProof(ascii, policy.LogKey)
+			require.NoError(t, err, "size %d, index %d", size, i)
+			require.NoError(t, proof.Verify(sha256.Sum256([]byte(fmt.Sprint(i))), policy), "size %d, index %d", size, i)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logtest provides an in-memory stand-in for a transparency log and
+// its witnesses. It is meant for tests only.
+package logtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/system-transparency/stboot/trust"
+)
+
+// Log is an in-memory Sigsum log with a set of witnesses, which cosign
+// every tree head, and a single submitter, which signs every leaf.
+type Log struct {
+	key       ed25519.PrivateKey
+	submitter ed25519.PrivateKey
+	witnesses []ed25519.PrivateKey
+	leaves    []trust.Leaf
+	hashes    [][32]byte
+}
+
+// New returns an empty Log with the given number of witnesses.
+func New(witnesses int) (*Log, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, submitter, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{key: key, submitter: submitter}
+	for i := 0; i < witnesses; i++ {
+		_, w, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		l.witnesses = append(l.witnesses, w)
+	}
+	return l, nil
+}
+
+// Policy returns a trust.LogPolicy for l requiring quorum cosignatures.
+func (l *Log) Policy(quorum uint) *trust.LogPolicy {
+	p := &trust.LogPolicy{
+		LogKey:     l.key.Public().(ed25519.PublicKey),
+		SubmitKeys: []ed25519.PublicKey{l.submitter.Public().(ed25519.PublicKey)},
+		Quorum:     quorum,
+	}
+	for _, w := range l.witnesses {
+		p.Witnesses = append(p.Witnesses, w.Public().(ed25519.PublicKey))
+	}
+	return p
+}
+
+// Add appends a leaf logging message to l and returns its index.
+func (l *Log) Add(message [32]byte) uint64 {
+	checksum := trust.LeafChecksum(message)
+	kh := trust.KeyHash(l.submitter.Public().(ed25519.PublicKey))
+	leaf := trust.Leaf{
+		KeyHash:   kh[:],
+		Signature: ed25519.Sign(l.submitter, trust.LeafMessage(checksum)),
+	}
+	l.leaves = append(l.leaves, leaf)
+	l.hashes = append(l.hashes, trust.LeafHash(checksum, leaf.Signature, leaf.KeyHash))
+	return uint64(len(l.leaves) - 1)
+}
+
+// Proof returns an inclusion proof for the leaf at index in the current
+// tree, together with the signed and cosigned tree head.
+func (l *Log) Proof(index uint64) (*trust.LogProof, error) {
+	if index >= uint64(len(l.leaves)) {
+		return nil, fmt.Errorf("leaf index %d out of range", index)
+	}
+	root := rootHash(l.hashes)
+	logKey := l.key.Public().(ed25519.PublicKey)
+	size := uint64(len(l.hashes))
+	th := trust.TreeHead{
+		Size:      size,
+		RootHash:  root[:],
+		Signature: ed25519.Sign(l.key, trust.TreeHeadMessage(logKey, size, root[:])),
+	}
+	now := uint64(time.Now().Unix())
+	for _, w := range l.witnesses {
+		kh := trust.KeyHash(w.Public().(ed25519.PublicKey))
+		th.Cosignatures = append(th.Cosignatures, trust.Cosignature{
+			KeyHash:   kh[:],
+			Timestamp: now,
+			Signature: ed25519.Sign(w, trust.CosignatureMessage(logKey, size, root[:], now)),
+		})
+	}
+	return &trust.LogProof{
+		Leaf:          l.leaves[index],
+		LeafIndex:     index,
+		InclusionPath: path(index, l.hashes),
+		TreeHead:      th,
+	}, nil
+}
+
+// SigsumProof returns the proof for the leaf at index in the ASCII format
+// of Sigsum proofs, see trust.ParseSigsumProof.
+func (l *Log) SigsumProof(index uint64) ([]byte, error) {
+	p, err := l.Proof(index)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	kh := trust.KeyHash(l.key.Public().(ed25519.PublicKey))
+	fmt.Fprintf(&b, "version=2\nlog=%x\nleaf=%x %x\n", kh, p.Leaf.KeyHash, p.Leaf.Signature)
+	th := p.TreeHead
+	fmt.Fprintf(&b, "\nsize=%d\nroot_hash=%x\nsignature=%x\n", th.Size, th.RootHash, th.Signature)
+	for _, c := range th.Cosignatures {
+		fmt.Fprintf(&b, "cosignature=%x %d %x\n", c.KeyHash, c.Timestamp, c.Signature)
+	}
+	if th.Size > 1 {
+		fmt.Fprintf(&b, "\nleaf_index=%d\n", p.LeafIndex)
+		for _, h := range p.InclusionPath {
+			fmt.Fprintf(&b, "node_hash=%x\n", h)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// split returns the largest power of two smaller than n.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func rootHash(leaves [][32]byte) [32]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	l, r := rootHash(leaves[:k]), rootHash(leaves[k:])
+	return trust.NodeHash(l[:], r[:])
+}
+
+func path(m uint64, leaves [][32]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if m < uint64(k) {
+		h := rootHash(leaves[k:])
+		return append(path(m, leaves[:k]), h[:])
+	}
+	h := rootHash(leaves[:k])
+	return append(path(m-uint64(k), leaves[k:]), h[:])
+}
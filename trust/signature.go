@@ -6,7 +6,9 @@ package trust
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
@@ -19,6 +21,23 @@ type Signer interface {
 	Verify(sig, hash []byte, key crypto.PublicKey) error
 }
 
+// SignerFor returns the Signer matching the algorithm of key.
+func SignerFor(key crypto.PublicKey) (Signer, error) {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ED25519Signer{}, nil
+	case *rsa.PublicKey:
+		return RSAPSSSigner{}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+		return ECDSASigner{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
 // DummySigner implements the Signer interface. It creates signatures
 // that are always valid.
 type DummySigner struct{}
@@ -119,3 +138,43 @@ func (ED25519Signer) Verify(sig, hash []byte, key crypto.PublicKey) error {
 	}
 	return nil
 }
+
+// ECDSASigner implements the Signer interface. It creates ASN.1 encoded
+// ECDSA signatures using the curves P-256 or P-384.
+type ECDSASigner struct{}
+
+var _ Signer = ECDSASigner{}
+
+// Sign signes the provided data with the key named by privKey.
+func (ECDSASigner) Sign(key crypto.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("ECDSASigner: input data has zero length")
+	}
+
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("ECDSASigner: invalid key type %T", key)
+	}
+
+	return ecdsa.SignASN1(rand.Reader, priv, data)
+}
+
+// Verify checks if sig contains a valid signature of hash.
+func (ECDSASigner) Verify(sig, hash []byte, key crypto.PublicKey) error {
+	if len(sig) == 0 {
+		return errors.New("ECDSASigner: signature has zero length")
+	}
+	if len(hash) == 0 {
+		return errors.New("ECDSASigner: hash has zero length")
+	}
+
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("ECDSASigner: invalid key type %T", key)
+	}
+
+	if !ecdsa.VerifyASN1(pub, hash, sig) {
+		return errors.New("ECDSASigner: verification failed")
+	}
+	return nil
+}
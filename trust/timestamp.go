@@ -0,0 +1,489 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trust
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// TSA is a RFC 3161 time stamping authority.
+type TSA interface {
+	// Timestamp returns a DER encoded timestamp token over the SHA-256
+	// digest.
+	Timestamp(digest [32]byte) ([]byte, error)
+}
+
+// HTTPTSA requests timestamp tokens from the time stamping authority at URL
+// using the RFC 3161 HTTP transport.
+type HTTPTSA struct {
+	URL    string
+	Client *http.Client
+}
+
+var _ TSA = HTTPTSA{}
+
+// ASN.1 object identifiers used by RFC 3161 and CMS (RFC 5652).
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCert     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidSigningCertV2   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// messageImprint is the hash of the timestamped data.
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status int
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// contentInfo is the outer structure of a timestamp token.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// signedData is the CMS structure holding the timestamp info.
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// encapContentInfo holds the DER encoded TSTInfo.
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// signerInfo holds the signature of the time stamping authority.
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+// issuerAndSerialNumber identifies the certificate of a signer.
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// attribute is a signed attribute of a signerInfo.
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// signingCertificate is the value of the ESS signing certificate attributes
+// (RFC 2634, RFC 5035). Only the first certificate identifies the signer,
+// policies are not parsed.
+type signingCertificate struct {
+	Certs []asn1.RawValue
+}
+
+// essCertID identifies a certificate by its SHA-1 hash.
+type essCertID struct {
+	CertHash     []byte
+	IssuerSerial issuerSerial `asn1:"optional"`
+}
+
+// essCertIDv2 identifies a certificate by its hash. The hash algorithm
+// defaults to SHA-256.
+type essCertIDv2 struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"`
+	CertHash      []byte
+	IssuerSerial  issuerSerial `asn1:"optional"`
+}
+
+// issuerSerial names the issuer as GeneralNames.
+type issuerSerial struct {
+	Issuer       []asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// tstInfo is the content of a timestamp token. The optional trailing TSA
+// name and extensions are not parsed.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       accuracy  `asn1:"optional"`
+	Ordering       bool      `asn1:"optional"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// Timestamp requests a timestamp token over digest from t.
+func (t HTTPTSA) Timestamp(digest [32]byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			HashedMessage: digest[:],
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(t.URL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("timestamp request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp request: HTTP status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp request: %v", err)
+	}
+
+	var tsr timeStampResp
+	if _, err := asn1.Unmarshal(body, &tsr); err != nil {
+		return nil, fmt.Errorf("timestamp response: %v", err)
+	}
+	// 0: granted, 1: granted with modifications
+	if tsr.Status.Status > 1 {
+		return nil, fmt.Errorf("timestamp response: request rejected with status %d", tsr.Status.Status)
+	}
+	token := tsr.TimeStampToken.FullBytes
+	_, info, err := parseTimestamp(token)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp response: %v", err)
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return nil, fmt.Errorf("timestamp response: token does not cover the requested digest")
+	}
+	if info.Nonce == nil {
+		return nil, fmt.Errorf("timestamp response: token has no nonce")
+	}
+	if info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("timestamp response: token has another nonce than requested")
+	}
+	return token, nil
+}
+
+// VerifyTimestamp verifies the RFC 3161 timestamp token over the SHA-256
+// digest and returns the time it states. The token must be signed by a
+// time stamping certificate chaining to one of roots, valid at that time.
+func VerifyTimestamp(token []byte, digest [32]byte, roots []*x509.Certificate) (time.Time, error) {
+	sd, info, err := parseTimestamp(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return time.Time{}, fmt.Errorf("timestamp does not cover the digest")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return time.Time{}, fmt.Errorf("expected one signer, found %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing certificates failed: %v", err)
+	}
+	signer, err := findSigner(si.SID, certs)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	sigAlg, hash, err := signatureAlgorithm(si.DigestAlgorithm.Algorithm, si.SignatureAlgorithm.Algorithm)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := checkSignedAttrs(si.SignedAttrs, sd.EncapContentInfo, hash, signer); err != nil {
+		return time.Time{}, err
+	}
+	// the signature covers the DER encoding of the attributes as SET OF
+	signedAttrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	if err := signer.CheckSignature(sigAlg, signedAttrs, si.Signature); err != nil {
+		return time.Time{}, fmt.Errorf("invalid signature: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	for _, r := range roots {
+		pool.AddCert(r)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	_, err = signer.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		CurrentTime:   info.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid TSA certificate: %v", err)
+	}
+	return info.GenTime, nil
+}
+
+func parseTimestamp(token []byte) (*signedData, *tstInfo, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(token, &ci); err != nil {
+		return nil, nil, fmt.Errorf("parsing token failed: %v", err)
+	} else if len(rest) > 0 {
+		return nil, nil, fmt.Errorf("trailing data after token")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, fmt.Errorf("token is not signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, fmt.Errorf("parsing signed data failed: %v", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, nil, fmt.Errorf("token does not contain timestamp info")
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &content); err != nil {
+		return nil, nil, fmt.Errorf("parsing timestamp info failed: %v", err)
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return nil, nil, fmt.Errorf("parsing timestamp info failed: %v", err)
+	}
+	return &sd, &info, nil
+}
+
+func findSigner(sid asn1.RawValue, certs []*x509.Certificate) (*x509.Certificate, error) {
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		for _, c := range certs {
+			if bytes.Equal(c.SubjectKeyId, sid.Bytes) {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("signer certificate not found")
+	}
+	var ias issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+		return nil, fmt.Errorf("parsing signer identifier failed: %v", err)
+	}
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) && c.SerialNumber.Cmp(ias.SerialNumber) == 0 {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("signer certificate not found")
+}
+
+// checkSignedAttrs makes sure that the signed attributes cover the content
+// and name signer in a signing certificate attribute, as required by RFC 3161
+// to prevent substitution of the signer's certificate.
+func checkSignedAttrs(raw asn1.RawValue, eci encapContentInfo, hash crypto.Hash, signer *x509.Certificate) error {
+	if len(raw.FullBytes) == 0 {
+		return fmt.Errorf("missing signed attributes")
+	}
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(raw.FullBytes, &attrs, "set,tag:0"); err != nil {
+		return fmt.Errorf("parsing signed attributes failed: %v", err)
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(eci.EContent.Bytes, &content); err != nil {
+		return fmt.Errorf("parsing timestamp info failed: %v", err)
+	}
+	h := hash.New()
+	h.Write(content)
+
+	var contentType, digest, signingCert bool
+	for _, a := range attrs {
+		switch {
+		case a.Type.Equal(oidContentType):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &oid); err != nil || !oid.Equal(oidTSTInfo) {
+				return fmt.Errorf("signed content type mismatch")
+			}
+			contentType = true
+		case a.Type.Equal(oidMessageDigest):
+			var md []byte
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &md); err != nil || !bytes.Equal(md, h.Sum(nil)) {
+				return fmt.Errorf("signed message digest mismatch")
+			}
+			digest = true
+		case a.Type.Equal(oidSigningCert), a.Type.Equal(oidSigningCertV2):
+			if err := checkSigningCert(a, signer); err != nil {
+				return err
+			}
+			signingCert = true
+		}
+	}
+	if !contentType || !digest {
+		return fmt.Errorf("missing content type or message digest attribute")
+	}
+	if !signingCert {
+		return fmt.Errorf("missing signing certificate attribute")
+	}
+	return nil
+}
+
+// checkSigningCert makes sure that the ESSCertID or ESSCertIDv2 in the
+// signing certificate attribute a identifies signer.
+func checkSigningCert(a attribute, signer *x509.Certificate) error {
+	var sc signingCertificate
+	if _, err := asn1.Unmarshal(a.Values.Bytes, &sc); err != nil || len(sc.Certs) == 0 {
+		return fmt.Errorf("parsing signing certificate attribute failed")
+	}
+	var (
+		want, certHash []byte
+		is             issuerSerial
+	)
+	if a.Type.Equal(oidSigningCert) {
+		var id essCertID
+		if _, err := asn1.Unmarshal(sc.Certs[0].FullBytes, &id); err != nil {
+			return fmt.Errorf("parsing ESSCertID failed: %v", err)
+		}
+		h := sha1.Sum(signer.Raw)
+		want, certHash, is = h[:], id.CertHash, id.IssuerSerial
+	} else {
+		var id essCertIDv2
+		if _, err := asn1.Unmarshal(sc.Certs[0].FullBytes, &id); err != nil {
+			return fmt.Errorf("parsing ESSCertIDv2 failed: %v", err)
+		}
+		alg := id.HashAlgorithm.Algorithm
+		if len(alg) == 0 {
+			alg = oidSHA256
+		}
+		hash, err := digestAlgorithm(alg)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(signer.Raw)
+		want, certHash, is = h.Sum(nil), id.CertHash, id.IssuerSerial
+	}
+	if !bytes.Equal(certHash, want) {
+		return fmt.Errorf("signing certificate attribute does not match the signer")
+	}
+	if is.SerialNumber == nil {
+		return nil
+	}
+	if is.SerialNumber.Cmp(signer.SerialNumber) != 0 {
+		return fmt.Errorf("signing certificate attribute does not match the signer's serial number")
+	}
+	for _, name := range is.Issuer {
+		// directoryName [4] EXPLICIT Name
+		if name.Class == asn1.ClassContextSpecific && name.Tag == 4 && bytes.Equal(name.Bytes, signer.RawIssuer) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signing certificate attribute does not match the signer's issuer")
+}
+
+func signatureAlgorithm(digestAlg, sigAlg asn1.ObjectIdentifier) (x509.SignatureAlgorithm, crypto.Hash, error) {
+	hash, err := digestAlgorithm(digestAlg)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rsa := map[crypto.Hash]x509.SignatureAlgorithm{
+		crypto.SHA256: x509.SHA256WithRSA,
+		crypto.SHA384: x509.SHA384WithRSA,
+		crypto.SHA512: x509.SHA512WithRSA,
+	}
+	ecdsa := map[crypto.Hash]x509.SignatureAlgorithm{
+		crypto.SHA256: x509.ECDSAWithSHA256,
+		crypto.SHA384: x509.ECDSAWithSHA384,
+		crypto.SHA512: x509.ECDSAWithSHA512,
+	}
+	switch {
+	case sigAlg.Equal(oidRSAEncryption):
+		return rsa[hash], hash, nil
+	case sigAlg.Equal(oidSHA256WithRSA) && hash == crypto.SHA256,
+		sigAlg.Equal(oidSHA384WithRSA) && hash == crypto.SHA384,
+		sigAlg.Equal(oidSHA512WithRSA) && hash == crypto.SHA512:
+		return rsa[hash], hash, nil
+	case sigAlg.Equal(oidECPublicKey):
+		return ecdsa[hash], hash, nil
+	case sigAlg.Equal(oidECDSAWithSHA256) && hash == crypto.SHA256,
+		sigAlg.Equal(oidECDSAWithSHA384) && hash == crypto.SHA384,
+		sigAlg.Equal(oidECDSAWithSHA512) && hash == crypto.SHA512:
+		return ecdsa[hash], hash, nil
+	case sigAlg.Equal(oidEd25519):
+		return x509.PureEd25519, hash, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported signature algorithm %v", sigAlg)
+	}
+}
+
+func digestAlgorithm(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported digest algorithm %v", oid)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 the System Transparency Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trust_test
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/system-transparency/stboot/internal/tsatest"
+	"github.com/system-transparency/stboot/trust"
+)
+
+func TestTimestamp(t *testing.T) {
+	tsa, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+
+	digest := sha256.Sum256([]byte("signature"))
+	token, err := trust.HTTPTSA{URL: srv.URL}.Timestamp(digest)
+	require.NoError(t, err)
+
+	genTime, err := trust.VerifyTimestamp(token, digest, []*x509.Certificate{tsa.Root})
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), genTime, time.Minute)
+
+	_, err = trust.VerifyTimestamp(token, sha256.Sum256([]byte("other")), []*x509.Certificate{tsa.Root})
+	require.Error(t, err, "digest mismatch")
+
+	other, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = trust.VerifyTimestamp(token, digest, []*x509.Certificate{other.Root})
+	require.Error(t, err, "unknown TSA root")
+
+	token[len(token)-1] ^= 0xff
+	_, err = trust.VerifyTimestamp(token, digest, []*x509.Certificate{tsa.Root})
+	require.Error(t, err, "modified token")
+}
+
+func TestTimestampNonce(t *testing.T) {
+	tsa, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+	digest := sha256.Sum256([]byte("signature"))
+
+	tsa.Nonce = big.NewInt(42)
+	_, err = trust.HTTPTSA{URL: srv.URL}.Timestamp(digest)
+	require.Error(t, err, "mismatched nonce")
+
+	tsa.Nonce = big.NewInt(-1)
+	_, err = trust.HTTPTSA{URL: srv.URL}.Timestamp(digest)
+	require.Error(t, err, "missing nonce")
+}
+
+func TestTimestampOutsideTSAValidity(t *testing.T) {
+	tsa, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	tsa.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	digest := sha256.Sum256([]byte("signature"))
+	token, err := tsa.Timestamp(digest)
+	require.NoError(t, err)
+	_, err = trust.VerifyTimestamp(token, digest, []*x509.Certificate{tsa.Root})
+	require.Error(t, err)
+}
+
+func TestTimestampSigningCertificate(t *testing.T) {
+	tsa, err := tsatest.New(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte("signature"))
+	roots := []*x509.Certificate{tsa.Root}
+
+	tsa.SigningCert = 1
+	token, err := tsa.Timestamp(digest)
+	require.NoError(t, err)
+	_, err = trust.VerifyTimestamp(token, digest, roots)
+	require.NoError(t, err, "ESSCertID")
+
+	tsa.SigningCert = -1
+	token, err = tsa.Timestamp(digest)
+	require.NoError(t, err)
+	_, err = trust.VerifyTimestamp(token, digest, roots)
+	require.Error(t, err, "no signing certificate attribute")
+
+	for _, v := range []int{1, 2} {
+		tsa.SigningCert = v
+		tsa.CertIDFor = tsa.Root
+		token, err = tsa.Timestamp(digest)
+		require.NoError(t, err)
+		_, err = trust.VerifyTimestamp(token, digest, roots)
+		require.Error(t, err, "signing certificate attribute names another certificate, version %d", v)
+	}
+}